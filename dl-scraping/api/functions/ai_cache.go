@@ -0,0 +1,325 @@
+package functions
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// キャッシュの有効期間の既定値
+	defaultResponseCacheTtl = 7 * 24 * time.Hour
+	// メモリ上のキャッシュに置く件数の既定値
+	defaultResponseCacheSize = 1000
+)
+
+// CachedResponse はキャッシュに保存する応答
+type CachedResponse struct {
+	Model        string    `firestore:"model"`
+	Message      string    `firestore:"message"`
+	InputTokens  int       `firestore:"inputTokens"`
+	OutputTokens int       `firestore:"outputTokens"`
+	CreatedAt    time.Time `firestore:"createdAt"`
+	ExpiresAt    time.Time `firestore:"expiresAt"`
+}
+
+// ResponseCache はモデルの応答のキャッシュの保存先
+type ResponseCache interface {
+	// Get は期限内の応答を返す ない場合はnil
+	Get(ctx context.Context, key string) (*CachedResponse, error)
+	Set(ctx context.Context, key string, response CachedResponse) error
+}
+
+// responseCacheKey はモデルと問い合わせ内容からキャッシュのキーを作る
+// 画像は中身のハッシュで比べる
+func responseCacheKey(model string, request GenerateRequest) (string, error) {
+	type turn struct {
+		Role   string   `json:"role"`
+		Text   string   `json:"text"`
+		Images []string `json:"images"`
+	}
+	history := make([]turn, 0, len(request.History))
+	for _, message := range request.History {
+		history = append(history, turn{Role: message.Role, Text: message.Text, Images: imageHashes(message.Images)})
+	}
+	key, err := json.Marshal(struct {
+		Model              string                 `json:"model"`
+		History            []turn                 `json:"history"`
+		Prompt             string                 `json:"prompt"`
+		SystemInstructions string                 `json:"systemInstructions"`
+		Images             []string               `json:"images"`
+		Temperature        float64                `json:"temperature"`
+		ResponseFormat     map[string]interface{} `json:"responseFormat"`
+	}{model, history, request.Prompt, request.SystemInstructions, imageHashes(request.Images), request.Temperature, request.ResponseFormat})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func imageHashes(images []ImagePart) []string {
+	hashes := make([]string, 0, len(images))
+	for _, image := range images {
+		sum := sha256.Sum256(image.Data)
+		hashes = append(hashes, image.MimeType+":"+hex.EncodeToString(sum[:]))
+	}
+	return hashes
+}
+
+// CachedClient は同じ問い合わせにはキャッシュした応答を返すLLMClient
+// キャッシュから返した応答はCachedをtrueにし、トークンを使っていないのでUsageは0にする
+type CachedClient struct {
+	client LLMClient
+	model  string
+	cache  ResponseCache
+	ttl    time.Duration
+	// trueの場合はキャッシュを読まずに問い合わせ、結果で上書きする
+	refresh bool
+}
+
+// NewCachedClient はclientを包んで応答をキャッシュする キャッシュが無効な場合はclientをそのまま返す
+// refreshがtrueの場合はキャッシュを使わずに問い合わせ直す
+func NewCachedClient(client LLMClient, model *ModelConfig, refresh bool) LLMClient {
+	cache, err := getResponseCache()
+	if err != nil {
+		log.Printf("Failed to open response cache: %v", err)
+		return client
+	}
+	if cache == nil {
+		return client
+	}
+	// スタブと本物の応答が混ざらないようにモデル名を分ける
+	modelName := model.Name
+	if useStubProvider() {
+		modelName = stubModelPrefix + modelName
+	}
+	return &CachedClient{
+		client:  client,
+		model:   modelName,
+		cache:   cache,
+		ttl:     envDuration("AI_CACHE_TTL_MS", defaultResponseCacheTtl),
+		refresh: refresh,
+	}
+}
+
+// lookup はキャッシュから応答を探す 見つからない場合や読めない場合はnil
+func (c *CachedClient) lookup(ctx context.Context, key string) *GenerateResponse {
+	if c.refresh {
+		return nil
+	}
+	cached, err := c.cache.Get(ctx, key)
+	if err != nil {
+		log.Printf("Failed to read response cache: %v", err)
+		return nil
+	}
+	if cached == nil {
+		return nil
+	}
+	return &GenerateResponse{Model: cached.Model, Message: cached.Message, Cached: true}
+}
+
+// store は応答をキャッシュする スキーマを指定した問い合わせは、スキーマに合う応答だけを残す
+func (c *CachedClient) store(ctx context.Context, key string, request GenerateRequest, response *GenerateResponse) {
+	schema, _, err := responseFormatSchema(request.ResponseFormat)
+	if err != nil {
+		return
+	}
+	if schema != nil {
+		if _, err := validateStructured(schema, response.Message); err != nil {
+			return
+		}
+	}
+
+	now := time.Now()
+	err = c.cache.Set(ctx, key, CachedResponse{
+		Model:        response.Model,
+		Message:      response.Message,
+		InputTokens:  response.Usage.InputTokens,
+		OutputTokens: response.Usage.OutputTokens,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(c.ttl),
+	})
+	if err != nil {
+		log.Printf("Failed to write response cache: %v", err)
+	}
+}
+
+func (c *CachedClient) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	key, err := responseCacheKey(c.model, request)
+	if err != nil {
+		return nil, err
+	}
+	if response := c.lookup(ctx, key); response != nil {
+		return response, nil
+	}
+
+	response, err := c.client.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	c.store(ctx, key, request, response)
+	return response, nil
+}
+
+// GenerateStream はキャッシュにある場合は応答全体を1回でonDeltaに渡す
+func (c *CachedClient) GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error) {
+	key, err := responseCacheKey(c.model, request)
+	if err != nil {
+		return nil, err
+	}
+	if response := c.lookup(ctx, key); response != nil {
+		if err := onDelta(response.Message); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+
+	response, err := c.client.GenerateStream(ctx, request, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	c.store(ctx, key, request, response)
+	return response, nil
+}
+
+func (c *CachedClient) Close() error {
+	return c.client.Close()
+}
+
+var (
+	responseCacheOnce sync.Once
+	responseCache     ResponseCache
+	responseCacheErr  error
+)
+
+// getResponseCache は環境変数AI_CACHEで選んだキャッシュを返す
+// memory, firestore, offのいずれか 未指定の場合はcatalogStoreと同じ offの場合はnil
+func getResponseCache() (ResponseCache, error) {
+	responseCacheOnce.Do(func() {
+		store := os.Getenv("AI_CACHE")
+		if store == "" {
+			store = catalogStore()
+		}
+		switch store {
+		case "firestore":
+			client, err := newFirestoreClient(context.Background())
+			if err != nil {
+				responseCacheErr = err
+				return
+			}
+			responseCache = NewFirestoreResponseCache(client)
+		case "memory":
+			responseCache = NewLRUResponseCache(envInt("AI_CACHE_SIZE", defaultResponseCacheSize))
+		case "off":
+		default:
+			responseCacheErr = errors.New("unknown response cache: " + store)
+		}
+	})
+	return responseCache, responseCacheErr
+}
+
+// LRUResponseCache はメモリ上に件数を決めて置くキャッシュ 溢れた場合は最も使われていないものから消す
+type LRUResponseCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	response CachedResponse
+}
+
+func NewLRUResponseCache(capacity int) *LRUResponseCache {
+	return &LRUResponseCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUResponseCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := element.Value.(*lruEntry)
+	if !time.Now().Before(entry.response.ExpiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, nil
+	}
+	c.order.MoveToFront(element)
+	response := entry.response
+	return &response, nil
+}
+
+func (c *LRUResponseCache) Set(ctx context.Context, key string, response CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.capacity <= 0 {
+		return nil
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry).response = response
+		c.order.MoveToFront(element)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, response: response})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+// FirestoreResponseCache はaiCache/{key}に保存する
+// 期限切れのドキュメントは読むときに無視する 削除はexpiresAtにTTLポリシーを設定して任せる
+type FirestoreResponseCache struct {
+	client *firestore.Client
+}
+
+func NewFirestoreResponseCache(client *firestore.Client) *FirestoreResponseCache {
+	return &FirestoreResponseCache{client: client}
+}
+
+func (c *FirestoreResponseCache) Get(ctx context.Context, key string) (*CachedResponse, error) {
+	docSnap, err := c.client.Collection("aiCache").Doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var response CachedResponse
+	if err := docSnap.DataTo(&response); err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(response.ExpiresAt) {
+		return nil, nil
+	}
+	return &response, nil
+}
+
+func (c *FirestoreResponseCache) Set(ctx context.Context, key string, response CachedResponse) error {
+	_, err := c.client.Collection("aiCache").Doc(key).Set(ctx, response)
+	return err
+}
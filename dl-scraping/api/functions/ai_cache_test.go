@@ -0,0 +1,193 @@
+package functions
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useMemoryResponseCache はテストの間だけ空のメモリ上のキャッシュを使う
+func useMemoryResponseCache(t *testing.T) *LRUResponseCache {
+	t.Helper()
+	cache := NewLRUResponseCache(defaultResponseCacheSize)
+
+	getResponseCache()
+	previous, previousErr := responseCache, responseCacheErr
+	responseCache, responseCacheErr = cache, nil
+	t.Cleanup(func() {
+		responseCache, responseCacheErr = previous, previousErr
+	})
+	return cache
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	base := GenerateRequest{
+		Prompt:             "describe",
+		SystemInstructions: "label",
+		Images:             []ImagePart{{MimeType: "image/jpeg", Data: []byte("jpeg")}},
+		Temperature:        0.2,
+		ResponseFormat:     map[string]interface{}{"type": "json_object"},
+	}
+	key, _ := responseCacheKey("gpt-4o", base)
+	if same, _ := responseCacheKey("gpt-4o", base); same != key {
+		t.Error("expected the same key for the same request")
+	}
+
+	changes := map[string]func(r *GenerateRequest) string{
+		"prompt": func(r *GenerateRequest) string { r.Prompt = "other"; return "gpt-4o" },
+		"system": func(r *GenerateRequest) string { r.SystemInstructions = "other"; return "gpt-4o" },
+		"image": func(r *GenerateRequest) string {
+			r.Images = []ImagePart{{MimeType: "image/jpeg", Data: []byte("png")}}
+			return "gpt-4o"
+		},
+		"temperature": func(r *GenerateRequest) string { r.Temperature = 0; return "gpt-4o" },
+		"schema":      func(r *GenerateRequest) string { r.ResponseFormat = nil; return "gpt-4o" },
+		"model":       func(r *GenerateRequest) string { return "gpt-4o-mini" },
+	}
+	for name, change := range changes {
+		request := base
+		model := change(&request)
+		if other, _ := responseCacheKey(model, request); other == key {
+			t.Errorf("expected a different key when %s changes", name)
+		}
+	}
+}
+
+func TestLRUResponseCache(t *testing.T) {
+	ctx := context.Background()
+	cache := NewLRUResponseCache(2)
+	valid := CachedResponse{Message: "ok", ExpiresAt: time.Now().Add(time.Hour)}
+
+	cache.Set(ctx, "a", valid)
+	cache.Set(ctx, "b", valid)
+	cache.Get(ctx, "a")
+	// 最も使われていないbが消える
+	cache.Set(ctx, "c", valid)
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if response, _ := cache.Get(ctx, key); (response != nil) != want {
+			t.Errorf("Get(%q) = %v, want present %v", key, response, want)
+		}
+	}
+
+	cache.Set(ctx, "expired", CachedResponse{Message: "old", ExpiresAt: time.Now().Add(-time.Second)})
+	if response, _ := cache.Get(ctx, "expired"); response != nil {
+		t.Errorf("expected expired entry to be ignored; got %+v", response)
+	}
+}
+
+func TestCachedClient(t *testing.T) {
+	var calls int32
+	setupFakeOpenAi(t, func(request map[string]interface{}) string {
+		if atomic.AddInt32(&calls, 1) == 1 && request["response_format"] != nil {
+			// 1回目はスキーマに合わない応答を返す
+			return `{"name": "a"}`
+		}
+		return `{"name": "朝顔", "ok": true}`
+	})
+	useMemoryUsage(t)
+	model, _ := resolveModel("")
+	newClient := func(refresh bool) *UsageRecorder {
+		client, err := NewLLMClient(context.Background(), model)
+		if err != nil {
+			t.Fatalf("NewLLMClient() error = %v", err)
+		}
+		return NewUsageRecorder(NewCachedClient(client, model, refresh), "", "test")
+	}
+
+	recorder := newClient(false)
+	if _, _, err := GenerateTyped[testItem](context.Background(), recorder, GenerateRequest{Prompt: "答えて"}, 1); err != nil {
+		t.Fatalf("GenerateTyped() error = %v", err)
+	}
+	// スキーマに合わなかった応答はキャッシュされないので、同じ問い合わせでもモデルに送る
+	// その応答はスキーマに合うのでキャッシュされ、3回目はモデルに送らない
+	for i := 0; i < 2; i++ {
+		result, response, err := GenerateTyped[testItem](context.Background(), recorder, GenerateRequest{Prompt: "答えて"}, 1)
+		if err != nil || result.Name != "朝顔" {
+			t.Fatalf("unexpected result: %+v, %v", result, err)
+		}
+		// キャッシュから返したかは最後の問い合わせの応答に合わせる
+		if response.Cached != (i == 1) {
+			t.Errorf("response %d: cached = %v", i, response.Cached)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("expected 3 calls; got %d", calls)
+	}
+	records := recorder.Records()
+	if len(records) != 4 || records[0].Cached || records[2].Cached {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if last := records[3]; !last.Cached || last.Cost != 0 || last.InputTokens != 0 {
+		t.Errorf("expected cached record without cost; got %+v", last)
+	}
+
+	// ストリームでもキャッシュを使う
+	scripted := &scriptedClient{replies: []string{"紅葉です"}}
+	var deltas []string
+	onDelta := func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		response, err := NewCachedClient(scripted, model, false).GenerateStream(context.Background(), GenerateRequest{Prompt: "秋は?"}, onDelta)
+		if err != nil || response.Message != "紅葉です" || response.Cached != (i == 1) {
+			t.Errorf("unexpected stream response %d: %+v, %v", i, response, err)
+		}
+	}
+	// 1回目は1文字ずつ、2回目はまとめて届く
+	if len(deltas) != 5 || deltas[4] != "紅葉です" || len(scripted.requests) != 1 {
+		t.Errorf("unexpected deltas %q after %d requests", deltas, len(scripted.requests))
+	}
+
+	// refreshの場合はキャッシュを読まない
+	if response, _ := newClient(true).Generate(context.Background(), GenerateRequest{Prompt: "答えて"}); response.Cached || atomic.LoadInt32(&calls) != 4 {
+		t.Errorf("expected refresh to skip the cache; got %+v after %d calls", response, calls)
+	}
+}
+
+func TestTagEffects_cache(t *testing.T) {
+	setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	useMemoryCatalog(t)
+	useMemoryTags(t)
+	useMemoryUsage(t)
+	calls := setupTaggingModel(t)
+
+	_, first := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword, EffectIds: []string{"1", "2"}})
+	// 保存したタグを消しても、同じ画像はキャッシュから判定する
+	useMemoryTags(t)
+	_, second := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword, EffectIds: []string{"1", "2"}})
+	if first.Tagged != 2 || second.Tagged != 2 || atomic.LoadInt32(calls) != 2 {
+		t.Fatalf("expected second run to use the cache; got %+v, %+v after %d calls", first, second, atomic.LoadInt32(calls))
+	}
+	for _, record := range second.Usage {
+		if !record.Cached || record.Cost != 0 {
+			t.Errorf("expected cached usage; got %+v", record)
+		}
+	}
+
+	// forceの場合はモデルに問い合わせ直す
+	_, forced := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword, EffectIds: []string{"1"}, Force: true})
+	if forced.Tagged != 1 || atomic.LoadInt32(calls) != 3 || forced.Usage[0].Cached {
+		t.Errorf("expected force to skip the cache; got %+v after %d calls", forced, atomic.LoadInt32(calls))
+	}
+	if !strings.HasPrefix(forced.Tags["1"].Model, "gpt-4o-mini") {
+		t.Errorf("unexpected tags: %+v", forced.Tags["1"])
+	}
+}
+
+func TestGetResponseCache_off(t *testing.T) {
+	getResponseCache()
+	previous, previousErr := responseCache, responseCacheErr
+	responseCache, responseCacheErr = nil, nil
+	t.Cleanup(func() {
+		responseCache, responseCacheErr = previous, previousErr
+	})
+
+	client := &scriptedClient{}
+	if cached := NewCachedClient(client, &ModelConfig{Name: "gpt-4o"}, false); cached != client {
+		t.Errorf("expected the client itself when the cache is off; got %T", cached)
+	}
+}
@@ -0,0 +1,199 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// defaultGeminiRegion はモデルの設定にリージョンがない場合に使う
+const defaultGeminiRegion = "asia-northeast1"
+
+// GeminiClient はVertex AIのGeminiで問い合わせる
+type GeminiClient struct {
+	modelName string
+	maxTokens int
+	client    *genai.Client
+}
+
+// newGeminiClient はVertex AIのクライアントを作る
+// SERVICE_ACCOUNT_KEYがあればそのサービスアカウントで、なければ既定の認証情報で接続する
+// リージョンと接続先はモデルの設定に従う
+func newGeminiClient(ctx context.Context, model *ModelConfig) (*GeminiClient, error) {
+	var opts []option.ClientOption
+	if model.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(model.Endpoint))
+	}
+	sa, err := serviceAccountOption()
+	if err == nil {
+		opts = append(opts, sa)
+	} else if !errors.Is(err, ErrServiceAccountKeyNotSet) {
+		return nil, err
+	}
+
+	region := model.Region
+	if region == "" {
+		region = defaultGeminiRegion
+	}
+	client, err := genai.NewClient(ctx, firebaseProjectId, region, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GeminiClient{modelName: model.Name, maxTokens: model.MaxTokens, client: client}, nil
+}
+
+// chat はリクエストの設定をしたモデルで、それまでの会話を持ったチャットと送る内容を返す
+func (c *GeminiClient) chat(request GenerateRequest) (*genai.ChatSession, []genai.Part, error) {
+	gemini := c.client.GenerativeModel(c.modelName)
+	if request.SystemInstructions != "" {
+		gemini.SystemInstruction = &genai.Content{
+			Role:  "user",
+			Parts: []genai.Part{genai.Text(request.SystemInstructions)},
+		}
+	}
+	gemini.SetTemperature(float32(request.Temperature))
+	if c.maxTokens > 0 {
+		gemini.SetMaxOutputTokens(int32(c.maxTokens))
+	}
+
+	promptParts := geminiParts(request.Prompt, request.Images)
+
+	// スキーマが指定されている場合は、geminiのスキーマに変換して設定
+	schema, jsonMode, err := responseFormatSchema(request.ResponseFormat)
+	if err != nil {
+		return nil, nil, err
+	}
+	if jsonMode {
+		gemini.GenerationConfig.ResponseMIMEType = "application/json"
+	}
+	if schema != nil {
+		geminiSchema, err := convertJsonSchemaToGeminiSchema(schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		gemini.GenerationConfig.ResponseSchema = geminiSchema
+	}
+
+	chat := gemini.StartChat()
+	for _, message := range request.History {
+		role := "user"
+		if message.Role == RoleAssistant {
+			role = "model"
+		}
+		chat.History = append(chat.History, &genai.Content{Role: role, Parts: geminiParts(message.Text, message.Images)})
+	}
+	return chat, promptParts, nil
+}
+
+// geminiParts は文章と画像を送る形にする 画像は文章の前に置く
+func geminiParts(text string, images []ImagePart) []genai.Part {
+	var parts []genai.Part
+	for _, image := range images {
+		parts = append(parts, genai.Blob{MIMEType: image.MimeType, Data: image.Data})
+	}
+	if text != "" {
+		parts = append(parts, genai.Text(text))
+	}
+	return parts
+}
+
+// geminiText は応答の文章の部分をつなげる 文章がなければエラーを返す
+func geminiText(parts []genai.Part) (string, error) {
+	var message strings.Builder
+	found := false
+	for _, part := range parts {
+		if text, ok := part.(genai.Text); ok {
+			message.WriteString(string(text))
+			found = true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("gemini: no text in response")
+	}
+	return message.String(), nil
+}
+
+func (c *GeminiClient) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	chat, promptParts, err := c.chat(request)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := chat.SendMessage(ctx, promptParts...)
+	if err != nil {
+		return nil, fmt.Errorf("error generating content: %w", err)
+	}
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return nil, fmt.Errorf("gemini: empty response")
+	}
+	message, err := geminiText(resp.Candidates[0].Content.Parts)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GenerateResponse{
+		Model:   c.modelName,
+		Message: message,
+	}
+	if resp.UsageMetadata != nil {
+		response.Usage = geminiUsage(resp.UsageMetadata)
+	}
+	return response, nil
+}
+
+func (c *GeminiClient) GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error) {
+	chat, promptParts, err := c.chat(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GenerateResponse{Model: c.modelName}
+	var message strings.Builder
+	iter := chat.SendMessageStream(ctx, promptParts...)
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error generating content: %w", err)
+		}
+
+		// 使用量は最後の応答の値が合計になる
+		if resp.UsageMetadata != nil {
+			response.Usage = geminiUsage(resp.UsageMetadata)
+		}
+		if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+			continue
+		}
+		for _, part := range resp.Candidates[0].Content.Parts {
+			text, ok := part.(genai.Text)
+			if !ok || text == "" {
+				continue
+			}
+			message.WriteString(string(text))
+			if err := onDelta(string(text)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	response.Message = message.String()
+	return response, nil
+}
+
+func geminiUsage(metadata *genai.UsageMetadata) TokenUsage {
+	return TokenUsage{
+		InputTokens:  int(metadata.PromptTokenCount),
+		OutputTokens: int(metadata.CandidatesTokenCount),
+	}
+}
+
+func (c *GeminiClient) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,21 @@
+package functions
+
+import (
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+func Test_geminiText(t *testing.T) {
+	// 文章の部分は全てつなげ、それ以外の部分は含めない
+	text, err := geminiText([]genai.Part{genai.Text(`{"a": `), genai.Blob{MIMEType: "image/png", Data: []byte{1}}, genai.Text(`1}`)})
+	if err != nil || text != `{"a": 1}` {
+		t.Errorf("geminiText() = %q, %v", text, err)
+	}
+
+	for _, parts := range [][]genai.Part{nil, {genai.Blob{MIMEType: "image/png"}}} {
+		if _, err := geminiText(parts); err == nil {
+			t.Errorf("expected an error for %v", parts)
+		}
+	}
+}
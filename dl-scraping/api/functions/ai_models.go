@@ -0,0 +1,197 @@
+package functions
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// defaultModelAlias は環境変数AI_MODELが未指定の場合に使うモデル
+const defaultModelAlias = "gpt-4o-mini"
+
+const (
+	ProviderOpenAi = "openai"
+	ProviderGemini = "gemini"
+	ProviderStub   = "stub"
+)
+
+var ErrUnsupportedCapability = errors.New("model does not support the request")
+
+// defaultModelsConfig は組み込みのモデルの設定
+//
+//go:embed models.json
+var defaultModelsConfig []byte
+
+// ModelConfig は1つのモデルの設定
+type ModelConfig struct {
+	// APIに渡すモデル名 料金の記録にも使う
+	Name string `json:"name"`
+	// Nameの他に指定できる名前
+	Aliases  []string `json:"aliases"`
+	Provider string   `json:"provider"`
+	// 空の場合はプロバイダの既定値 OpenAIはOPEN_AI_API_URLも使える
+	Endpoint string `json:"endpoint"`
+	// Geminiのリージョン
+	Region string `json:"region"`
+	// APIキーを入れた環境変数の名前 空の場合はOPEN_AI_API_KEY
+	ApiKeyEnv string `json:"apiKeyEnv"`
+	// 1回の応答の最大トークン数 0は指定しない
+	MaxTokens int        `json:"maxTokens"`
+	Vision    bool       `json:"vision"`
+	JsonMode  bool       `json:"jsonMode"`
+	Price     ModelPrice `json:"price"`
+}
+
+// Check はモデルがリクエストに対応しているかを問い合わせる前に確かめる
+func (m *ModelConfig) Check(request GenerateRequest) error {
+	hasImages := len(request.Images) > 0
+	for _, message := range request.History {
+		hasImages = hasImages || len(message.Images) > 0
+	}
+	if hasImages && !m.Vision {
+		return fmt.Errorf("%w: %s does not accept images", ErrUnsupportedCapability, m.Name)
+	}
+	_, jsonMode, err := responseFormatSchema(request.ResponseFormat)
+	if err != nil {
+		return err
+	}
+	if jsonMode && !m.JsonMode {
+		return fmt.Errorf("%w: %s does not support JSON mode", ErrUnsupportedCapability, m.Name)
+	}
+	return nil
+}
+
+// ModelRegistry は名前と別名からモデルの設定を引く
+type ModelRegistry struct {
+	models []ModelConfig
+	byName map[string]int
+}
+
+// NewModelRegistry はconfigsから登録簿を作る 名前と別名の重複や未知のプロバイダはエラー
+func NewModelRegistry(configs []ModelConfig) (*ModelRegistry, error) {
+	registry := &ModelRegistry{byName: make(map[string]int)}
+	for i, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("models[%d]: name is empty", i)
+		}
+		switch config.Provider {
+		case ProviderOpenAi, ProviderGemini, ProviderStub:
+		default:
+			return nil, fmt.Errorf("models[%d]: unknown provider %q", i, config.Provider)
+		}
+		for _, name := range append([]string{config.Name}, config.Aliases...) {
+			if _, ok := registry.byName[name]; ok {
+				return nil, fmt.Errorf("models[%d]: duplicate name %q", i, name)
+			}
+			registry.byName[name] = len(registry.models)
+		}
+		registry.models = append(registry.models, config)
+	}
+	return registry, nil
+}
+
+// Lookup は名前か別名でモデルを引く
+func (r *ModelRegistry) Lookup(name string) (*ModelConfig, error) {
+	index, ok := r.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModel, name)
+	}
+	model := r.models[index]
+	return &model, nil
+}
+
+// Models は登録されているモデルを設定の順に返す
+func (r *ModelRegistry) Models() []ModelConfig {
+	return append([]ModelConfig{}, r.models...)
+}
+
+// loadModelRegistry は組み込みの設定に、環境変数AI_MODELS_CONFIGのファイルの設定を重ねる
+// ファイルのモデルは同じNameの組み込みのモデルを置き換え、それ以外は追加する
+func loadModelRegistry() (*ModelRegistry, error) {
+	var configs []ModelConfig
+	if err := json.Unmarshal(defaultModelsConfig, &configs); err != nil {
+		return nil, fmt.Errorf("invalid models.json: %w", err)
+	}
+
+	if path := os.Getenv("AI_MODELS_CONFIG"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read models config: %w", err)
+		}
+		var overrides []ModelConfig
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return nil, fmt.Errorf("invalid models config %s: %w", path, err)
+		}
+		for _, override := range overrides {
+			replaced := false
+			for i := range configs {
+				if configs[i].Name == override.Name {
+					configs[i] = override
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				configs = append(configs, override)
+			}
+		}
+	}
+	return NewModelRegistry(configs)
+}
+
+var (
+	modelRegistryOnce sync.Once
+	modelRegistry     *ModelRegistry
+	modelRegistryErr  error
+)
+
+func getModelRegistry() (*ModelRegistry, error) {
+	modelRegistryOnce.Do(func() {
+		modelRegistry, modelRegistryErr = loadModelRegistry()
+	})
+	return modelRegistry, modelRegistryErr
+}
+
+// resolveModel は名前からモデルの設定を返す
+// 空文字の場合は環境変数AI_MODEL、それもなければdefaultModelAlias
+func resolveModel(name string) (*ModelConfig, error) {
+	if name == "" {
+		name = os.Getenv("AI_MODEL")
+	}
+	if name == "" {
+		name = defaultModelAlias
+	}
+	registry, err := getModelRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return registry.Lookup(name)
+}
+
+// checkedClient は問い合わせる前にモデルがリクエストに対応しているかを確かめる
+type checkedClient struct {
+	model  *ModelConfig
+	client LLMClient
+}
+
+func (c *checkedClient) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	if err := c.model.Check(request); err != nil {
+		return nil, err
+	}
+	return c.client.Generate(ctx, request)
+}
+
+func (c *checkedClient) GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error) {
+	if err := c.model.Check(request); err != nil {
+		return nil, err
+	}
+	return c.client.GenerateStream(ctx, request, onDelta)
+}
+
+func (c *checkedClient) Close() error {
+	return c.client.Close()
+}
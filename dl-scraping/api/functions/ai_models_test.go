@@ -0,0 +1,151 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// useModelRegistry はテストの間だけ環境変数AI_MODELS_CONFIGのconfigを重ねた登録簿を使う
+func useModelRegistry(t *testing.T, config string) *ModelRegistry {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "models.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AI_MODELS_CONFIG", path)
+	registry, err := loadModelRegistry()
+	if err != nil {
+		t.Fatalf("loadModelRegistry() error = %v", err)
+	}
+
+	getModelRegistry()
+	previous, previousErr := modelRegistry, modelRegistryErr
+	modelRegistry, modelRegistryErr = registry, nil
+	t.Cleanup(func() {
+		modelRegistry, modelRegistryErr = previous, previousErr
+	})
+	return registry
+}
+
+func TestModelRegistry_lookup(t *testing.T) {
+	registry, err := getModelRegistry()
+	if err != nil {
+		t.Fatalf("getModelRegistry() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		model    string
+		provider string
+	}{
+		{"gpt-4o", "gpt-4o-2024-08-06", ProviderOpenAi},
+		{"gpt-4o-mini-2024-07-18", "gpt-4o-mini-2024-07-18", ProviderOpenAi},
+		{"gemini-1.5-pro", "gemini-1.5-pro", ProviderGemini},
+	}
+	for _, tt := range tests {
+		model, err := registry.Lookup(tt.name)
+		if err != nil {
+			t.Errorf("Lookup(%q) error = %v", tt.name, err)
+			continue
+		}
+		if model.Name != tt.model || model.Provider != tt.provider || !model.Vision || model.Price.InputPerMillion == 0 {
+			t.Errorf("Lookup(%q) = %+v", tt.name, model)
+		}
+	}
+	if _, err := registry.Lookup("gpt-3"); !errors.Is(err, ErrUnknownModel) {
+		t.Errorf("expected ErrUnknownModel; got %v", err)
+	}
+
+	t.Setenv("AI_MODEL", "gemini-1.5-flash")
+	if model, _ := resolveModel(""); model.Name != "gemini-1.5-flash" || model.Region != "asia-northeast1" {
+		t.Errorf("expected AI_MODEL to be used; got %+v", model)
+	}
+	t.Setenv("AI_MODEL", "")
+	if model, _ := resolveModel(""); model.Name != "gpt-4o-mini-2024-07-18" {
+		t.Errorf("expected default model; got %+v", model)
+	}
+}
+
+func TestModelRegistry_config(t *testing.T) {
+	useModelRegistry(t, `[
+		{"name": "gemini-1.5-flash", "aliases": ["flash"], "provider": "gemini", "region": "us-central1", "vision": true, "jsonMode": true},
+		{"name": "local-text", "aliases": ["text"], "provider": "openai", "endpoint": "http://localhost:8080/v1/chat/completions", "price": {"inputPerMillion": 1, "outputPerMillion": 1}}
+	]`)
+
+	flash, err := resolveModel("flash")
+	if err != nil || flash.Region != "us-central1" {
+		t.Errorf("expected overridden region; got %+v, %v", flash, err)
+	}
+	if model, err := resolveModel("gpt-4o"); err != nil || model.Name != "gpt-4o-2024-08-06" {
+		t.Errorf("expected built-in models to remain; got %+v, %v", model, err)
+	}
+	if cost := estimateCost("local-text", TokenUsage{InputTokens: 1000000}); cost != 1 {
+		t.Errorf("expected price from config; got %v", cost)
+	}
+	// 上書きした設定に料金がなければ0
+	if cost := estimateCost("gemini-1.5-flash", TokenUsage{InputTokens: 1000000}); cost != 0 {
+		t.Errorf("expected no price; got %v", cost)
+	}
+
+	invalid := []string{
+		`[{"name": "a", "provider": "openai"}, {"name": "b", "aliases": ["a"], "provider": "openai"}]`,
+		`[{"name": "a", "provider": "anthropic"}]`,
+		`[{"provider": "openai"}]`,
+		`{}`,
+	}
+	for _, config := range invalid {
+		path := filepath.Join(t.TempDir(), "models.json")
+		os.WriteFile(path, []byte(config), 0o644)
+		t.Setenv("AI_MODELS_CONFIG", path)
+		if _, err := loadModelRegistry(); err == nil {
+			t.Errorf("expected error for %s", config)
+		}
+	}
+}
+
+func TestNewLLMClient_capabilities(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(okOpenAiBody))
+	}))
+	t.Cleanup(server.Close)
+	useModelRegistry(t, `[{"name": "text-only", "provider": "openai", "endpoint": "`+server.URL+`", "maxTokens": 100}]`)
+
+	model, _ := resolveModel("text-only")
+	client, err := NewLLMClient(context.Background(), model)
+	if err != nil {
+		t.Fatalf("NewLLMClient() error = %v", err)
+	}
+
+	requests := []GenerateRequest{
+		{Prompt: "describe", Images: []ImagePart{{MimeType: "image/jpeg", Data: []byte("jpeg")}}},
+		{Prompt: "answer", ResponseFormat: map[string]interface{}{"type": "json_object"}},
+	}
+	for _, request := range requests {
+		if _, err := client.Generate(context.Background(), request); !errors.Is(err, ErrUnsupportedCapability) {
+			t.Errorf("expected ErrUnsupportedCapability; got %v", err)
+		}
+		if _, err := client.GenerateStream(context.Background(), request, func(string) error { return nil }); !errors.Is(err, ErrUnsupportedCapability) {
+			t.Errorf("expected ErrUnsupportedCapability for stream; got %v", err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Errorf("expected no calls for unsupported requests; got %d", calls)
+	}
+
+	if _, err := client.Generate(context.Background(), GenerateRequest{Prompt: "hello"}); err != nil || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected call to configured endpoint; got %v after %d calls", err, calls)
+	}
+
+	// タグ付けは画像を受け付けないモデルを断る
+	response, _ := postTagEffects(t, RequestTagEffects{EffectIds: []string{"1"}, Model: "text-only"})
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("expected status BadRequest; got %v", response.Code)
+	}
+}
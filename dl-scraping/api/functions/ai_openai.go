@@ -0,0 +1,489 @@
+package functions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOpenAiUrl = "https://api.openai.com/v1/chat/completions"
+	// 失敗した場合に再試行する回数の既定値
+	defaultOpenAiMaxRetries = 3
+	// 1回の問い合わせの制限時間の既定値
+	defaultOpenAiTimeout = 60 * time.Second
+	// 再試行までの待ち時間 1回ごとに倍にする
+	openAiRetryBaseDelay = 500 * time.Millisecond
+	openAiRetryMaxDelay  = 30 * time.Second
+)
+
+var (
+	ErrRateLimited           = errors.New("openai: rate limited")
+	ErrInsufficientQuota     = errors.New("openai: insufficient quota")
+	ErrContextLengthExceeded = errors.New("openai: context length exceeded")
+	ErrInvalidApiKey         = errors.New("openai: invalid api key")
+	ErrRefused               = errors.New("openai: request refused by model")
+	ErrEmptyResponse         = errors.New("openai: empty response")
+)
+
+// OpenAiError はOpenAIがエラーとして返した内容
+// errors.IsでErrRateLimitedなどと比べられる
+type OpenAiError struct {
+	StatusCode int
+	Type       string
+	Code       string
+	Param      string
+	Message    string
+	// Retry-Afterで指定された待ち時間 指定がなければ0
+	RetryAfter time.Duration
+}
+
+func (e *OpenAiError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("openai: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("openai: %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *OpenAiError) Is(target error) bool {
+	switch target {
+	case ErrInsufficientQuota:
+		return e.Code == "insufficient_quota"
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests && e.Code != "insufficient_quota"
+	case ErrContextLengthExceeded:
+		return e.Code == "context_length_exceeded"
+	case ErrInvalidApiKey:
+		return e.Code == "invalid_api_key" || e.StatusCode == http.StatusUnauthorized
+	}
+	return false
+}
+
+// Retryable は待てば成功する可能性があるエラーかを返す
+func (e *OpenAiError) Retryable() bool {
+	switch {
+	case errors.Is(e, ErrInsufficientQuota):
+		return false
+	case e.StatusCode == http.StatusTooManyRequests, e.StatusCode == http.StatusRequestTimeout:
+		return true
+	case e.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+type openAiErrorResponse struct {
+	Error struct {
+		Message string      `json:"message"`
+		Type    string      `json:"type"`
+		Param   string      `json:"param"`
+		Code    interface{} `json:"code"`
+	} `json:"error"`
+}
+
+type openAiChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Role    string  `json:"role"`
+			Content *string `json:"content"`
+			Refusal *string `json:"refusal"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// openAiChatChunk はstreamで届く1つ分のデータ
+type openAiChatChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+			Refusal string `json:"refusal"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// OpenAiClient はOpenAIのChat Completions APIで問い合わせる
+type OpenAiClient struct {
+	modelName  string
+	apiKey     string
+	url        string
+	maxTokens  int
+	httpClient *http.Client
+
+	maxRetries int
+	timeout    time.Duration
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+// newOpenAiClient はモデルの設定からクライアントを作る
+// キーはmodel.ApiKeyEnvの環境変数(既定はOPEN_AI_API_KEY)から読む
+// 問い合わせ先はmodel.Endpoint、なければOPEN_AI_API_URL、どちらもなければOpenAI
+// 再試行の回数と1回の制限時間はOPEN_AI_MAX_RETRIES, OPEN_AI_TIMEOUT_MSで変えられる
+func newOpenAiClient(model *ModelConfig) *OpenAiClient {
+	url := model.Endpoint
+	if url == "" {
+		url = os.Getenv("OPEN_AI_API_URL")
+	}
+	if url == "" {
+		url = defaultOpenAiUrl
+	}
+	apiKeyEnv := model.ApiKeyEnv
+	if apiKeyEnv == "" {
+		apiKeyEnv = "OPEN_AI_API_KEY"
+	}
+	return &OpenAiClient{
+		modelName:  model.Name,
+		apiKey:     os.Getenv(apiKeyEnv),
+		url:        url,
+		maxTokens:  model.MaxTokens,
+		httpClient: &http.Client{},
+		maxRetries: envInt("OPEN_AI_MAX_RETRIES", defaultOpenAiMaxRetries),
+		timeout:    envDuration("OPEN_AI_TIMEOUT_MS", defaultOpenAiTimeout),
+		baseDelay:  openAiRetryBaseDelay,
+		maxDelay:   openAiRetryMaxDelay,
+	}
+}
+
+// requestBody はChat Completions APIに送るJSONを組み立てる
+func (c *OpenAiClient) requestBody(request GenerateRequest) map[string]interface{} {
+	var messages []map[string]interface{}
+	if request.SystemInstructions != "" {
+		messages = append(messages, map[string]interface{}{
+			"role": "system",
+			"content": []map[string]interface{}{
+				{"type": "text", "text": request.SystemInstructions},
+			},
+		})
+	}
+	for _, message := range request.History {
+		if message.Role == RoleAssistant {
+			messages = append(messages, map[string]interface{}{
+				"role":    "assistant",
+				"content": message.Text,
+			})
+			continue
+		}
+		messages = append(messages, map[string]interface{}{
+			"role":    "user",
+			"content": openAiUserContent(message.Text, message.Images),
+		})
+	}
+	messages = append(messages, map[string]interface{}{
+		"role":    "user",
+		"content": openAiUserContent(request.Prompt, request.Images),
+	})
+
+	reqBody := map[string]interface{}{
+		"model":       c.modelName,
+		"messages":    messages,
+		"temperature": request.Temperature,
+	}
+	if request.ResponseFormat != nil {
+		reqBody["response_format"] = request.ResponseFormat
+	}
+	if c.maxTokens > 0 {
+		reqBody["max_tokens"] = c.maxTokens
+	}
+	return reqBody
+}
+
+// openAiUserContent はユーザーの発言の文章と画像を送る形にする
+func openAiUserContent(text string, images []ImagePart) []map[string]interface{} {
+	content := []map[string]interface{}{
+		{"type": "text", "text": text},
+	}
+	for _, image := range images {
+		content = append(content, map[string]interface{}{
+			"type": "image_url",
+			"image_url": map[string]string{
+				"url": image.DataUrl(),
+			},
+		})
+	}
+	return content
+}
+
+func (c *OpenAiClient) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	reqBodyJson, err := json.Marshal(c.requestBody(request))
+	if err != nil {
+		return nil, err
+	}
+
+	var resBody openAiChatResponse
+	err = c.doWithRetry(ctx, func(ctx context.Context) error {
+		resp, err := c.post(ctx, reqBodyJson)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		resBody = openAiChatResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&resBody); err != nil {
+			return fmt.Errorf("openai: invalid response: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resBody.Choices) == 0 {
+		return nil, ErrEmptyResponse
+	}
+	message := resBody.Choices[0].Message
+	if message.Refusal != nil && *message.Refusal != "" {
+		return nil, fmt.Errorf("%w: %s", ErrRefused, *message.Refusal)
+	}
+	if message.Content == nil {
+		return nil, ErrEmptyResponse
+	}
+
+	response := &GenerateResponse{
+		Model:   c.modelName,
+		Message: *message.Content,
+	}
+	if resBody.Usage != nil {
+		response.Usage = TokenUsage{
+			InputTokens:  resBody.Usage.PromptTokens,
+			OutputTokens: resBody.Usage.CompletionTokens,
+		}
+	}
+	return response, nil
+}
+
+// GenerateStream はstreamを有効にして問い合わせ、SSEで届く差分をonDeltaに渡す
+// 再試行するのは接続して応答が返るまでで、受信を始めた後は再試行しない
+func (c *OpenAiClient) GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error) {
+	reqBody := c.requestBody(request)
+	reqBody["stream"] = true
+	// 最後のchunkに使用量を含めてもらう
+	reqBody["stream_options"] = map[string]interface{}{"include_usage": true}
+	reqBodyJson, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// 受信中に制限時間が切れないように、ここではctxだけで打ち切る
+	var resp *http.Response
+	err = c.doWithRetry(ctx, func(context.Context) error {
+		var err error
+		resp, err = c.post(ctx, reqBodyJson)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response := &GenerateResponse{Model: c.modelName}
+	var message strings.Builder
+	var refusal strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAiChatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("openai: invalid stream chunk: %w", err)
+		}
+		if chunk.Error != nil {
+			return nil, &OpenAiError{
+				StatusCode: http.StatusOK,
+				Type:       chunk.Error.Type,
+				Message:    chunk.Error.Message,
+			}
+		}
+		if chunk.Usage != nil {
+			response.Usage = TokenUsage{
+				InputTokens:  chunk.Usage.PromptTokens,
+				OutputTokens: chunk.Usage.CompletionTokens,
+			}
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		refusal.WriteString(delta.Refusal)
+		if delta.Content == "" {
+			continue
+		}
+		message.WriteString(delta.Content)
+		if err := onDelta(delta.Content); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("openai: failed to read stream: %w", err)
+	}
+
+	if refusal.Len() > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRefused, refusal.String())
+	}
+	if message.Len() == 0 {
+		return nil, ErrEmptyResponse
+	}
+	response.Message = message.String()
+	return response, nil
+}
+
+// post は1回だけ問い合わせる 200以外の場合はOpenAiErrorを返す
+func (c *OpenAiClient) post(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, parseOpenAiError(resp)
+	}
+	return resp, nil
+}
+
+// doWithRetry はattemptを実行し、再試行できるエラーの場合は待ってからやり直す
+// 1回ごとにc.timeoutの制限時間を付ける ctxが終わった場合はすぐにやめる
+func (c *OpenAiClient) doWithRetry(ctx context.Context, attempt func(ctx context.Context) error) error {
+	for retry := 0; ; retry++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if c.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		}
+		err := attempt(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var apiErr *OpenAiError
+		retryable := false
+		var wait time.Duration
+		if errors.As(err, &apiErr) {
+			retryable = apiErr.Retryable()
+			wait = apiErr.RetryAfter
+		} else {
+			// 通信エラーと1回ごとの制限時間切れはやり直す
+			retryable = true
+		}
+		if !retryable || retry >= c.maxRetries {
+			return err
+		}
+
+		if wait <= 0 {
+			wait = c.backoff(retry)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff はretry回目の再試行までの待ち時間を返す 倍々にして半分までゆらぎを入れる
+func (c *OpenAiClient) backoff(retry int) time.Duration {
+	delay := c.baseDelay << retry
+	if delay > c.maxDelay || delay <= 0 {
+		delay = c.maxDelay
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(half))
+	}
+	return delay
+}
+
+// parseOpenAiError はエラーのレスポンスを読む JSONでない場合は本文をそのままメッセージにする
+func parseOpenAiError(resp *http.Response) *OpenAiError {
+	apiErr := &OpenAiError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header),
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var errBody openAiErrorResponse
+	if err := json.Unmarshal(body, &errBody); err == nil && errBody.Error.Message != "" {
+		apiErr.Type = errBody.Error.Type
+		apiErr.Param = errBody.Error.Param
+		apiErr.Message = errBody.Error.Message
+		if errBody.Error.Code != nil {
+			apiErr.Code = fmt.Sprint(errBody.Error.Code)
+		}
+	} else {
+		apiErr.Message = string(bytes.TrimSpace(body))
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	return apiErr
+}
+
+// parseRetryAfter はretry-after-msとRetry-After(秒か日時)から待ち時間を読む
+func parseRetryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func (c *OpenAiClient) Close() error {
+	return nil
+}
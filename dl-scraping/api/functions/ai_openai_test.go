@@ -0,0 +1,174 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const okOpenAiBody = `{"choices": [{"message": {"role": "assistant", "content": "ok"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 1, "completion_tokens": 1}}`
+
+// newTestOpenAiClient はhandlerに問い合わせ、待ち時間を短くしたクライアントを作る
+func newTestOpenAiClient(t *testing.T, handler http.HandlerFunc) (*OpenAiClient, *int32) {
+	t.Helper()
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OPEN_AI_API_URL", server.URL)
+
+	client := newOpenAiClient(&ModelConfig{Name: "gpt-4o-mini-2024-07-18", Provider: ProviderOpenAi})
+	client.baseDelay = time.Millisecond
+	client.maxDelay = 5 * time.Millisecond
+	return client, &calls
+}
+
+// failTimes は最初のn回だけstatusとbodyを返し、その後は成功する
+func failTimes(n int32, status int, header map[string]string, body string) http.HandlerFunc {
+	var count int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) <= n {
+			for key, value := range header {
+				w.Header().Set(key, value)
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+			return
+		}
+		w.Write([]byte(okOpenAiBody))
+	}
+}
+
+func TestOpenAiClient_retry(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		calls   int32
+	}{
+		{"rate limit with Retry-After", failTimes(1, http.StatusTooManyRequests, map[string]string{"Retry-After": "0.001"}, `{"error": {"message": "slow down", "type": "requests", "code": "rate_limit_exceeded"}}`), 2},
+		{"rate limit with retry-after-ms", failTimes(1, http.StatusTooManyRequests, map[string]string{"retry-after-ms": "1"}, `{"error": {"message": "slow down"}}`), 2},
+		{"server errors", failTimes(2, http.StatusBadGateway, nil, "bad gateway"), 3},
+		{"overloaded", failTimes(3, http.StatusServiceUnavailable, nil, `{"error": {"message": "overloaded", "type": "server_error"}}`), 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, calls := newTestOpenAiClient(t, tt.handler)
+			response, err := client.Generate(context.Background(), GenerateRequest{Prompt: "hello"})
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			if response.Message != "ok" || *calls != tt.calls {
+				t.Errorf("got %q after %d calls, want ok after %d", response.Message, *calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestOpenAiClient_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  error
+		calls   int32
+	}{
+		{"invalid key", failTimes(10, http.StatusUnauthorized, nil, `{"error": {"message": "Incorrect API key provided", "type": "invalid_request_error", "code": "invalid_api_key"}}`), ErrInvalidApiKey, 1},
+		{"context length", failTimes(10, http.StatusBadRequest, nil, `{"error": {"message": "too long", "type": "invalid_request_error", "param": "messages", "code": "context_length_exceeded"}}`), ErrContextLengthExceeded, 1},
+		{"insufficient quota", failTimes(10, http.StatusTooManyRequests, nil, `{"error": {"message": "quota", "type": "insufficient_quota", "code": "insufficient_quota"}}`), ErrInsufficientQuota, 1},
+		{"rate limit exhausted", failTimes(10, http.StatusTooManyRequests, nil, `{"error": {"message": "slow down", "code": "rate_limit_exceeded"}}`), ErrRateLimited, 4},
+		{"no choices", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"choices": []}`)) }, ErrEmptyResponse, 1},
+		{"null content", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": null}}]}`))
+		}, ErrEmptyResponse, 1},
+		{"refusal", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": null, "refusal": "I can't help with that"}}]}`))
+		}, ErrRefused, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, calls := newTestOpenAiClient(t, tt.handler)
+			_, err := client.Generate(context.Background(), GenerateRequest{Prompt: "hello"})
+			if !errors.Is(err, tt.target) {
+				t.Fatalf("Generate() error = %v, want %v", err, tt.target)
+			}
+			if *calls != tt.calls {
+				t.Errorf("expected %d calls; got %d", tt.calls, *calls)
+			}
+		})
+	}
+}
+
+func TestOpenAiClient_errorDetails(t *testing.T) {
+	client, _ := newTestOpenAiClient(t, failTimes(1, http.StatusBadRequest, nil, `{"error": {"message": "bad param", "type": "invalid_request_error", "param": "temperature", "code": null}}`))
+	_, err := client.Generate(context.Background(), GenerateRequest{Prompt: "hello"})
+
+	var apiErr *OpenAiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected OpenAiError; got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Param != "temperature" || apiErr.Message != "bad param" || apiErr.Code != "" {
+		t.Errorf("unexpected error: %+v", apiErr)
+	}
+}
+
+func TestOpenAiClient_timeout(t *testing.T) {
+	// 1回目だけ応答しない
+	var first int32
+	client, calls := newTestOpenAiClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&first, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte(okOpenAiBody))
+	})
+	client.timeout = 50 * time.Millisecond
+
+	response, err := client.Generate(context.Background(), GenerateRequest{Prompt: "hello"})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if response.Message != "ok" || *calls != 2 {
+		t.Errorf("expected retry after timeout; got %q after %d calls", response.Message, *calls)
+	}
+}
+
+func TestOpenAiClient_canceled(t *testing.T) {
+	client, calls := newTestOpenAiClient(t, failTimes(10, http.StatusTooManyRequests, map[string]string{"Retry-After": "10"}, `{"error": {"message": "slow down"}}`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Generate(ctx, GenerateRequest{Prompt: "hello"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded; got %v", err)
+	}
+	if time.Since(start) > 5*time.Second || *calls != 1 {
+		t.Errorf("expected to stop waiting when the context is done; took %v with %d calls", time.Since(start), *calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "2")
+	if wait := parseRetryAfter(header); wait != 2*time.Second {
+		t.Errorf("parseRetryAfter() = %v, want 2s", wait)
+	}
+
+	header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if wait := parseRetryAfter(header); wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("parseRetryAfter() = %v, want about 1h", wait)
+	}
+
+	header.Set("retry-after-ms", "250")
+	if wait := parseRetryAfter(header); wait != 250*time.Millisecond {
+		t.Errorf("parseRetryAfter() = %v, want 250ms", wait)
+	}
+}
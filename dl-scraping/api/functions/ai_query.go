@@ -3,257 +3,109 @@ package functions
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"os"
 	"strings"
-
-	"cloud.google.com/go/firestore"
-	"cloud.google.com/go/vertexai/genai"
 )
 
-type modelTypes int
-
-const (
-	GPT_4o modelTypes = iota
-	GPT_4o_mini
-	Gemini_1_5_flash
-	Gemini_1_5_pro
-)
+var ErrUnknownModel = errors.New("unknown model")
 
-type AiResponse struct {
-	Message string `json:"message"`
+// ImagePart はプロンプトに添付する画像
+type ImagePart struct {
+	MimeType string `json:"mimeType" firestore:"mimeType"`
+	Data     []byte `json:"data" firestore:"data"`
 }
 
-func queryGpt(aiResponse *AiResponse, ctx context.Context, storeClient *firestore.Client, model modelTypes, prompt string, imageData string, systemInstructions string, temperature float64, responseFormat map[string]interface{}) error {
-	openAiApiKey := os.Getenv("OPEN_AI_API_KEY")
-
-	url := "https://api.openai.com/v1/chat/completions"
-	modelName := ""
-	if model == GPT_4o {
-		modelName = "gpt-4o-2024-08-06"
-	} else if model == GPT_4o_mini {
-		modelName = "gpt-4o-mini-2024-07-18"
-	}
-
-	userContent := []map[string]interface{}{
-		{"type": "text", "text": prompt},
-	}
-	if imageData != "" {
-		userContent = append(userContent, map[string]interface{}{
-			"type": "image_url",
-			"image_url": map[string]string{
-				"url": imageData,
-			},
-		})
-	}
-
-	messages := []map[string]interface{}{
-		{
-			"role":    "user",
-			"content": userContent,
-		},
-	}
-
-	if systemInstructions != "" {
-		messages = append([]map[string]interface{}{
-			{
-				"role": "system",
-				"content": []map[string]interface{}{
-					{"type": "text", "text": systemInstructions},
-				},
-			},
-		}, messages...)
-	}
-
-	reqBody := map[string]interface{}{
-		"model":       modelName,
-		"messages":    messages,
-		"temperature": temperature,
-	}
-	if responseFormat != nil {
-		reqBody["response_format"] = responseFormat
-	}
-
-	reqBodyJson, err := json.Marshal(reqBody)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(reqBodyJson)))
-	if err != nil {
-		return err
+// ParseDataUrl は"data:image/jpeg;base64,..."形式の文字列から画像を取り出す
+func ParseDataUrl(dataUrl string) (ImagePart, error) {
+	header, data, ok := strings.Cut(dataUrl, ";base64,")
+	if !ok || !strings.HasPrefix(header, "data:") {
+		return ImagePart{}, fmt.Errorf("invalid data url")
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", openAiApiKey))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	binary, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
-		return err
+		return ImagePart{}, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return err
-	}
-
-	var resBody map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&resBody); err != nil {
-		return err
-	}
-
-	choices := resBody["choices"].([]interface{})
-	firstChoice := choices[0].(map[string]interface{})
-	message := firstChoice["message"].(map[string]interface{})
-	content := message["content"].(string)
-
-	usage := resBody["usage"].(map[string]interface{})
-	completionTokens := int(usage["completion_tokens"].(float64))
-	promptTokens := int(usage["prompt_tokens"].(float64))
-	println("completion_tokens: ", completionTokens)
-	println("prompt_tokens: ", promptTokens)
-
-	aiResponse.Message = content
-
-	return nil
+	return ImagePart{MimeType: strings.TrimPrefix(header, "data:"), Data: binary}, nil
 }
 
-func getSchemaType(schemaType string) genai.Type {
-	switch schemaType {
-	case "object":
-		return genai.TypeObject
-	case "array":
-		return genai.TypeArray
-	case "string":
-		return genai.TypeString
-	case "number":
-		return genai.TypeNumber
-	case "boolean":
-		return genai.TypeBoolean
-	case "integer":
-		return genai.TypeInteger
-	default:
-		return genai.TypeUnspecified
-	}
+// DataUrl は画像を"data:image/jpeg;base64,..."形式の文字列にする
+func (p ImagePart) DataUrl() string {
+	return "data:" + p.MimeType + ";base64," + base64.StdEncoding.EncodeToString(p.Data)
 }
 
-func convertJsonSchemaToGeminiSchema(responseFormat map[string]interface{}) (*genai.Schema, error) {
-	thisType, ok := responseFormat["type"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid schema format")
-	}
-
-	schema := &genai.Schema{
-		Type:       getSchemaType(thisType),
-		Properties: make(map[string]*genai.Schema),
-	}
-
-	properties, ok := responseFormat["properties"].(map[string]interface{})
-	if ok {
-		for key, value := range properties {
-			propMap, ok := value.(map[string]interface{})
-			if !ok {
-				return nil, fmt.Errorf("invalid property format for key: %s", key)
-			}
-
-			propSchema := &genai.Schema{}
-			if propType, ok := propMap["type"].(string); ok {
-				fmt.Printf("propType: %s\n", propType)
-				propSchema.Type = getSchemaType(propType)
-			}
-
-			if description, ok := propMap["description"].(string); ok {
-				propSchema.Description = description
-			}
-
-			if propSchema.Type == genai.TypeArray {
-				items, ok := propMap["items"].(map[string]interface{})
-				if !ok {
-					return nil, fmt.Errorf("invalid items format for key: %s", key)
-				}
-				itemSchema, err := convertJsonSchemaToGeminiSchema(items)
-				if err != nil {
-					return nil, err
-				}
-				propSchema.Items = itemSchema
-			}
-
-			if propSchema.Type == genai.TypeObject {
-				subSchema, err := convertJsonSchemaToGeminiSchema(propMap)
-				if err != nil {
-					return nil, err
-				}
-				propSchema.Properties = subSchema.Properties
-			}
-
-			schema.Properties[key] = propSchema
-		}
-	}
-
-	if required, ok := responseFormat["required"].([]interface{}); ok {
-		for _, req := range required {
-			if reqStr, ok := req.(string); ok {
-				schema.Required = append(schema.Required, reqStr)
-			}
-		}
-	}
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
 
-	return schema, nil
+// Message は会話の中の1回分の発言
+type Message struct {
+	// RoleUserかRoleAssistant
+	Role   string      `json:"role" firestore:"role"`
+	Text   string      `json:"text" firestore:"text"`
+	Images []ImagePart `json:"images,omitempty" firestore:"images"`
 }
 
-func queryGemini(aiResponse *AiResponse, ctx context.Context, prompt string, imageData string, systemInstructions string, temperature float64, responseFormat map[string]interface{}) error {
-
-	client, err := genai.NewClient(ctx, "asa-o-experiment", "asia-northeast1")
-	gemini := client.GenerativeModel("gemini-1.5-flash")
-	if systemInstructions != "" {
-		gemini.SystemInstruction = &genai.Content{
-			Role:  "user",
-			Parts: []genai.Part{genai.Text(systemInstructions)},
-		}
-	}
-	gemini.SetTemperature(float32(temperature))
+// GenerateRequest はモデルへの問い合わせ内容
+type GenerateRequest struct {
+	// それまでの会話 古い順 PromptとImagesはその続きのユーザーの発言になる
+	History            []Message
+	Prompt             string
+	Images             []ImagePart
+	SystemInstructions string
+	Temperature        float64
+	// OpenAIのresponse_formatと同じ形式 Geminiの場合はスキーマに変換して使う
+	ResponseFormat map[string]interface{}
+}
 
-	promptParts := []genai.Part{
-		genai.Text(prompt),
-	}
-	if imageData != "" {
-		parts := strings.Split(imageData, ";base64,")
-		imageType := strings.Split(parts[0], "/")[1]
-		imageBinary, _ := base64.StdEncoding.DecodeString(parts[1])
+// TokenUsage は1回の問い合わせで使ったトークン数
+type TokenUsage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+}
 
-		img := genai.ImageData(imageType, imageBinary)
+// GenerateResponse はモデルからの応答
+type GenerateResponse struct {
+	Model   string
+	Message string
+	Usage   TokenUsage
+	// キャッシュから返した場合はtrue
+	Cached bool
+}
 
-		promptParts = append([]genai.Part{img}, promptParts...)
-	}
+// LLMClient はモデルごとの違いを吸収して問い合わせる
+type LLMClient interface {
+	Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error)
+	// GenerateStream は生成された文字列を届いた順にonDeltaに渡し、最後に全体を返す
+	// onDeltaがエラーを返した場合はそこでやめる
+	GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error)
+	Close() error
+}
 
-	// スキーマが指定されている場合は、geminiのスキーマに変換して設定
-	if responseFormat != nil {
-		if json_schema, ok := responseFormat["json_schema"].(map[string]interface{}); ok {
-			if schema, ok := json_schema["schema"].(map[string]interface{}); ok {
-				geminiSchema, err := convertJsonSchemaToGeminiSchema(schema)
-				if err != nil {
-					return err
-				}
-				gemini.GenerationConfig.ResponseMIMEType = "application/json"
-				gemini.GenerationConfig.ResponseSchema = geminiSchema
-			}
-		}
+// NewLLMClient はモデルのプロバイダに合ったクライアントを作る 使い終わったらCloseする
+// 環境変数AI_PROVIDERがstubの場合は、どのモデルでもStubClientを使う
+// 問い合わせる前にモデルがリクエストに対応しているかを確かめる
+func NewLLMClient(ctx context.Context, model *ModelConfig) (LLMClient, error) {
+	provider := model.Provider
+	if useStubProvider() {
+		provider = ProviderStub
+	}
+
+	var client LLMClient
+	var err error
+	switch provider {
+	case ProviderOpenAi:
+		client = newOpenAiClient(model)
+	case ProviderGemini:
+		client, err = newGeminiClient(ctx, model)
+	case ProviderStub:
+		client, err = newStubClient(model.Name)
+	default:
+		err = fmt.Errorf("%w: unknown provider %q", ErrUnknownModel, provider)
 	}
-
-	resp, err := gemini.GenerateContent(ctx, promptParts...)
 	if err != nil {
-		return fmt.Errorf("error generating content: %w", err)
+		return nil, err
 	}
-
-	inputTokens := int(resp.UsageMetadata.PromptTokenCount)
-	outputTokens := int(resp.UsageMetadata.CandidatesTokenCount)
-	println("input_tokens: ", inputTokens)
-	println("output_tokens: ", outputTokens)
-
-	aiResponse.Message = fmt.Sprintf("%v", resp.Candidates[0].Content.Parts[0])
-
-	return nil
+	return &checkedClient{model: model, client: client}, nil
 }
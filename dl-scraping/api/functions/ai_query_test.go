@@ -0,0 +1,139 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setupFakeOpenAi はChat Completions APIの代わりになるサーバーを立てる
+// replyはリクエストのJSONを受け取って、返すメッセージの内容を返す
+func setupFakeOpenAi(t *testing.T, reply func(request map[string]interface{}) string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, _ := json.Marshal(reply(request))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices": [{"message": {"role": "assistant", "content": %s}}], "usage": {"prompt_tokens": 10, "completion_tokens": 5}}`, content)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OPEN_AI_API_URL", server.URL)
+	t.Setenv("OPEN_AI_API_KEY", "test-key")
+	t.Setenv("AI_MODEL", "gpt-4o-mini")
+	// 他のテストの応答がキャッシュから返らないようにする
+	useMemoryResponseCache(t)
+	return server
+}
+
+// requestImageUrls はChat Completionsのリクエストに添付された画像のURLを返す
+func requestImageUrls(request map[string]interface{}) []string {
+	var urls []string
+	for _, message := range request["messages"].([]interface{}) {
+		content, ok := message.(map[string]interface{})["content"].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, part := range content {
+			if imageUrl, ok := part.(map[string]interface{})["image_url"].(map[string]interface{}); ok {
+				urls = append(urls, imageUrl["url"].(string))
+			}
+		}
+	}
+	return urls
+}
+
+func TestParseDataUrl(t *testing.T) {
+	image := ImagePart{MimeType: "image/jpeg", Data: []byte{0xff, 0xd8, 0xff}}
+	parsed, err := ParseDataUrl(image.DataUrl())
+	if err != nil {
+		t.Fatalf("ParseDataUrl() error = %v", err)
+	}
+	if parsed.MimeType != "image/jpeg" || string(parsed.Data) != string(image.Data) {
+		t.Errorf("ParseDataUrl() = %+v, want %+v", parsed, image)
+	}
+
+	if _, err := ParseDataUrl("image/jpeg,abc"); err == nil {
+		t.Error("expected error for invalid data url")
+	}
+}
+
+func TestOpenAiClient_Generate(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("unexpected Authorization header: %q", r.Header.Get("Authorization"))
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"choices": [{"message": {"role": "assistant", "content": "秋らしいエフェクトです"}}],
+			"usage": {"prompt_tokens": 12, "completion_tokens": 5}
+		}`))
+	}))
+	defer server.Close()
+	t.Setenv("OPEN_AI_API_URL", server.URL)
+	t.Setenv("OPEN_AI_API_KEY", "test-key")
+
+	model, _ := resolveModel("gpt-4o-mini")
+	client, err := NewLLMClient(context.Background(), model)
+	if err != nil {
+		t.Fatalf("NewLLMClient() error = %v", err)
+	}
+	defer client.Close()
+
+	response, err := client.Generate(context.Background(), GenerateRequest{
+		Prompt:             "このエフェクトを説明して",
+		Images:             []ImagePart{{MimeType: "image/jpeg", Data: []byte("jpeg")}},
+		SystemInstructions: "日本語で答える",
+		Temperature:        0.2,
+	})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if response.Message != "秋らしいエフェクトです" || response.Model != "gpt-4o-mini-2024-07-18" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+	if response.Usage != (TokenUsage{InputTokens: 12, OutputTokens: 5}) {
+		t.Errorf("unexpected usage: %+v", response.Usage)
+	}
+
+	messages := received["messages"].([]interface{})
+	if len(messages) != 2 || messages[0].(map[string]interface{})["role"] != "system" {
+		t.Errorf("expected system and user messages; got %v", messages)
+	}
+	userContent := messages[1].(map[string]interface{})["content"].([]interface{})
+	if len(userContent) != 2 {
+		t.Errorf("expected text and image parts; got %v", userContent)
+	}
+}
+
+func TestOpenAiClient_GenerateError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"message": "invalid key"}}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	t.Setenv("OPEN_AI_API_URL", server.URL)
+
+	model, _ := resolveModel("gpt-4o")
+	client, _ := NewLLMClient(context.Background(), model)
+	if _, err := client.Generate(context.Background(), GenerateRequest{Prompt: "hello"}); err == nil {
+		t.Error("expected error for non-200 status")
+	}
+}
+
+func TestNewLLMClient_unknownModel(t *testing.T) {
+	if _, err := resolveModel("gpt-3"); !errors.Is(err, ErrUnknownModel) {
+		t.Errorf("expected ErrUnknownModel; got %v", err)
+	}
+	if _, err := NewLLMClient(context.Background(), &ModelConfig{Name: "x", Provider: "unknown"}); err == nil {
+		t.Error("expected error for unknown provider")
+	}
+}
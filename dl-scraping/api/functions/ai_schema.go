@@ -0,0 +1,635 @@
+package functions
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// SchemaError はGeminiのスキーマに変換できなかった箇所とその理由
+// PathはJSON Pointer形式 ("#/properties/colors/items")
+type SchemaError struct {
+	Path    string
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("schema %s: %s", e.Path, e.Message)
+}
+
+// responseFormatSchema はOpenAIのresponse_formatからJSON Schemaを取り出す
+// json_objectの場合はスキーマなしでJSONモードにする textや未指定の場合は何もしない
+func responseFormatSchema(responseFormat map[string]interface{}) (map[string]interface{}, bool, error) {
+	if responseFormat == nil {
+		return nil, false, nil
+	}
+	switch formatType, _ := responseFormat["type"].(string); formatType {
+	case "json_schema":
+		jsonSchema, ok := responseFormat["json_schema"].(map[string]interface{})
+		if !ok {
+			return nil, false, fmt.Errorf("response_format: json_schema is missing")
+		}
+		schema, ok := jsonSchema["schema"].(map[string]interface{})
+		if !ok {
+			return nil, false, fmt.Errorf("response_format: json_schema.schema is missing")
+		}
+		return schema, true, nil
+	case "json_object":
+		return nil, true, nil
+	case "", "text":
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("response_format: unknown type %q", formatType)
+	}
+}
+
+// geminiFormats はGeminiが受け付けるformat 型ごと
+var geminiFormats = map[genai.Type][]string{
+	genai.TypeString:  {"date-time", "enum"},
+	genai.TypeNumber:  {"float", "double"},
+	genai.TypeInteger: {"int32", "int64"},
+}
+
+// ignoredSchemaKeywords は変換結果に影響しないので読み飛ばすキーワード
+var ignoredSchemaKeywords = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"$defs":       true,
+	"definitions": true,
+	"default":     true,
+	"examples":    true,
+}
+
+// handledSchemaKeywords は変換で扱うキーワード これら以外は変換できないのでエラーにする
+var handledSchemaKeywords = map[string]bool{
+	"$ref":                 true,
+	"type":                 true,
+	"anyOf":                true,
+	"oneOf":                true,
+	"nullable":             true,
+	"title":                true,
+	"description":          true,
+	"format":               true,
+	"enum":                 true,
+	"const":                true,
+	"properties":           true,
+	"required":             true,
+	"additionalProperties": true,
+	"minProperties":        true,
+	"maxProperties":        true,
+	"items":                true,
+	"minItems":             true,
+	"maxItems":             true,
+	"minLength":            true,
+	"maxLength":            true,
+	"pattern":              true,
+	"minimum":              true,
+	"maximum":              true,
+}
+
+// convertJsonSchemaToGeminiSchema はOpenAIのresponse_formatで使うJSON SchemaをGeminiのスキーマに変換する
+// $refは同じドキュメント内のものだけ解決する 再帰する参照や、null以外の型が複数あるanyOfのように
+// Geminiで表せないものは、その場所を含んだSchemaErrorを返す
+func convertJsonSchemaToGeminiSchema(schema map[string]interface{}) (*genai.Schema, error) {
+	converter := &schemaConverter{root: schema, resolving: make(map[string]bool)}
+	return converter.convert(schema, "#")
+}
+
+type schemaConverter struct {
+	root map[string]interface{}
+	// 解決中の$ref 再帰の検出に使う
+	resolving map[string]bool
+}
+
+func (c *schemaConverter) errorf(path string, format string, args ...interface{}) error {
+	return &SchemaError{Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+func (c *schemaConverter) convert(node map[string]interface{}, path string) (*genai.Schema, error) {
+	if ref, ok := node["$ref"]; ok {
+		return c.convertRef(node, ref, path)
+	}
+
+	// キーワードは名前順に確認して、エラーになる場所を毎回同じにする
+	keys := make([]string, 0, len(node))
+	for key := range node {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !handledSchemaKeywords[key] && !ignoredSchemaKeywords[key] {
+			return nil, c.errorf(path+"/"+key, "unsupported keyword")
+		}
+	}
+
+	if _, ok := node["anyOf"]; ok {
+		return c.convertUnion(node, "anyOf", path)
+	}
+	if _, ok := node["oneOf"]; ok {
+		return c.convertUnion(node, "oneOf", path)
+	}
+
+	schemaType, nullable, err := c.schemaType(node, path)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &genai.Schema{Type: schemaType, Nullable: nullable}
+	if value, ok := node["nullable"]; ok {
+		b, ok := value.(bool)
+		if !ok {
+			return nil, c.errorf(path+"/nullable", "must be a boolean")
+		}
+		schema.Nullable = schema.Nullable || b
+	}
+	if schema.Title, err = c.stringValue(node, "title", path); err != nil {
+		return nil, err
+	}
+	if schema.Description, err = c.stringValue(node, "description", path); err != nil {
+		return nil, err
+	}
+	if err := c.convertFormat(node, schema, path); err != nil {
+		return nil, err
+	}
+	if err := c.convertEnum(node, schema, path); err != nil {
+		return nil, err
+	}
+
+	switch schemaType {
+	case genai.TypeObject:
+		err = c.convertObject(node, schema, path)
+	case genai.TypeArray:
+		err = c.convertArray(node, schema, path)
+	case genai.TypeString:
+		err = c.convertString(node, schema, path)
+	case genai.TypeNumber, genai.TypeInteger:
+		err = c.convertNumber(node, schema, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 型に合わないキーワードは黙って捨てずにエラーにする
+	for _, key := range keys {
+		if !keywordAppliesTo(key, schemaType) {
+			return nil, c.errorf(path+"/"+key, "keyword does not apply to type %s", jsonTypeName(schemaType))
+		}
+	}
+	return schema, nil
+}
+
+// keywordAppliesTo はキーワードが型に対して使えるかを返す
+func keywordAppliesTo(key string, schemaType genai.Type) bool {
+	switch key {
+	case "properties", "required", "additionalProperties", "minProperties", "maxProperties":
+		return schemaType == genai.TypeObject
+	case "items", "minItems", "maxItems":
+		return schemaType == genai.TypeArray
+	case "minLength", "maxLength", "pattern":
+		return schemaType == genai.TypeString
+	case "minimum", "maximum":
+		return schemaType == genai.TypeNumber || schemaType == genai.TypeInteger
+	}
+	return true
+}
+
+// convertRef は$refを解決して変換する descriptionとtitleは参照元に書かれたものを優先する
+func (c *schemaConverter) convertRef(node map[string]interface{}, value interface{}, path string) (*genai.Schema, error) {
+	ref, ok := value.(string)
+	if !ok {
+		return nil, c.errorf(path+"/$ref", "must be a string")
+	}
+	for key := range node {
+		if key != "$ref" && key != "description" && key != "title" && !ignoredSchemaKeywords[key] {
+			return nil, c.errorf(path+"/"+key, "keyword next to $ref is not supported")
+		}
+	}
+	if c.resolving[ref] {
+		return nil, c.errorf(path+"/$ref", "recursive reference %q is not supported", ref)
+	}
+
+	target, err := c.resolve(ref, path+"/$ref")
+	if err != nil {
+		return nil, err
+	}
+
+	c.resolving[ref] = true
+	defer delete(c.resolving, ref)
+
+	schema, err := c.convert(target, ref)
+	if err != nil {
+		return nil, err
+	}
+	if description, ok := node["description"].(string); ok {
+		schema.Description = description
+	}
+	if title, ok := node["title"].(string); ok {
+		schema.Title = title
+	}
+	return schema, nil
+}
+
+// resolve はドキュメント内の"#/..."形式の参照をたどる
+func (c *schemaConverter) resolve(ref string, path string) (map[string]interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, c.errorf(path, "only local references are supported: %q", ref)
+	}
+
+	var current interface{} = c.root
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch value := current.(type) {
+		case map[string]interface{}:
+			next, ok := value[token]
+			if !ok {
+				return nil, c.errorf(path, "reference %q not found", ref)
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, c.errorf(path, "reference %q not found", ref)
+			}
+			current = value[index]
+		default:
+			return nil, c.errorf(path, "reference %q not found", ref)
+		}
+	}
+
+	target, ok := current.(map[string]interface{})
+	if !ok {
+		return nil, c.errorf(path, "reference %q is not a schema", ref)
+	}
+	return target, nil
+}
+
+// convertUnion はanyOf/oneOfを変換する
+// Geminiには型の組み合わせがないので、nullとの組み合わせだけをnullableとして受け付ける
+func (c *schemaConverter) convertUnion(node map[string]interface{}, keyword string, path string) (*genai.Schema, error) {
+	for key := range node {
+		if key != keyword && key != "description" && key != "title" && !ignoredSchemaKeywords[key] {
+			return nil, c.errorf(path+"/"+key, "keyword next to %s is not supported", keyword)
+		}
+	}
+	options, ok := node[keyword].([]interface{})
+	if !ok || len(options) == 0 {
+		return nil, c.errorf(path+"/"+keyword, "must be a non-empty array")
+	}
+
+	var nonNull []int
+	nullable := false
+	for i, option := range options {
+		optionMap, ok := option.(map[string]interface{})
+		if !ok {
+			return nil, c.errorf(fmt.Sprintf("%s/%s/%d", path, keyword, i), "must be an object")
+		}
+		if isNullSchema(optionMap) {
+			nullable = true
+			continue
+		}
+		nonNull = append(nonNull, i)
+	}
+	if len(nonNull) != 1 {
+		return nil, c.errorf(path+"/"+keyword, "only a single schema combined with null is supported")
+	}
+
+	index := nonNull[0]
+	schema, err := c.convert(options[index].(map[string]interface{}), fmt.Sprintf("%s/%s/%d", path, keyword, index))
+	if err != nil {
+		return nil, err
+	}
+	schema.Nullable = schema.Nullable || nullable
+	if description, ok := node["description"].(string); ok {
+		schema.Description = description
+	}
+	if title, ok := node["title"].(string); ok {
+		schema.Title = title
+	}
+	return schema, nil
+}
+
+func isNullSchema(node map[string]interface{}) bool {
+	schemaType, ok := node["type"].(string)
+	return ok && schemaType == "null" && len(node) == 1
+}
+
+// schemaType はtypeを変換する ["string", "null"]のような指定はnullableにする
+// typeがない場合はほかのキーワードから推測する
+func (c *schemaConverter) schemaType(node map[string]interface{}, path string) (genai.Type, bool, error) {
+	value, ok := node["type"]
+	if !ok {
+		switch {
+		case node["properties"] != nil:
+			return genai.TypeObject, false, nil
+		case node["items"] != nil:
+			return genai.TypeArray, false, nil
+		case node["enum"] != nil, node["const"] != nil:
+			return genai.TypeString, false, nil
+		}
+		return genai.TypeUnspecified, false, c.errorf(path, "type is missing")
+	}
+
+	var typeNames []string
+	switch value := value.(type) {
+	case string:
+		typeNames = []string{value}
+	case []interface{}:
+		for i, item := range value {
+			name, ok := item.(string)
+			if !ok {
+				return genai.TypeUnspecified, false, c.errorf(fmt.Sprintf("%s/type/%d", path, i), "must be a string")
+			}
+			typeNames = append(typeNames, name)
+		}
+	default:
+		return genai.TypeUnspecified, false, c.errorf(path+"/type", "must be a string or an array of strings")
+	}
+
+	nullable := false
+	var types []string
+	for _, name := range typeNames {
+		if name == "null" {
+			nullable = true
+			continue
+		}
+		types = append(types, name)
+	}
+	if len(types) != 1 {
+		return genai.TypeUnspecified, false, c.errorf(path+"/type", "only a single type combined with null is supported")
+	}
+
+	schemaType := getSchemaType(types[0])
+	if schemaType == genai.TypeUnspecified {
+		return genai.TypeUnspecified, false, c.errorf(path+"/type", "unknown type %q", types[0])
+	}
+	return schemaType, nullable, nil
+}
+
+func getSchemaType(schemaType string) genai.Type {
+	switch schemaType {
+	case "object":
+		return genai.TypeObject
+	case "array":
+		return genai.TypeArray
+	case "string":
+		return genai.TypeString
+	case "number":
+		return genai.TypeNumber
+	case "boolean":
+		return genai.TypeBoolean
+	case "integer":
+		return genai.TypeInteger
+	default:
+		return genai.TypeUnspecified
+	}
+}
+
+// jsonTypeName はGeminiの型をJSON Schemaの型名に戻す
+func jsonTypeName(schemaType genai.Type) string {
+	switch schemaType {
+	case genai.TypeObject:
+		return "object"
+	case genai.TypeArray:
+		return "array"
+	case genai.TypeString:
+		return "string"
+	case genai.TypeNumber:
+		return "number"
+	case genai.TypeBoolean:
+		return "boolean"
+	case genai.TypeInteger:
+		return "integer"
+	default:
+		return "unspecified"
+	}
+}
+
+func (c *schemaConverter) stringValue(node map[string]interface{}, key string, path string) (string, error) {
+	value, ok := node[key]
+	if !ok {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", c.errorf(path+"/"+key, "must be a string")
+	}
+	return s, nil
+}
+
+// intValue は0以上の整数のキーワードを読む JSONから読んだ場合はfloat64になる
+func (c *schemaConverter) intValue(node map[string]interface{}, key string, path string) (int64, bool, error) {
+	value, ok := node[key]
+	if !ok {
+		return 0, false, nil
+	}
+	var n float64
+	switch value := value.(type) {
+	case float64:
+		n = value
+	case int:
+		n = float64(value)
+	case int64:
+		n = float64(value)
+	default:
+		return 0, false, c.errorf(path+"/"+key, "must be a number")
+	}
+	if n < 0 || n != float64(int64(n)) {
+		return 0, false, c.errorf(path+"/"+key, "must be a non-negative integer")
+	}
+	return int64(n), true, nil
+}
+
+func (c *schemaConverter) numberValue(node map[string]interface{}, key string, path string) (float64, bool, error) {
+	value, ok := node[key]
+	if !ok {
+		return 0, false, nil
+	}
+	switch value := value.(type) {
+	case float64:
+		return value, true, nil
+	case int:
+		return float64(value), true, nil
+	case int64:
+		return float64(value), true, nil
+	default:
+		return 0, false, c.errorf(path+"/"+key, "must be a number")
+	}
+}
+
+func (c *schemaConverter) convertFormat(node map[string]interface{}, schema *genai.Schema, path string) error {
+	format, err := c.stringValue(node, "format", path)
+	if err != nil || format == "" {
+		return err
+	}
+	for _, supported := range geminiFormats[schema.Type] {
+		if format == supported {
+			schema.Format = format
+			return nil
+		}
+	}
+	return c.errorf(path+"/format", "format %q is not supported for type %s", format, jsonTypeName(schema.Type))
+}
+
+// convertEnum はenumとconstを変換する Geminiのenumは文字列だけなのでstringに限る
+func (c *schemaConverter) convertEnum(node map[string]interface{}, schema *genai.Schema, path string) error {
+	var values []interface{}
+	key := "enum"
+	if value, ok := node["enum"]; ok {
+		values, ok = value.([]interface{})
+		if !ok || len(values) == 0 {
+			return c.errorf(path+"/enum", "must be a non-empty array")
+		}
+	} else if value, ok := node["const"]; ok {
+		key = "const"
+		values = []interface{}{value}
+	} else {
+		return nil
+	}
+
+	if schema.Type != genai.TypeString {
+		return c.errorf(path+"/"+key, "only string values are supported")
+	}
+	for i, value := range values {
+		if value == nil && schema.Nullable {
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			if key == "const" {
+				return c.errorf(path+"/const", "only string values are supported")
+			}
+			return c.errorf(fmt.Sprintf("%s/enum/%d", path, i), "only string values are supported")
+		}
+		schema.Enum = append(schema.Enum, s)
+	}
+	if schema.Format == "" {
+		schema.Format = "enum"
+	}
+	return nil
+}
+
+func (c *schemaConverter) convertObject(node map[string]interface{}, schema *genai.Schema, path string) error {
+	if value, ok := node["properties"]; ok {
+		properties, ok := value.(map[string]interface{})
+		if !ok {
+			return c.errorf(path+"/properties", "must be an object")
+		}
+		schema.Properties = make(map[string]*genai.Schema, len(properties))
+
+		keys := make([]string, 0, len(properties))
+		for key := range properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			propPath := path + "/properties/" + escapePointer(key)
+			propMap, ok := properties[key].(map[string]interface{})
+			if !ok {
+				return c.errorf(propPath, "must be an object")
+			}
+			propSchema, err := c.convert(propMap, propPath)
+			if err != nil {
+				return err
+			}
+			schema.Properties[key] = propSchema
+		}
+	}
+
+	if value, ok := node["required"]; ok {
+		required, ok := value.([]interface{})
+		if !ok {
+			return c.errorf(path+"/required", "must be an array")
+		}
+		for i, item := range required {
+			name, ok := item.(string)
+			if !ok {
+				return c.errorf(fmt.Sprintf("%s/required/%d", path, i), "must be a string")
+			}
+			if _, ok := schema.Properties[name]; !ok {
+				return c.errorf(fmt.Sprintf("%s/required/%d", path, i), "property %q is not defined", name)
+			}
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	// Geminiは定義したプロパティしか返さないのでfalseだけ受け付ける
+	if value, ok := node["additionalProperties"]; ok {
+		if b, ok := value.(bool); !ok || b {
+			return c.errorf(path+"/additionalProperties", "only false is supported")
+		}
+	}
+
+	var err error
+	if schema.MinProperties, _, err = c.intValue(node, "minProperties", path); err != nil {
+		return err
+	}
+	if schema.MaxProperties, _, err = c.intValue(node, "maxProperties", path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *schemaConverter) convertArray(node map[string]interface{}, schema *genai.Schema, path string) error {
+	value, ok := node["items"]
+	if !ok {
+		return c.errorf(path, "items is missing")
+	}
+	items, ok := value.(map[string]interface{})
+	if !ok {
+		return c.errorf(path+"/items", "must be an object")
+	}
+	itemSchema, err := c.convert(items, path+"/items")
+	if err != nil {
+		return err
+	}
+	schema.Items = itemSchema
+
+	minItems, hasMin, err := c.intValue(node, "minItems", path)
+	if err != nil {
+		return err
+	}
+	maxItems, hasMax, err := c.intValue(node, "maxItems", path)
+	if err != nil {
+		return err
+	}
+	if hasMin && hasMax && minItems > maxItems {
+		return c.errorf(path+"/minItems", "must not be greater than maxItems")
+	}
+	schema.MinItems, schema.MaxItems = minItems, maxItems
+	return nil
+}
+
+func (c *schemaConverter) convertString(node map[string]interface{}, schema *genai.Schema, path string) error {
+	var err error
+	if schema.MinLength, _, err = c.intValue(node, "minLength", path); err != nil {
+		return err
+	}
+	if schema.MaxLength, _, err = c.intValue(node, "maxLength", path); err != nil {
+		return err
+	}
+	schema.Pattern, err = c.stringValue(node, "pattern", path)
+	return err
+}
+
+func (c *schemaConverter) convertNumber(node map[string]interface{}, schema *genai.Schema, path string) error {
+	var err error
+	if schema.Minimum, _, err = c.numberValue(node, "minimum", path); err != nil {
+		return err
+	}
+	if schema.Maximum, _, err = c.numberValue(node, "maximum", path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// escapePointer はJSON Pointerで使えるようにプロパティ名をエスケープする
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,245 @@
+package functions
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// geminiSchemaToJsonSchema は変換結果をJSON Schemaに戻す 往復して比べるために使う
+func geminiSchemaToJsonSchema(schema *genai.Schema) map[string]interface{} {
+	result := map[string]interface{}{"type": jsonTypeName(schema.Type)}
+	if schema.Nullable {
+		result["type"] = []interface{}{jsonTypeName(schema.Type), "null"}
+	}
+	if schema.Title != "" {
+		result["title"] = schema.Title
+	}
+	if schema.Description != "" {
+		result["description"] = schema.Description
+	}
+	if schema.Format != "" && schema.Format != "enum" {
+		result["format"] = schema.Format
+	}
+	if len(schema.Enum) > 0 {
+		enum := make([]interface{}, 0, len(schema.Enum))
+		for _, value := range schema.Enum {
+			enum = append(enum, value)
+		}
+		result["enum"] = enum
+	}
+	if schema.Properties != nil {
+		properties := make(map[string]interface{}, len(schema.Properties))
+		for key, value := range schema.Properties {
+			properties[key] = geminiSchemaToJsonSchema(value)
+		}
+		result["properties"] = properties
+	}
+	if len(schema.Required) > 0 {
+		required := make([]interface{}, 0, len(schema.Required))
+		for _, name := range schema.Required {
+			required = append(required, name)
+		}
+		result["required"] = required
+	}
+	if schema.Items != nil {
+		result["items"] = geminiSchemaToJsonSchema(schema.Items)
+	}
+	for key, value := range map[string]int64{
+		"minItems": schema.MinItems, "maxItems": schema.MaxItems,
+		"minProperties": schema.MinProperties, "maxProperties": schema.MaxProperties,
+		"minLength": schema.MinLength, "maxLength": schema.MaxLength,
+	} {
+		if value != 0 {
+			result[key] = float64(value)
+		}
+	}
+	if schema.Pattern != "" {
+		result["pattern"] = schema.Pattern
+	}
+	if schema.Minimum != 0 {
+		result["minimum"] = schema.Minimum
+	}
+	if schema.Maximum != 0 {
+		result["maximum"] = schema.Maximum
+	}
+	return result
+}
+
+func mustParseSchema(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		t.Fatalf("invalid test schema: %v", err)
+	}
+	return schema
+}
+
+func TestConvertJsonSchemaToGeminiSchema_roundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		// 空の場合は入力と同じになる
+		want string
+	}{
+		{
+			name: "object",
+			schema: `{"type": "object", "description": "tags", "properties": {
+				"mood": {"type": "string", "description": "雰囲気"},
+				"count": {"type": "integer", "format": "int32", "minimum": 1, "maximum": 10},
+				"score": {"type": "number", "format": "double"},
+				"hasText": {"type": "boolean"}
+			}, "required": ["mood", "hasText"], "minProperties": 1, "maxProperties": 4}`,
+		},
+		{
+			name:   "top-level array",
+			schema: `{"type": "array", "items": {"type": "string", "minLength": 1, "maxLength": 20, "pattern": "^[a-z]+$"}, "minItems": 1, "maxItems": 3}`,
+		},
+		{
+			name:   "enum",
+			schema: `{"type": "string", "enum": ["spring", "summer", "autumn", "winter"]}`,
+		},
+		{
+			name:   "const",
+			schema: `{"const": "fixed"}`,
+			want:   `{"type": "string", "enum": ["fixed"]}`,
+		},
+		{
+			name:   "nullable type array",
+			schema: `{"type": ["string", "null"], "format": "date-time"}`,
+		},
+		{
+			name:   "nullable keyword",
+			schema: `{"type": "integer", "nullable": true}`,
+			want:   `{"type": ["integer", "null"]}`,
+		},
+		{
+			name:   "anyOf with null",
+			schema: `{"description": "optional season", "anyOf": [{"type": "string", "enum": ["spring", "summer"]}, {"type": "null"}]}`,
+			want:   `{"type": ["string", "null"], "description": "optional season", "enum": ["spring", "summer"]}`,
+		},
+		{
+			name:   "inferred types",
+			schema: `{"properties": {"list": {"items": {"type": "string"}}}, "additionalProperties": false}`,
+			want:   `{"type": "object", "properties": {"list": {"type": "array", "items": {"type": "string"}}}}`,
+		},
+		{
+			name: "refs",
+			schema: `{"type": "object", "properties": {
+				"effects": {"type": "array", "items": {"$ref": "#/$defs/effect"}},
+				"best": {"$ref": "#/$defs/effect", "description": "一番合うもの"},
+				"legacy": {"$ref": "#/definitions/color"}
+			}, "required": ["effects"],
+			"$defs": {"effect": {"type": "object", "description": "エフェクト", "properties": {"id": {"type": "string"}, "color": {"$ref": "#/definitions/color"}}, "required": ["id"], "additionalProperties": false}},
+			"definitions": {"color": {"type": "string", "enum": ["red", "blue"]}}}`,
+			want: `{"type": "object", "properties": {
+				"effects": {"type": "array", "items": {"type": "object", "description": "エフェクト", "properties": {"id": {"type": "string"}, "color": {"type": "string", "enum": ["red", "blue"]}}, "required": ["id"]}},
+				"best": {"type": "object", "description": "一番合うもの", "properties": {"id": {"type": "string"}, "color": {"type": "string", "enum": ["red", "blue"]}}, "required": ["id"]},
+				"legacy": {"type": "string", "enum": ["red", "blue"]}
+			}, "required": ["effects"]}`,
+		},
+		{
+			name:   "ignored keywords",
+			schema: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "$comment": "x", "type": "string", "default": "a", "examples": ["a"]}`,
+			want:   `{"type": "string"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := convertJsonSchemaToGeminiSchema(mustParseSchema(t, tt.schema))
+			if err != nil {
+				t.Fatalf("convertJsonSchemaToGeminiSchema() error = %v", err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.schema
+			}
+			got := geminiSchemaToJsonSchema(schema)
+			if expected := mustParseSchema(t, want); !reflect.DeepEqual(got, expected) {
+				gotJson, _ := json.Marshal(got)
+				t.Errorf("round trip mismatch\n got: %s\nwant: %s", gotJson, want)
+			}
+		})
+	}
+}
+
+func TestConvertJsonSchemaToGeminiSchema_enumFormat(t *testing.T) {
+	schema, err := convertJsonSchemaToGeminiSchema(mustParseSchema(t, `{"type": "string", "enum": ["a", "b"]}`))
+	if err != nil {
+		t.Fatalf("convertJsonSchemaToGeminiSchema() error = %v", err)
+	}
+	if schema.Format != "enum" {
+		t.Errorf("expected enum format; got %q", schema.Format)
+	}
+}
+
+func TestConvertJsonSchemaToGeminiSchema_errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		path   string
+	}{
+		{"missing type", `{"description": "x"}`, "#"},
+		{"unknown type", `{"type": "date"}`, "#/type"},
+		{"multiple types", `{"type": ["string", "integer"]}`, "#/type"},
+		{"anyOf of two schemas", `{"type": "object", "properties": {"value": {"anyOf": [{"type": "string"}, {"type": "integer"}]}}}`, "#/properties/value/anyOf"},
+		{"oneOf option", `{"oneOf": [{"type": "null"}, "string"]}`, "#/oneOf/1"},
+		{"allOf", `{"type": "object", "properties": {"a": {"allOf": [{"type": "string"}]}}}`, "#/properties/a/allOf"},
+		{"unsupported format", `{"type": "object", "properties": {"mail": {"type": "string", "format": "email"}}}`, "#/properties/mail/format"},
+		{"non-string enum", `{"type": "array", "items": {"type": "integer", "enum": [1, 2]}}`, "#/items/enum"},
+		{"mixed enum", `{"enum": ["a", 1]}`, "#/enum/1"},
+		{"missing items", `{"type": "object", "properties": {"list": {"type": "array"}}}`, "#/properties/list"},
+		{"prefixItems", `{"type": "array", "items": {"type": "string"}, "prefixItems": []}`, "#/prefixItems"},
+		{"minItems greater than maxItems", `{"type": "array", "items": {"type": "string"}, "minItems": 3, "maxItems": 1}`, "#/minItems"},
+		{"negative maxItems", `{"type": "array", "items": {"type": "string"}, "maxItems": -1}`, "#/maxItems"},
+		{"undefined required", `{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["a", "b"]}`, "#/required/1"},
+		{"additionalProperties schema", `{"type": "object", "properties": {}, "additionalProperties": {"type": "string"}}`, "#/additionalProperties"},
+		{"keyword for other type", `{"type": "string", "minItems": 1}`, "#/minItems"},
+		{"missing ref", `{"type": "object", "properties": {"a": {"$ref": "#/$defs/missing"}}}`, "#/properties/a/$ref"},
+		{"remote ref", `{"$ref": "https://example.com/schema.json"}`, "#/$ref"},
+		{"recursive ref", `{"$defs": {"node": {"type": "object", "properties": {"child": {"$ref": "#/$defs/node"}}}}, "$ref": "#/$defs/node"}`, "#/$defs/node/properties/child/$ref"},
+		{"error inside ref", `{"$defs": {"bad": {"type": "string", "format": "uri"}}, "type": "array", "items": {"$ref": "#/$defs/bad"}}`, "#/$defs/bad/format"},
+		{"escaped property name", `{"type": "object", "properties": {"a/b": {"type": "bogus"}}}`, "#/properties/a~1b/type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := convertJsonSchemaToGeminiSchema(mustParseSchema(t, tt.schema))
+			var schemaErr *SchemaError
+			if !errors.As(err, &schemaErr) {
+				t.Fatalf("expected SchemaError; got %v", err)
+			}
+			if schemaErr.Path != tt.path {
+				t.Errorf("error path = %q, want %q (%v)", schemaErr.Path, tt.path, err)
+			}
+		})
+	}
+}
+
+func TestResponseFormatSchema(t *testing.T) {
+	// タグ付けと検索で使う型から作ったスキーマはGeminiでも使える
+	for _, answerType := range []reflect.Type{reflect.TypeOf(effectTagsAnswer{}), reflect.TypeOf(searchAnswer{})} {
+		responseFormat, err := StructuredResponseFormat(answerType)
+		if err != nil {
+			t.Fatalf("StructuredResponseFormat(%s) error = %v", answerType, err)
+		}
+		schema, jsonMode, err := responseFormatSchema(responseFormat)
+		if err != nil || !jsonMode || schema == nil {
+			t.Fatalf("responseFormatSchema() = %v, %v, %v", schema, jsonMode, err)
+		}
+		if _, err := convertJsonSchemaToGeminiSchema(schema); err != nil {
+			t.Errorf("failed to convert %s: %v", answerType, err)
+		}
+	}
+
+	if schema, jsonMode, err := responseFormatSchema(map[string]interface{}{"type": "json_object"}); err != nil || !jsonMode || schema != nil {
+		t.Errorf("unexpected result for json_object: %v, %v, %v", schema, jsonMode, err)
+	}
+	if _, _, err := responseFormatSchema(map[string]interface{}{"type": "json_schema"}); err == nil {
+		t.Error("expected error for missing json_schema")
+	}
+}
@@ -0,0 +1,337 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 構造化した応答が不正だった場合に問い直す回数の既定値
+const defaultStructuredRetries = 2
+
+// structuredRetries は環境変数AI_STRUCTURED_RETRIESの問い直す回数を返す
+func structuredRetries() int {
+	return envInt("AI_STRUCTURED_RETRIES", defaultStructuredRetries)
+}
+
+var ErrInvalidStructuredResponse = errors.New("invalid structured response")
+
+// StructuredResponseError は問い直してもスキーマに合う応答が得られなかったことを表す
+type StructuredResponseError struct {
+	Attempts int
+	// 最後の応答とその検証エラー
+	Message string
+	Err     error
+}
+
+func (e *StructuredResponseError) Error() string {
+	return fmt.Sprintf("%v after %d attempts: %v", ErrInvalidStructuredResponse, e.Attempts, e.Err)
+}
+
+func (e *StructuredResponseError) Unwrap() []error {
+	return []error{ErrInvalidStructuredResponse, e.Err}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// SchemaFor はGoの型からOpenAIのstrictモードで使えるJSON Schemaを作る
+// フィールド名はjsonタグに従い、すべてrequiredにする ポインタはnullを許す
+// descriptionタグは説明に、enumタグ(カンマ区切り)は列挙値になる
+func SchemaFor(t reflect.Type) (map[string]interface{}, error) {
+	return schemaForType(t, "#", make(map[reflect.Type]bool))
+}
+
+func schemaForType(t reflect.Type, path string, visiting map[reflect.Type]bool) (map[string]interface{}, error) {
+	if t.Kind() == reflect.Pointer {
+		schema, err := schemaForType(t.Elem(), path, visiting)
+		if err != nil {
+			return nil, err
+		}
+		schema["type"] = []interface{}{schema["type"], "null"}
+		return schema, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := schemaForType(t.Elem(), path+"/items", visiting)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}, nil
+		}
+		if visiting[t] {
+			return nil, &SchemaError{Path: path, Message: fmt.Sprintf("recursive type %s is not supported", t)}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		properties := make(map[string]interface{})
+		required := []interface{}{}
+		if err := addStructProperties(t, path, visiting, properties, &required); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		}, nil
+	default:
+		return nil, &SchemaError{Path: path, Message: fmt.Sprintf("type %s is not supported", t)}
+	}
+}
+
+// addStructProperties は構造体のフィールドをプロパティにする 埋め込んだ構造体のフィールドは展開する
+func addStructProperties(t reflect.Type, path string, visiting map[reflect.Type]bool, properties map[string]interface{}, required *[]interface{}) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// encoding/jsonと同じく、埋め込んだ構造体は型が非公開でもフィールドを展開する
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			if err := addStructProperties(field.Type, path, visiting, properties, required); err != nil {
+				return err
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		propPath := path + "/properties/" + escapePointer(name)
+		schema, err := schemaForType(field.Type, propPath, visiting)
+		if err != nil {
+			return err
+		}
+		if description := field.Tag.Get("description"); description != "" {
+			schema["description"] = description
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			values := []interface{}{}
+			for _, value := range strings.Split(enum, ",") {
+				values = append(values, value)
+			}
+			if field.Type.Kind() == reflect.Pointer {
+				values = append(values, nil)
+			}
+			schema["enum"] = values
+		}
+		properties[name] = schema
+		*required = append(*required, name)
+	}
+	return nil
+}
+
+var schemaNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// StructuredResponseFormat はGoの型からresponse_formatを作る
+func StructuredResponseFormat(t reflect.Type) (map[string]interface{}, error) {
+	schema, err := SchemaFor(t)
+	if err != nil {
+		return nil, err
+	}
+	name := schemaNamePattern.ReplaceAllString(t.Name(), "_")
+	if name == "" {
+		name = "response"
+	}
+	return map[string]interface{}{
+		"type": "json_schema",
+		"json_schema": map[string]interface{}{
+			"name":   name,
+			"strict": true,
+			"schema": schema,
+		},
+	}, nil
+}
+
+// validateJsonSchema はJSONから読んだ値がSchemaForで作ったスキーマに合うかを確かめる
+// 合わない場合は場所を含んだエラーを返す
+func validateJsonSchema(schema map[string]interface{}, value interface{}, path string) error {
+	types := []string{}
+	switch schemaType := schema["type"].(type) {
+	case string:
+		types = append(types, schemaType)
+	case []interface{}:
+		for _, t := range schemaType {
+			if s, ok := t.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+
+	if value == nil {
+		for _, t := range types {
+			if t == "null" {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: must not be null", path)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+
+	for _, t := range types {
+		switch t {
+		case "object":
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			properties, _ := schema["properties"].(map[string]interface{})
+			required, _ := schema["required"].([]interface{})
+			for _, name := range required {
+				if _, ok := object[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing property %q", path, name)
+				}
+			}
+			for key, propValue := range object {
+				propSchema, ok := properties[key].(map[string]interface{})
+				if !ok {
+					if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+						return fmt.Errorf("%s: unexpected property %q", path, key)
+					}
+					continue
+				}
+				if err := validateJsonSchema(propSchema, propValue, path+"."+key); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "array":
+			array, ok := value.([]interface{})
+			if !ok {
+				continue
+			}
+			items, _ := schema["items"].(map[string]interface{})
+			for i, item := range array {
+				if items == nil {
+					break
+				}
+				if err := validateJsonSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "string":
+			if _, ok := value.(string); ok {
+				return nil
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return nil
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return nil
+			}
+		case "integer":
+			if n, ok := value.(float64); ok && n == float64(int64(n)) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s: expected %s", path, strings.Join(types, " or "))
+}
+
+// GenerateTyped はTの形でモデルに答えさせ、検証してTに読み込んで返す
+// スキーマに合わない応答だった場合は、その応答とエラーを伝えてretriesの回数まで問い直す
+// 返すGenerateResponseのUsageはすべての問い合わせの合計 Cachedは最後の問い合わせの応答のもの
+func GenerateTyped[T any](ctx context.Context, client LLMClient, request GenerateRequest, retries int) (*T, *GenerateResponse, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	responseFormat, err := StructuredResponseFormat(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	schema := responseFormat["json_schema"].(map[string]interface{})["schema"].(map[string]interface{})
+	request.ResponseFormat = responseFormat
+
+	total := &GenerateResponse{}
+	prompt := request.Prompt
+	var lastErr error
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		response, err := client.Generate(ctx, request)
+		if err != nil {
+			return nil, total, err
+		}
+		total.Model = response.Model
+		total.Message = response.Message
+		total.Cached = response.Cached
+		total.Usage.InputTokens += response.Usage.InputTokens
+		total.Usage.OutputTokens += response.Usage.OutputTokens
+
+		result, err := decodeStructured[T](schema, response.Message)
+		if err == nil {
+			return result, total, nil
+		}
+		lastErr = err
+
+		// 前回の応答とエラーを付けて問い直す
+		request.Prompt = fmt.Sprintf("%s\n\nYour previous answer was:\n%s\n\nIt was rejected: %v\nAnswer again with JSON that matches the schema.", prompt, response.Message, err)
+	}
+	return nil, total, &StructuredResponseError{Attempts: retries + 1, Message: total.Message, Err: lastErr}
+}
+
+func decodeStructured[T any](schema map[string]interface{}, message string) (*T, error) {
+	message, err := validateStructured(schema, message)
+	if err != nil {
+		return nil, err
+	}
+
+	var result T
+	if err := json.Unmarshal([]byte(message), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// validateStructured は応答がスキーマに合うJSONかを確かめ、コードブロックを外したJSONを返す
+func validateStructured(schema map[string]interface{}, message string) (string, error) {
+	// コードブロックで囲んで返すモデルがあるので外す
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, "```") {
+		message = strings.TrimPrefix(strings.TrimPrefix(message, "```json"), "```")
+		message = strings.TrimSpace(strings.TrimSuffix(message, "```"))
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal([]byte(message), &raw); err != nil {
+		return "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if err := validateJsonSchema(schema, raw, "$"); err != nil {
+		return "", err
+	}
+	return message, nil
+}
@@ -0,0 +1,184 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedClient は決められた応答を順番に返すLLMClient
+type scriptedClient struct {
+	replies  []string
+	requests []GenerateRequest
+}
+
+func (c *scriptedClient) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	c.requests = append(c.requests, request)
+	if len(c.replies) == 0 {
+		return nil, errors.New("no more replies")
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	return &GenerateResponse{Model: "scripted", Message: reply, Usage: TokenUsage{InputTokens: 3, OutputTokens: 2}}, nil
+}
+
+// GenerateStream は応答を1文字ずつonDeltaに渡す
+func (c *scriptedClient) GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error) {
+	response, err := c.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range response.Message {
+		if err := onDelta(string(r)); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+func (c *scriptedClient) Close() error {
+	return nil
+}
+
+type testAnswerBase struct {
+	Id string `json:"id"`
+}
+
+type testAnswer struct {
+	testAnswerBase
+	Title   string     `json:"title" description:"見出し"`
+	Season  *string    `json:"season" enum:"spring,summer"`
+	Count   int        `json:"count"`
+	Ratio   float64    `json:"ratio"`
+	Labels  []string   `json:"labels"`
+	Updated time.Time  `json:"updated"`
+	Items   []testItem `json:"items"`
+	Ignored string     `json:"-"`
+	private string
+}
+
+type testItem struct {
+	Name string `json:"name"`
+	Ok   bool   `json:"ok"`
+}
+
+func TestSchemaFor(t *testing.T) {
+	schema, err := SchemaFor(reflect.TypeOf(testAnswer{}))
+	if err != nil {
+		t.Fatalf("SchemaFor() error = %v", err)
+	}
+
+	want := mustParseSchema(t, `{
+		"type": "object",
+		"properties": {
+			"id": {"type": "string"},
+			"title": {"type": "string", "description": "見出し"},
+			"season": {"type": ["string", "null"], "enum": ["spring", "summer", null]},
+			"count": {"type": "integer"},
+			"ratio": {"type": "number"},
+			"labels": {"type": "array", "items": {"type": "string"}},
+			"updated": {"type": "string", "format": "date-time"},
+			"items": {"type": "array", "items": {
+				"type": "object",
+				"properties": {"name": {"type": "string"}, "ok": {"type": "boolean"}},
+				"required": ["name", "ok"],
+				"additionalProperties": false
+			}}
+		},
+		"required": ["id", "title", "season", "count", "ratio", "labels", "updated", "items"],
+		"additionalProperties": false
+	}`)
+	// JSONを通して型をそろえて比べる
+	schemaJson, _ := json.Marshal(schema)
+	var got map[string]interface{}
+	json.Unmarshal(schemaJson, &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SchemaFor() = %s", schemaJson)
+	}
+
+	// Geminiのスキーマにも変換できる
+	if _, err := convertJsonSchemaToGeminiSchema(got); err != nil {
+		t.Errorf("failed to convert to gemini schema: %v", err)
+	}
+
+	type recursive struct {
+		Children []recursive `json:"children"`
+	}
+	if _, err := SchemaFor(reflect.TypeOf(recursive{})); err == nil {
+		t.Error("expected error for recursive type")
+	}
+	if _, err := SchemaFor(reflect.TypeOf(map[string]string{})); err == nil {
+		t.Error("expected error for map type")
+	}
+}
+
+func TestValidateJsonSchema(t *testing.T) {
+	schema, _ := SchemaFor(reflect.TypeOf(testItem{}))
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{`{"name": "a", "ok": true}`, ""},
+		{`{"name": "a"}`, `$: missing property "ok"`},
+		{`{"name": "a", "ok": true, "extra": 1}`, `$: unexpected property "extra"`},
+		{`{"name": 1, "ok": true}`, `$.name: expected string`},
+		{`{"name": null, "ok": true}`, `$.name: must not be null`},
+		{`[]`, `$: expected object`},
+	}
+	for _, tt := range tests {
+		var value interface{}
+		json.Unmarshal([]byte(tt.value), &value)
+		err := validateJsonSchema(schema, value, "$")
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("validateJsonSchema(%s) = %v, want %q", tt.value, err, tt.err)
+		}
+	}
+}
+
+func TestGenerateTyped(t *testing.T) {
+	client := &scriptedClient{replies: []string{
+		"not json",
+		`{"name": "a", "ok": "yes"}`,
+		"```json\n{\"name\": \"朝顔\", \"ok\": true}\n```",
+	}}
+
+	result, response, err := GenerateTyped[testItem](context.Background(), client, GenerateRequest{Prompt: "答えて"}, 2)
+	if err != nil {
+		t.Fatalf("GenerateTyped() error = %v", err)
+	}
+	if result.Name != "朝顔" || !result.Ok {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if response.Usage != (TokenUsage{InputTokens: 9, OutputTokens: 6}) {
+		t.Errorf("expected usage of all attempts; got %+v", response.Usage)
+	}
+
+	if len(client.requests) != 3 {
+		t.Fatalf("expected 3 requests; got %d", len(client.requests))
+	}
+	if name := client.requests[0].ResponseFormat["json_schema"].(map[string]interface{})["name"]; name != "testItem" {
+		t.Errorf("unexpected schema name: %v", name)
+	}
+	// 問い直しには前回の応答とエラーが含まれる
+	retryPrompt := client.requests[2].Prompt
+	if !strings.HasPrefix(retryPrompt, "答えて") || !strings.Contains(retryPrompt, `"ok": "yes"`) || !strings.Contains(retryPrompt, "$.ok: expected boolean") {
+		t.Errorf("unexpected retry prompt: %s", retryPrompt)
+	}
+}
+
+func TestGenerateTyped_exhausted(t *testing.T) {
+	client := &scriptedClient{replies: []string{"{}", "{}"}}
+
+	_, _, err := GenerateTyped[testItem](context.Background(), client, GenerateRequest{Prompt: "答えて"}, 1)
+	var structuredErr *StructuredResponseError
+	if !errors.As(err, &structuredErr) || !errors.Is(err, ErrInvalidStructuredResponse) {
+		t.Fatalf("expected StructuredResponseError; got %v", err)
+	}
+	if structuredErr.Attempts != 2 || structuredErr.Message != "{}" {
+		t.Errorf("unexpected error: %+v", structuredErr)
+	}
+}
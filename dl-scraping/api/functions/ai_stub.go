@@ -0,0 +1,342 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// stubModelPrefix はスタブの応答のモデル名に付ける 料金表にないので料金は0になる
+const stubModelPrefix = "stub/"
+
+// StubRule はスタブが返す応答の台本の1件
+// MatchとSchemaの両方に合うリクエストにReplyを返す 空の条件はすべてに合う
+type StubRule struct {
+	// プロンプトに含まれる文字列
+	Match string `json:"match"`
+	// response_formatのjson_schemaの名前
+	Schema string `json:"schema"`
+	// 文字列はそのまま、それ以外はJSONにして返す
+	Reply interface{} `json:"reply"`
+}
+
+// StubClient はネットワークやキーなしで動くLLMClient
+// 台本に合うリクエストには台本の応答を返し、それ以外はスキーマに合う応答を作って返す
+// 同じリクエスト(画像を含む)には同じ応答を返す
+type StubClient struct {
+	modelName string
+	rules     []StubRule
+}
+
+// useStubProvider は環境変数AI_PROVIDERでスタブが選ばれているかを返す
+func useStubProvider() bool {
+	return os.Getenv("AI_PROVIDER") == "stub"
+}
+
+// newStubClient はスタブのクライアントを作る
+// 環境変数AI_STUB_SCRIPTにStubRuleの配列のJSONファイルを指定すると台本として使う
+func newStubClient(modelName string) (*StubClient, error) {
+	client := &StubClient{modelName: stubModelPrefix + modelName}
+	path := os.Getenv("AI_STUB_SCRIPT")
+	if path == "" {
+		return client, nil
+	}
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stub script: %w", err)
+	}
+	if err := json.Unmarshal(script, &client.rules); err != nil {
+		return nil, fmt.Errorf("invalid stub script %s: %w", path, err)
+	}
+	return client, nil
+}
+
+func (c *StubClient) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	message, err := c.reply(request)
+	if err != nil {
+		return nil, err
+	}
+	return &GenerateResponse{
+		Model:   c.modelName,
+		Message: message,
+		Usage:   stubUsage(request, message),
+	}, nil
+}
+
+// GenerateStream は応答を単語ごとに区切ってonDeltaに渡す
+func (c *StubClient) GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error) {
+	response, err := c.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	for _, delta := range strings.SplitAfter(response.Message, " ") {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if delta == "" {
+			continue
+		}
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+func (c *StubClient) Close() error {
+	return nil
+}
+
+// reply は台本か、なければresponse_formatに合わせて応答を作る
+func (c *StubClient) reply(request GenerateRequest) (string, error) {
+	schemaName := ""
+	if jsonSchema, ok := request.ResponseFormat["json_schema"].(map[string]interface{}); ok {
+		schemaName, _ = jsonSchema["name"].(string)
+	}
+	for _, rule := range c.rules {
+		if rule.Match != "" && !strings.Contains(request.Prompt, rule.Match) {
+			continue
+		}
+		if rule.Schema != "" && rule.Schema != schemaName {
+			continue
+		}
+		if reply, ok := rule.Reply.(string); ok {
+			return reply, nil
+		}
+		reply, err := json.Marshal(rule.Reply)
+		if err != nil {
+			return "", err
+		}
+		return string(reply), nil
+	}
+
+	schema, jsonMode, err := responseFormatSchema(request.ResponseFormat)
+	if err != nil {
+		return "", err
+	}
+	seed := stubSeed(request)
+	switch {
+	case schema != nil:
+		synthesizer := &stubSynthesizer{converter: &schemaConverter{root: schema}, seed: seed}
+		value, err := synthesizer.value(schema, "#")
+		if err != nil {
+			return "", err
+		}
+		reply, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(reply), nil
+	case jsonMode:
+		return "{}", nil
+	default:
+		prompt := request.Prompt
+		if utf8.RuneCountInString(prompt) > 40 {
+			prompt = string([]rune(prompt)[:40]) + "..."
+		}
+		return fmt.Sprintf("Stub answer %08x for %q with %d image(s).", seed, prompt, len(request.Images)), nil
+	}
+}
+
+// stubSeed はリクエストの内容から応答を選ぶための値を作る
+func stubSeed(request GenerateRequest) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(request.SystemInstructions))
+	// 呼び出し元の履歴の配列に書き込まないように複製してから足す
+	messages := append(append([]Message(nil), request.History...), Message{Role: RoleUser, Text: request.Prompt, Images: request.Images})
+	for _, message := range messages {
+		hash.Write([]byte{0})
+		hash.Write([]byte(message.Role + ":" + message.Text))
+		for _, image := range message.Images {
+			hash.Write([]byte{0})
+			hash.Write([]byte(image.MimeType))
+			hash.Write(image.Data)
+		}
+	}
+	return hash.Sum32()
+}
+
+// stubUsage は文字数からトークン数を大まかに見積もる 画像は1枚85トークンとする 会話の履歴も数える
+func stubUsage(request GenerateRequest, message string) TokenUsage {
+	input := (len(request.Prompt)+len(request.SystemInstructions))/4 + 85*len(request.Images)
+	for _, message := range request.History {
+		input += len(message.Text)/4 + 85*len(message.Images)
+	}
+	output := len(message) / 4
+	return TokenUsage{InputTokens: max(input, 1), OutputTokens: max(output, 1)}
+}
+
+// stubSynthesizer はJSON Schemaに合う値を作る
+// 値はseedと場所から決めるので、同じリクエストには同じ値を返す
+type stubSynthesizer struct {
+	converter *schemaConverter
+	seed      uint32
+	// 解決中の$ref 再帰の検出に使う
+	resolving map[string]bool
+}
+
+// pick は場所ごとに0からn-1の値を選ぶ
+func (s *stubSynthesizer) pick(path string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(path))
+	return int((hash.Sum32() ^ s.seed) % uint32(n))
+}
+
+func (s *stubSynthesizer) value(node map[string]interface{}, path string) (interface{}, error) {
+	if ref, ok := node["$ref"].(string); ok {
+		// 再帰する参照は値を作り終えられないので、schemaConverterと同じく受け付けない
+		if s.resolving[ref] {
+			return nil, s.converter.errorf(path+"/$ref", "recursive reference %q is not supported", ref)
+		}
+		target, err := s.converter.resolve(ref, path+"/$ref")
+		if err != nil {
+			return nil, err
+		}
+		if s.resolving == nil {
+			s.resolving = make(map[string]bool)
+		}
+		s.resolving[ref] = true
+		defer delete(s.resolving, ref)
+		return s.value(target, ref)
+	}
+	if value, ok := node["const"]; ok {
+		return value, nil
+	}
+	if enum, ok := node["enum"].([]interface{}); ok {
+		var values []interface{}
+		for _, value := range enum {
+			if value != nil {
+				values = append(values, value)
+			}
+		}
+		if len(values) > 0 {
+			return values[s.pick(path, len(values))], nil
+		}
+		return nil, nil
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		if union, ok := node[keyword].([]interface{}); ok {
+			for i, option := range union {
+				if option, ok := option.(map[string]interface{}); ok && !isNullSchema(option) {
+					return s.value(option, fmt.Sprintf("%s/%s/%d", path, keyword, i))
+				}
+			}
+			return nil, nil
+		}
+	}
+
+	schemaType, _ := node["type"].(string)
+	if types, ok := node["type"].([]interface{}); ok {
+		for _, t := range types {
+			if t, ok := t.(string); ok && t != "null" {
+				schemaType = t
+				break
+			}
+		}
+	}
+	if schemaType == "" {
+		switch {
+		case node["properties"] != nil:
+			schemaType = "object"
+		case node["items"] != nil:
+			schemaType = "array"
+		default:
+			schemaType = "string"
+		}
+	}
+
+	switch schemaType {
+	case "object":
+		properties, _ := node["properties"].(map[string]interface{})
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		object := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			value, err := s.value(property, path+"/properties/"+escapePointer(name))
+			if err != nil {
+				return nil, err
+			}
+			object[name] = value
+		}
+		return object, nil
+	case "array":
+		items, _ := node["items"].(map[string]interface{})
+		if items == nil {
+			return []interface{}{}, nil
+		}
+		count := 1 + s.pick(path, 3)
+		if minItems, ok := node["minItems"].(float64); ok && count < int(minItems) {
+			count = int(minItems)
+		}
+		if maxItems, ok := node["maxItems"].(float64); ok && count > int(maxItems) {
+			count = int(maxItems)
+		}
+		array := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			value, err := s.value(items, fmt.Sprintf("%s/items/%d", path, i))
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case "boolean":
+		return s.pick(path, 2) == 1, nil
+	case "integer", "number":
+		minimum, hasMinimum := node["minimum"].(float64)
+		maximum, hasMaximum := node["maximum"].(float64)
+		switch {
+		case hasMinimum && hasMaximum:
+			if schemaType == "integer" {
+				return minimum + float64(s.pick(path, int(maximum-minimum)+1)), nil
+			}
+			return minimum + (maximum-minimum)*float64(s.pick(path, 101))/100, nil
+		case hasMinimum:
+			return minimum + float64(s.pick(path, 10)), nil
+		case hasMaximum:
+			return maximum - float64(s.pick(path, 10)), nil
+		case schemaType == "integer":
+			return float64(s.pick(path, 10)), nil
+		default:
+			return float64(s.pick(path, 101)) / 100, nil
+		}
+	case "null":
+		return nil, nil
+	default:
+		switch node["format"] {
+		case "date-time":
+			return "2024-01-01T00:00:00Z", nil
+		case "date":
+			return "2024-01-01", nil
+		}
+		value := fmt.Sprintf("stub-%s-%d", stubWords[s.pick(path, len(stubWords))], s.pick(path+"#", 100))
+		if minLength, ok := node["minLength"].(float64); ok && len(value) < int(minLength) {
+			value += strings.Repeat("x", int(minLength)-len(value))
+		}
+		if maxLength, ok := node["maxLength"].(float64); ok && len(value) > int(maxLength) {
+			value = value[:int(maxLength)]
+		}
+		return value, nil
+	}
+}
+
+// stubWords は作った文字列に使う単語
+var stubWords = []string{"red", "blue", "green", "calm", "happy", "cat", "flower", "night"}
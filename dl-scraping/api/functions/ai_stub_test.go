@@ -0,0 +1,178 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+// setupStubProvider はスタブのモデルを使うようにする scriptは台本のJSON 空なら台本なし
+func setupStubProvider(t *testing.T, script string) {
+	t.Helper()
+	t.Setenv("AI_PROVIDER", "stub")
+	t.Setenv("AI_MODEL", "gpt-4o-mini")
+	// 問い合わせないことを確かめるため、存在しない宛先にしておく
+	t.Setenv("OPEN_AI_API_URL", "http://127.0.0.1:0")
+	t.Setenv("AI_STUB_SCRIPT", "")
+	if script != "" {
+		path := filepath.Join(t.TempDir(), "script.json")
+		if err := os.WriteFile(path, []byte(script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("AI_STUB_SCRIPT", path)
+	}
+}
+
+func TestStubClient_structured(t *testing.T) {
+	setupStubProvider(t, "")
+	model, _ := resolveModel("gpt-4o")
+	client, err := NewLLMClient(context.Background(), model)
+	if err != nil {
+		t.Fatalf("NewLLMClient() error = %v", err)
+	}
+
+	// 画像ごとにスキーマに合うタグを返し、同じ画像には同じタグを返す
+	tags := make(map[string]*EffectTags)
+	for _, id := range []string{"1", "2", "1"} {
+		image := ImagePart{MimeType: "image/jpeg", Data: fakeupstream.ImageData(id)}
+		effectTags, err := tagEffectImage(context.Background(), client, image)
+		if err != nil {
+			t.Fatalf("tagEffectImage() error = %v", err)
+		}
+		if effectTags.Model != "stub/gpt-4o-2024-08-06" || len(effectTags.Colors) == 0 || effectTags.Season == "" {
+			t.Errorf("unexpected tags: %+v", effectTags)
+		}
+		if previous, ok := tags[id]; ok && !reflect.DeepEqual(previous, effectTags) {
+			t.Errorf("expected the same tags for the same image; got %+v and %+v", previous, effectTags)
+		}
+		tags[id] = effectTags
+	}
+
+	response, err := client.Generate(context.Background(), GenerateRequest{Prompt: "hello"})
+	if err != nil || !strings.Contains(response.Message, "hello") || response.Usage.OutputTokens == 0 {
+		t.Errorf("unexpected text response: %+v, %v", response, err)
+	}
+	if cost := estimateCost(response.Model, response.Usage); cost != 0 {
+		t.Errorf("expected no cost for stub; got %v", cost)
+	}
+}
+
+func TestStubClient_synthesize(t *testing.T) {
+	schema := mustParseSchema(t, `{
+		"type": "object",
+		"properties": {
+			"when": {"type": "string", "format": "date-time"},
+			"score": {"type": "number", "minimum": 0, "maximum": 1},
+			"count": {"type": "integer", "minimum": 3, "maximum": 5},
+			"kind": {"const": "effect"},
+			"note": {"anyOf": [{"type": "null"}, {"type": "string", "maxLength": 5}]},
+			"items": {"type": "array", "minItems": 4, "items": {"$ref": "#/$defs/item"}}
+		},
+		"required": ["when", "score", "count", "kind", "note", "items"],
+		"additionalProperties": false,
+		"$defs": {"item": {"type": "object", "properties": {"ok": {"type": "boolean"}}, "required": ["ok"], "additionalProperties": false}}
+	}`)
+	synthesizer := &stubSynthesizer{converter: &schemaConverter{root: schema}, seed: 1}
+	value, err := synthesizer.value(schema, "#")
+	if err != nil {
+		t.Fatalf("value() error = %v", err)
+	}
+	object := value.(map[string]interface{})
+	if len(object["items"].([]interface{})) < 4 || object["kind"] != "effect" || len(object["note"].(string)) > 5 {
+		t.Errorf("unexpected value: %v", value)
+	}
+	if count := object["count"].(float64); count < 3 || count > 5 {
+		t.Errorf("count out of range: %v", count)
+	}
+	// $defsは値に含まれないので、検証用に除く
+	delete(schema, "$defs")
+	schema["properties"].(map[string]interface{})["items"] = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}
+	schema["properties"].(map[string]interface{})["note"] = map[string]interface{}{"type": []interface{}{"string", "null"}}
+	schema["properties"].(map[string]interface{})["kind"] = map[string]interface{}{"type": "string"}
+	if err := validateJsonSchema(schema, value, "$"); err != nil {
+		t.Errorf("synthesized value does not match schema: %v", err)
+	}
+}
+
+func TestStubClient_recursiveRef(t *testing.T) {
+	schema := mustParseSchema(t, `{
+		"$ref": "#/$defs/node",
+		"$defs": {"node": {"type": "object", "properties": {"child": {"$ref": "#/$defs/node"}}, "required": ["child"]}}
+	}`)
+	synthesizer := &stubSynthesizer{converter: &schemaConverter{root: schema}, seed: 1}
+	if _, err := synthesizer.value(schema, "#"); err == nil || !strings.Contains(err.Error(), "recursive") {
+		t.Errorf("expected recursive reference error; got %v", err)
+	}
+}
+
+func Test_stubSeed_history(t *testing.T) {
+	// 余裕のある配列を渡しても書き換えない
+	history := make([]Message, 1, 2)
+	history[0] = Message{Role: RoleUser, Text: "q1"}
+	backing := history[:2]
+	backing[1] = Message{Role: RoleAssistant, Text: "a1"}
+
+	stubSeed(GenerateRequest{History: history, Prompt: "q2"})
+	if backing[1].Text != "a1" {
+		t.Errorf("expected the caller's history to be untouched; got %+v", backing[1])
+	}
+}
+
+func TestStubClient_script(t *testing.T) {
+	setupStubProvider(t, `[
+		{"schema": "searchAnswer", "reply": {"results": [{"id": "3", "score": 0.9, "reason": "autumn"}]}},
+		{"match": "紅葉", "reply": "紅葉がおすすめです"}
+	]`)
+	model, _ := resolveModel("gemini-1.5-flash")
+	client, err := NewLLMClient(context.Background(), model)
+	if err != nil {
+		t.Fatalf("NewLLMClient() error = %v", err)
+	}
+
+	var deltas []string
+	response, err := client.GenerateStream(context.Background(), GenerateRequest{Prompt: "紅葉のエフェクトは?"}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil || response.Message != "紅葉がおすすめです" || strings.Join(deltas, "") != response.Message {
+		t.Errorf("unexpected scripted response: %+v, %q, %v", response, deltas, err)
+	}
+
+	effects := []EffectInfo{{Id: "1", Name: "朝顔"}, {Id: "3", Name: "紅葉"}}
+	results, err := rankEffectsWithModel(context.Background(), client, "autumn", effects)
+	if err != nil {
+		t.Fatalf("rankEffectsWithModel() error = %v", err)
+	}
+	if len(results) != 1 || results[0].Effect.Id != "3" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	t.Setenv("AI_STUB_SCRIPT", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := NewLLMClient(context.Background(), model); err == nil {
+		t.Error("expected error for missing script")
+	}
+}
+
+func TestTagEffects_stub(t *testing.T) {
+	setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	useMemoryCatalog(t)
+	useMemoryTags(t)
+	useMemoryUsage(t)
+	setupStubProvider(t, "")
+
+	_, res := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword, EffectIds: []string{"1", "2"}})
+	if !res.Succeed || res.Tagged != 2 || len(res.Failed) != 0 {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+	body, _ := json.Marshal(res.Tags)
+	if !strings.Contains(string(body), "stub/gpt-4o-mini-2024-07-18") {
+		t.Errorf("expected tags from stub model; got %s", body)
+	}
+}
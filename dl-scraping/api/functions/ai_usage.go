@@ -0,0 +1,390 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joho/godotenv"
+	"google.golang.org/api/iterator"
+)
+
+// 集計期間の既定値
+const defaultUsageDays = 30
+
+// 日ごとの集計は日本時間で区切る
+var usageLocation = time.FixedZone("JST", 9*60*60)
+
+// ModelPrice は100万トークンあたりの料金(USD)
+type ModelPrice struct {
+	InputPerMillion  float64 `json:"inputPerMillion"`
+	OutputPerMillion float64 `json:"outputPerMillion"`
+}
+
+// modelPrice はモデルの料金を返す
+// 環境変数AI_MODEL_PRICESに{"モデル名": ModelPrice}の形のJSONがあればそちらを優先し、なければモデルの設定の料金
+func modelPrice(model string) (ModelPrice, bool) {
+	if value := os.Getenv("AI_MODEL_PRICES"); value != "" {
+		var overrides map[string]ModelPrice
+		if err := json.Unmarshal([]byte(value), &overrides); err != nil {
+			log.Printf("Invalid AI_MODEL_PRICES: %v", err)
+		} else if price, ok := overrides[model]; ok {
+			return price, true
+		}
+	}
+
+	registry, err := getModelRegistry()
+	if err != nil {
+		log.Printf("Failed to load model registry: %v", err)
+		return ModelPrice{}, false
+	}
+	config, err := registry.Lookup(model)
+	if err != nil {
+		return ModelPrice{}, false
+	}
+	return config.Price, true
+}
+
+// estimateCost はトークン数から料金を見積もる 料金が分からないモデルは0
+func estimateCost(model string, usage TokenUsage) float64 {
+	price, ok := modelPrice(model)
+	if !ok {
+		return 0
+	}
+	return (float64(usage.InputTokens)*price.InputPerMillion + float64(usage.OutputTokens)*price.OutputPerMillion) / 1e6
+}
+
+// UsageRecord は1回の問い合わせの使用量
+type UsageRecord struct {
+	Account      string    `json:"-" firestore:"account"`
+	Caller       string    `json:"caller" firestore:"caller"`
+	Model        string    `json:"model" firestore:"model"`
+	InputTokens  int       `json:"inputTokens" firestore:"inputTokens"`
+	OutputTokens int       `json:"outputTokens" firestore:"outputTokens"`
+	LatencyMs    int64     `json:"latencyMs" firestore:"latencyMs"`
+	Cost         float64   `json:"cost" firestore:"cost"`
+	CreatedAt    time.Time `json:"createdAt" firestore:"createdAt"`
+	// キャッシュから返した場合はtrue トークンと料金は0になる
+	Cached bool `json:"cached" firestore:"cached"`
+}
+
+// UsageRecorder はLLMClientの問い合わせごとに使用量を記録する
+// アカウントが分かる場合は保存先にも残す
+type UsageRecorder struct {
+	client  LLMClient
+	account string
+	caller  string
+
+	mu      sync.Mutex
+	records []UsageRecord
+}
+
+// NewUsageRecorder はclientを包んで使用量を記録する callerは呼び出し元の機能名
+func NewUsageRecorder(client LLMClient, account string, caller string) *UsageRecorder {
+	return &UsageRecorder{client: client, account: account, caller: caller}
+}
+
+func (r *UsageRecorder) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	start := time.Now()
+	response, err := r.client.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	r.record(ctx, start, response)
+	return response, nil
+}
+
+func (r *UsageRecorder) GenerateStream(ctx context.Context, request GenerateRequest, onDelta func(delta string) error) (*GenerateResponse, error) {
+	start := time.Now()
+	response, err := r.client.GenerateStream(ctx, request, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	r.record(ctx, start, response)
+	return response, nil
+}
+
+// record はstartから始まった問い合わせの使用量を記録する
+func (r *UsageRecorder) record(ctx context.Context, start time.Time, response *GenerateResponse) {
+	record := UsageRecord{
+		Account:      r.account,
+		Caller:       r.caller,
+		Model:        response.Model,
+		InputTokens:  response.Usage.InputTokens,
+		OutputTokens: response.Usage.OutputTokens,
+		LatencyMs:    time.Since(start).Milliseconds(),
+		Cost:         estimateCost(response.Model, response.Usage),
+		CreatedAt:    start,
+		Cached:       response.Cached,
+	}
+	r.mu.Lock()
+	r.records = append(r.records, record)
+	r.mu.Unlock()
+
+	if r.account != "" {
+		if err := saveUsage(ctx, record); err != nil {
+			log.Printf("Failed to save usage: %v", err)
+		}
+	}
+}
+
+func (r *UsageRecorder) Close() error {
+	return r.client.Close()
+}
+
+// Records はこれまでに記録した使用量を返す
+func (r *UsageRecorder) Records() []UsageRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]UsageRecord{}, r.records...)
+}
+
+func saveUsage(ctx context.Context, record UsageRecord) error {
+	repository, err := getUsageRepository()
+	if err != nil {
+		return err
+	}
+	return repository.Save(ctx, record)
+}
+
+// UsageRepository はアカウントごとの使用量の保存先
+type UsageRepository interface {
+	Save(ctx context.Context, record UsageRecord) error
+	// List はsince以降の使用量を返す
+	List(ctx context.Context, account string, since time.Time) ([]UsageRecord, error)
+}
+
+var (
+	usageRepositoryOnce sync.Once
+	usageRepository     UsageRepository
+	usageRepositoryErr  error
+)
+
+// getUsageRepository はcatalogStoreで選んだ保存先を返す
+func getUsageRepository() (UsageRepository, error) {
+	usageRepositoryOnce.Do(func() {
+		switch store := catalogStore(); store {
+		case "firestore":
+			client, err := newFirestoreClient(context.Background())
+			if err != nil {
+				usageRepositoryErr = err
+				return
+			}
+			usageRepository = NewFirestoreUsageRepository(client)
+		case "memory":
+			usageRepository = NewMemoryUsageRepository()
+		default:
+			usageRepositoryErr = errors.New("unknown catalog store: " + store)
+		}
+	})
+	return usageRepository, usageRepositoryErr
+}
+
+type MemoryUsageRepository struct {
+	mu      sync.Mutex
+	records map[string][]UsageRecord
+}
+
+func NewMemoryUsageRepository() *MemoryUsageRepository {
+	return &MemoryUsageRepository{records: make(map[string][]UsageRecord)}
+}
+
+func (r *MemoryUsageRepository) Save(ctx context.Context, record UsageRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[record.Account] = append(r.records[record.Account], record)
+	return nil
+}
+
+func (r *MemoryUsageRepository) List(ctx context.Context, account string, since time.Time) ([]UsageRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var records []UsageRecord
+	for _, record := range r.records[account] {
+		if !record.CreatedAt.Before(since) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// FirestoreUsageRepository はaiUsage/{account}/recordsに保存する
+type FirestoreUsageRepository struct {
+	client *firestore.Client
+}
+
+func NewFirestoreUsageRepository(client *firestore.Client) *FirestoreUsageRepository {
+	return &FirestoreUsageRepository{client: client}
+}
+
+func (r *FirestoreUsageRepository) records(account string) *firestore.CollectionRef {
+	return r.client.Collection("aiUsage").Doc(account).Collection("records")
+}
+
+func (r *FirestoreUsageRepository) Save(ctx context.Context, record UsageRecord) error {
+	_, _, err := r.records(record.Account).Add(ctx, record)
+	return err
+}
+
+func (r *FirestoreUsageRepository) List(ctx context.Context, account string, since time.Time) ([]UsageRecord, error) {
+	iter := r.records(account).Where("createdAt", ">=", since).Documents(ctx)
+	defer iter.Stop()
+
+	var records []UsageRecord
+	for {
+		docSnap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record UsageRecord
+		if err := docSnap.DataTo(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// UsageSummary は日とモデルごとの使用量の合計
+type UsageSummary struct {
+	Date         string  `json:"date,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	Calls        int     `json:"calls"`
+	CachedCalls  int     `json:"cachedCalls"`
+	InputTokens  int     `json:"inputTokens"`
+	OutputTokens int     `json:"outputTokens"`
+	Cost         float64 `json:"cost"`
+}
+
+func (s *UsageSummary) add(record UsageRecord) {
+	s.Calls++
+	if record.Cached {
+		s.CachedCalls++
+	}
+	s.InputTokens += record.InputTokens
+	s.OutputTokens += record.OutputTokens
+	s.Cost += record.Cost
+}
+
+// summarizeUsage は使用量を日とモデルごとにまとめる 日付順、同じ日はモデル名順
+func summarizeUsage(records []UsageRecord) ([]UsageSummary, UsageSummary) {
+	type key struct{ date, model string }
+	summaries := make(map[key]*UsageSummary)
+	var total UsageSummary
+	for _, record := range records {
+		k := key{date: record.CreatedAt.In(usageLocation).Format("2006-01-02"), model: record.Model}
+		summary, ok := summaries[k]
+		if !ok {
+			summary = &UsageSummary{Date: k.date, Model: k.model}
+			summaries[k] = summary
+		}
+		summary.add(record)
+		total.add(record)
+	}
+
+	result := make([]UsageSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Date != result[j].Date {
+			return result[i].Date < result[j].Date
+		}
+		return result[i].Model < result[j].Model
+	})
+	return result, total
+}
+
+type RequestAiUsage struct {
+	SessionId   string `json:"sessionId"`
+	MailAddress string `json:"mailAddress"`
+	Password    string `json:"password"`
+	// 何日前からを集計するか 今日を含む
+	Days int `json:"days"`
+}
+
+type ResponseAiUsage struct {
+	Succeed bool           `json:"succeed"`
+	Since   string         `json:"since"`
+	Days    []UsageSummary `json:"days"`
+	Total   UsageSummary   `json:"total"`
+}
+
+// AiUsage はアカウントのAIの使用量と料金の見積もりを日とモデルごとに返す
+func AiUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// JSONデコード
+	var request RequestAiUsage
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	godotenv.Load()
+
+	_, account, err := authenticate(r.Context(), request.SessionId, request.MailAddress, request.Password)
+	if err != nil {
+		log.Printf("Failed to acquire session: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	days := request.Days
+	if days <= 0 {
+		days = defaultUsageDays
+	}
+	now := time.Now().In(usageLocation)
+	since := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, usageLocation)
+
+	repository, err := getUsageRepository()
+	if err != nil {
+		log.Printf("Failed to open usage repository: %v", err)
+		http.Error(w, "Failed to read usage", http.StatusInternalServerError)
+		return
+	}
+	records, err := repository.List(r.Context(), account, since)
+	if err != nil {
+		log.Printf("Failed to read usage: %v", err)
+		http.Error(w, "Failed to read usage", http.StatusInternalServerError)
+		return
+	}
+
+	summaries, total := summarizeUsage(records)
+	response := ResponseAiUsage{
+		Succeed: true,
+		Since:   since.Format("2006-01-02"),
+		Days:    summaries,
+		Total:   total,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,146 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useMemoryUsage はテストの間だけメモリ上の使用量の保存先を使う
+func useMemoryUsage(t *testing.T) *MemoryUsageRepository {
+	t.Helper()
+	repository := NewMemoryUsageRepository()
+
+	getUsageRepository()
+	previous, previousErr := usageRepository, usageRepositoryErr
+	usageRepository, usageRepositoryErr = repository, nil
+	t.Cleanup(func() {
+		usageRepository, usageRepositoryErr = previous, previousErr
+	})
+	return repository
+}
+
+func postAiUsage(t *testing.T, request RequestAiUsage) (*httptest.ResponseRecorder, ResponseAiUsage) {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/ai-usage", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	AiUsage(response, req)
+
+	var res ResponseAiUsage
+	if response.Code == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return response, res
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-12
+}
+
+func TestEstimateCost(t *testing.T) {
+	usage := TokenUsage{InputTokens: 1000000, OutputTokens: 500000}
+	if cost := estimateCost("gpt-4o-mini-2024-07-18", usage); !almostEqual(cost, 0.15+0.30) {
+		t.Errorf("estimateCost() = %v, want 0.45", cost)
+	}
+	if cost := estimateCost("unknown", usage); cost != 0 {
+		t.Errorf("expected 0 for unknown model; got %v", cost)
+	}
+
+	t.Setenv("AI_MODEL_PRICES", `{"unknown": {"inputPerMillion": 1, "outputPerMillion": 2}}`)
+	if cost := estimateCost("unknown", usage); !almostEqual(cost, 2) {
+		t.Errorf("expected overridden price; got %v", cost)
+	}
+	if cost := estimateCost("gpt-4o-mini-2024-07-18", usage); !almostEqual(cost, 0.45) {
+		t.Errorf("expected default price to remain; got %v", cost)
+	}
+}
+
+func TestTagEffects_usage(t *testing.T) {
+	setupFakeUpstream(t)
+	useMemoryTags(t)
+	repository := useMemoryUsage(t)
+	setupTaggingModel(t)
+
+	// sessionIdからアカウントが分かるようにログインしておく
+	_, list := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: testPassword})
+
+	_, res := postTagEffects(t, RequestTagEffects{SessionId: list.SessionId, EffectIds: []string{"1", "2"}})
+	if len(res.Usage) != 2 {
+		t.Fatalf("expected 2 usage records; got %+v", res.Usage)
+	}
+	record := res.Usage[0]
+	if record.Caller != "tag-effects" || record.Model != "gpt-4o-mini-2024-07-18" || record.InputTokens != 10 || record.OutputTokens != 5 {
+		t.Errorf("unexpected usage record: %+v", record)
+	}
+	if !almostEqual(record.Cost, estimateCost(record.Model, TokenUsage{InputTokens: 10, OutputTokens: 5})) || record.Cost == 0 {
+		t.Errorf("unexpected cost: %v", record.Cost)
+	}
+
+	saved, _ := repository.List(context.Background(), accountKey(testMailAddress), time.Time{})
+	if len(saved) != 2 {
+		t.Errorf("expected usage to be saved for the account; got %d", len(saved))
+	}
+
+	response, usage := postAiUsage(t, RequestAiUsage{SessionId: list.SessionId})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if len(usage.Days) != 1 || usage.Days[0].Calls != 2 || usage.Total.InputTokens != 20 || usage.Total.OutputTokens != 10 {
+		t.Errorf("unexpected summary: %+v", usage)
+	}
+}
+
+func TestAiUsage_summary(t *testing.T) {
+	setupFakeUpstream(t)
+	repository := useMemoryUsage(t)
+	ctx := context.Background()
+	account := accountKey(testMailAddress)
+
+	now := time.Now().In(usageLocation)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, usageLocation)
+	records := []UsageRecord{
+		{Model: "gpt-4o", InputTokens: 100, OutputTokens: 10, Cost: 0.5, CreatedAt: today},
+		{Model: "gemini-1.5-flash", InputTokens: 200, OutputTokens: 20, Cost: 0.25, CreatedAt: today},
+		{Model: "gpt-4o", InputTokens: 300, OutputTokens: 30, Cost: 1, CreatedAt: today.Add(time.Hour)},
+		{Model: "gpt-4o", InputTokens: 50, OutputTokens: 5, Cost: 0.125, CreatedAt: today.AddDate(0, 0, -1)},
+		// 集計期間外
+		{Model: "gpt-4o", InputTokens: 1, OutputTokens: 1, Cost: 100, CreatedAt: today.AddDate(0, 0, -10)},
+	}
+	for _, record := range records {
+		record.Account = account
+		repository.Save(ctx, record)
+	}
+
+	_, usage := postAiUsage(t, RequestAiUsage{MailAddress: testMailAddress, Password: testPassword, Days: 2})
+	want := []UsageSummary{
+		{Date: today.AddDate(0, 0, -1).Format("2006-01-02"), Model: "gpt-4o", Calls: 1, InputTokens: 50, OutputTokens: 5, Cost: 0.125},
+		{Date: today.Format("2006-01-02"), Model: "gemini-1.5-flash", Calls: 1, InputTokens: 200, OutputTokens: 20, Cost: 0.25},
+		{Date: today.Format("2006-01-02"), Model: "gpt-4o", Calls: 2, InputTokens: 400, OutputTokens: 40, Cost: 1.5},
+	}
+	if len(usage.Days) != len(want) {
+		t.Fatalf("unexpected days: %+v", usage.Days)
+	}
+	for i := range want {
+		if usage.Days[i] != want[i] {
+			t.Errorf("Days[%d] = %+v, want %+v", i, usage.Days[i], want[i])
+		}
+	}
+	if usage.Total.Calls != 4 || usage.Total.Cost != 1.875 {
+		t.Errorf("unexpected total: %+v", usage.Total)
+	}
+
+	// 認証できなければ他人の利用量は読めない
+	for _, request := range []RequestAiUsage{{SessionId: "unknown"}, {MailAddress: testMailAddress}} {
+		if response, _ := postAiUsage(t, request); response.Code != http.StatusUnauthorized {
+			t.Errorf("expected status Unauthorized for %+v; got %v", request, response.Code)
+		}
+	}
+}
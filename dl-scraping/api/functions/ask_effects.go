@@ -0,0 +1,158 @@
+package functions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+type RequestAskEffects struct {
+	// GETの場合はsessionIdだけを受け付ける パスワードをURLに載せないため
+	SessionId   string `json:"sessionId"`
+	MailAddress string `json:"mailAddress"`
+	Password    string `json:"password"`
+	Question    string `json:"question"`
+	// 指定しない場合は環境変数AI_MODEL
+	Model string `json:"model"`
+}
+
+// AskDeltaEvent はモデルが生成した文字列が届くたびに送るイベント
+type AskDeltaEvent struct {
+	Text string `json:"text"`
+}
+
+// AskDoneEvent は回答し終えたときに送るイベント
+type AskDoneEvent struct {
+	Message string        `json:"message"`
+	Usage   []UsageRecord `json:"usage"`
+}
+
+// AskErrorEvent は途中で失敗したときに送るイベント
+type AskErrorEvent struct {
+	Error string `json:"error"`
+}
+
+const askSystemInstructions = "You answer questions about the user's collection of phone theme effects. " +
+	"Use only the effects in the list (id, name and visual tags). Answer in the language of the question."
+
+// askPrompt は質問と保存済みの一覧からモデルに渡すプロンプトを作る
+func askPrompt(question string, effects []EffectInfo) string {
+	lines := make([]string, 0, len(effects))
+	for _, effect := range effects {
+		lines = append(lines, describeEffect(effect))
+	}
+	return fmt.Sprintf("Question: %s\n\nEffects:\n%s", question, strings.Join(lines, "\n"))
+}
+
+// AskEffects は保存済みの一覧についての質問に、モデルの回答をServer-Sent Eventsで少しずつ返す
+// 生成された文字列ごとに"delta"イベント、最後に"done"イベント、失敗した場合は"error"イベントを送る
+// EventSourceから使う場合はGETでsessionIdとquestionをクエリに付ける
+func AskEffects(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	var request RequestAskEffects
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	case http.MethodGet:
+		query := r.URL.Query()
+		request.SessionId = query.Get("sessionId")
+		request.Question = query.Get("question")
+		request.Model = query.Get("model")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.TrimSpace(request.Question) == "" {
+		http.Error(w, "Question is empty", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	godotenv.Load()
+
+	_, account, err := authenticate(r.Context(), request.SessionId, request.MailAddress, request.Password)
+	if err != nil {
+		log.Printf("Failed to acquire session: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	model, err := resolveModel(request.Model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repository, err := getCatalogRepository()
+	if err != nil {
+		log.Printf("Failed to open catalog repository: %v", err)
+		http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+		return
+	}
+	snapshot, err := repository.Latest(r.Context(), account)
+	if errors.Is(err, ErrCatalogNotFound) {
+		http.Error(w, "Catalog not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read catalog: %v", err)
+		http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+		return
+	}
+
+	client, err := NewLLMClient(r.Context(), model)
+	if err != nil {
+		log.Printf("Failed to create client: %v", err)
+		http.Error(w, "Failed to create client", http.StatusInternalServerError)
+		return
+	}
+	recorder := NewUsageRecorder(NewCachedClient(client, model, false), account, "ask-effects")
+	defer recorder.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	effects := withTags(r.Context(), snapshot.Effects, nil)
+	response, err := recorder.GenerateStream(r.Context(), GenerateRequest{
+		Prompt:             askPrompt(request.Question, effects),
+		SystemInstructions: askSystemInstructions,
+	}, func(delta string) error {
+		// ブラウザが切断した場合は書き込みに失敗するので、そこで生成をやめる
+		return writeSSE(w, flusher, "delta", AskDeltaEvent{Text: delta})
+	})
+	if err != nil {
+		log.Printf("Failed to generate answer: %v", err)
+		writeSSE(w, flusher, "error", AskErrorEvent{Error: err.Error()})
+		return
+	}
+
+	writeSSE(w, flusher, "done", AskDoneEvent{
+		Message: response.Message,
+		Usage:   recorder.Records(),
+	})
+}
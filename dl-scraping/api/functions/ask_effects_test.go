@@ -0,0 +1,162 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// streamChunks はChat Completionsのstreamの形でchunksを1つずつ返すハンドラを作る
+func streamChunks(chunks []string, received *map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if received != nil {
+			json.NewDecoder(r.Body).Decode(received)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			content, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: {\"choices\": [{\"delta\": {\"content\": %s}, \"finish_reason\": null}]}\n\n", content)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 10, \"completion_tokens\": 5}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+}
+
+func TestOpenAiClient_GenerateStream(t *testing.T) {
+	var received map[string]interface{}
+	client, _ := newTestOpenAiClient(t, streamChunks([]string{"秋", "らしい", "です"}, &received))
+
+	var deltas []string
+	response, err := client.GenerateStream(context.Background(), GenerateRequest{Prompt: "hello"}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("GenerateStream() error = %v", err)
+	}
+	if strings.Join(deltas, "|") != "秋|らしい|です" || response.Message != "秋らしいです" {
+		t.Errorf("unexpected deltas %q and message %q", deltas, response.Message)
+	}
+	if response.Usage != (TokenUsage{InputTokens: 10, OutputTokens: 5}) {
+		t.Errorf("unexpected usage: %+v", response.Usage)
+	}
+	if received["stream"] != true || received["stream_options"] == nil {
+		t.Errorf("expected stream to be requested; got %v", received)
+	}
+
+	// onDeltaが失敗したらそこでやめる
+	stop := errors.New("stop")
+	calls := 0
+	_, err = client.GenerateStream(context.Background(), GenerateRequest{Prompt: "hello"}, func(delta string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("expected to stop after the first delta; got %v after %d calls", err, calls)
+	}
+}
+
+func TestOpenAiClient_GenerateStreamErrors(t *testing.T) {
+	client, calls := newTestOpenAiClient(t, failTimes(1, http.StatusServiceUnavailable, nil, `{"error": {"message": "overloaded"}}`))
+	// 2回目はstreamでない応答が返るので、内容が空になる
+	_, err := client.GenerateStream(context.Background(), GenerateRequest{Prompt: "hello"}, func(string) error { return nil })
+	if !errors.Is(err, ErrEmptyResponse) || *calls != 2 {
+		t.Errorf("expected retry before streaming; got %v after %d calls", err, *calls)
+	}
+
+	client, _ = newTestOpenAiClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"refusal\": \"I can't\"}}]}\n\ndata: [DONE]\n\n")
+	})
+	if _, err := client.GenerateStream(context.Background(), GenerateRequest{Prompt: "hello"}, func(string) error { return nil }); !errors.Is(err, ErrRefused) {
+		t.Errorf("expected ErrRefused; got %v", err)
+	}
+}
+
+func TestAskEffects(t *testing.T) {
+	setupSearchCatalog(t)
+	repository := useMemoryUsage(t)
+	var received map[string]interface{}
+	server := httptest.NewServer(streamChunks([]string{"紅葉", "がおすすめです"}, &received))
+	t.Cleanup(server.Close)
+	t.Setenv("OPEN_AI_API_URL", server.URL)
+	t.Setenv("AI_MODEL", "gpt-4o-mini")
+
+	query := url.Values{"sessionId": {""}, "question": {"秋に使えるのは?"}}
+	req := httptest.NewRequest(http.MethodGet, "/ask-effects?"+query.Encode(), nil)
+	response := httptest.NewRecorder()
+	AskEffects(response, req)
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status Unauthorized without session; got %v", response.Code)
+	}
+
+	// メールアドレスだけではモデルを呼ばない
+	body := strings.NewReader(`{"mailAddress": "` + testMailAddress + `", "question": "秋に使えるのは?"}`)
+	req = httptest.NewRequest(http.MethodPost, "/ask-effects", body)
+	response = httptest.NewRecorder()
+	AskEffects(response, req)
+	if response.Code != http.StatusUnauthorized || received != nil {
+		t.Fatalf("expected status Unauthorized without password; got %v", response.Code)
+	}
+
+	body = strings.NewReader(`{"mailAddress": "` + testMailAddress + `", "password": "` + testPassword + `", "question": "秋に使えるのは?"}`)
+	req = httptest.NewRequest(http.MethodPost, "/ask-effects", body)
+	response = httptest.NewRecorder()
+	AskEffects(response, req)
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected event stream; got %v %s", response.Code, response.Body.String())
+	}
+
+	events := parseSSE(t, response.Body.String())
+	if len(events) != 3 || events[0].name != "delta" || events[1].name != "delta" || events[2].name != "done" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	var delta AskDeltaEvent
+	json.Unmarshal([]byte(events[0].data), &delta)
+	if delta.Text != "紅葉" {
+		t.Errorf("unexpected delta: %+v", delta)
+	}
+	var done AskDoneEvent
+	json.Unmarshal([]byte(events[2].data), &done)
+	if done.Message != "紅葉がおすすめです" || len(done.Usage) != 1 || done.Usage[0].Caller != "ask-effects" {
+		t.Errorf("unexpected done event: %+v", done)
+	}
+
+	// プロンプトに保存済みの一覧とタグが含まれる
+	prompt := fmt.Sprint(received["messages"])
+	if !strings.Contains(prompt, "秋に使えるのは?") || !strings.Contains(prompt, "season=autumn") {
+		t.Errorf("unexpected prompt: %s", prompt)
+	}
+
+	saved, _ := repository.List(context.Background(), accountKey(testMailAddress), done.Usage[0].CreatedAt)
+	if len(saved) != 1 {
+		t.Errorf("expected usage to be saved; got %d", len(saved))
+	}
+}
+
+func TestAskEffects_error(t *testing.T) {
+	setupSearchCatalog(t)
+	useMemoryUsage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"message": "too long", "code": "context_length_exceeded"}}`))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OPEN_AI_API_URL", server.URL)
+
+	body := strings.NewReader(`{"mailAddress": "` + testMailAddress + `", "password": "` + testPassword + `", "question": "どれ?", "model": "gpt-4o"}`)
+	req := httptest.NewRequest(http.MethodPost, "/ask-effects", body)
+	response := httptest.NewRecorder()
+	AskEffects(response, req)
+
+	events := parseSSE(t, response.Body.String())
+	if len(events) != 1 || events[0].name != "error" || !strings.Contains(events[0].data, "context_length_exceeded") {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
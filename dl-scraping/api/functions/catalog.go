@@ -0,0 +1,370 @@
+package functions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 保存済みのものを返す前に取得し直す時間の既定値
+const defaultCatalogRefreshTimeout = 10 * time.Second
+
+var ErrCatalogNotFound = errors.New("catalog not found")
+
+// CatalogSnapshot はあるアカウントの全エフェクトを取得した時点の記録
+type CatalogSnapshot struct {
+	Id        string       `json:"id"`
+	Account   string       `json:"account"`
+	Effects   []EffectInfo `json:"effects"`
+	ScrapedAt time.Time    `json:"scrapedAt"`
+	PageCount int          `json:"pageCount"`
+	// 前回のスナップショットとの差分 最初のスナップショットではnil
+	Diff *CatalogDiff `json:"diff,omitempty"`
+}
+
+// CatalogRepository はアカウントごとのスナップショットを保存する
+type CatalogRepository interface {
+	// Save はスナップショットを保存し、Idを設定する
+	Save(ctx context.Context, snapshot *CatalogSnapshot) error
+	// Latest はアカウントの最新のスナップショットを返す なければErrCatalogNotFound
+	Latest(ctx context.Context, account string) (*CatalogSnapshot, error)
+	// Get はIdを指定してスナップショットを返す なければErrCatalogNotFound
+	Get(ctx context.Context, account string, id string) (*CatalogSnapshot, error)
+}
+
+// accountKey はメールアドレスからアカウントのキーを作る メールアドレスをそのまま保存しないためハッシュ化する
+func accountKey(mailAddress string) string {
+	normalized := strings.ToLower(strings.TrimSpace(mailAddress))
+	if normalized == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate はリクエストの認証情報からセッションとアカウントのキーを返す
+// sessionIdは発行したものだけを受け付け、なければメールアドレスとパスワードでログインする
+// メールアドレスだけでは他人のデータを読めてしまうので、アカウントは必ず認証したセッションから取る
+func authenticate(ctx context.Context, sessionId string, mailAddress string, password string) (*Session, string, error) {
+	session, err := sessionManager.Acquire(ctx, sessionId, mailAddress, password)
+	if err != nil {
+		return nil, "", err
+	}
+	account := session.Account
+	if account == "" {
+		return nil, "", ErrSessionExpired
+	}
+	return session, account, nil
+}
+
+var (
+	catalogRepositoryOnce sync.Once
+	catalogRepository     CatalogRepository
+	catalogRepositoryErr  error
+)
+
+// catalogStore は環境変数CATALOG_STOREで選んだ保存先の種類を返す
+// firestoreかmemory 未指定の場合はサービスアカウントがあればfirestore
+func catalogStore() string {
+	store := os.Getenv("CATALOG_STORE")
+	if store == "" {
+		store = "memory"
+		if os.Getenv("SERVICE_ACCOUNT_KEY") != "" {
+			store = "firestore"
+		}
+	}
+	return store
+}
+
+// getCatalogRepository はcatalogStoreで選んだ保存先を返す クライアントはリクエストをまたいで使い回す
+func getCatalogRepository() (CatalogRepository, error) {
+	catalogRepositoryOnce.Do(func() {
+		switch store := catalogStore(); store {
+		case "firestore":
+			client, err := newFirestoreClient(context.Background())
+			if err != nil {
+				catalogRepositoryErr = err
+				return
+			}
+			catalogRepository = NewFirestoreCatalogRepository(client)
+		case "memory":
+			catalogRepository = NewMemoryCatalogRepository()
+		default:
+			catalogRepositoryErr = errors.New("unknown catalog store: " + store)
+		}
+	})
+	return catalogRepository, catalogRepositoryErr
+}
+
+// MemoryCatalogRepository はメモリ上に保存する 開発とテスト用
+type MemoryCatalogRepository struct {
+	mu        sync.Mutex
+	snapshots map[string][]*CatalogSnapshot
+	nextId    int
+}
+
+func NewMemoryCatalogRepository() *MemoryCatalogRepository {
+	return &MemoryCatalogRepository{snapshots: make(map[string][]*CatalogSnapshot)}
+}
+
+func (r *MemoryCatalogRepository) Save(ctx context.Context, snapshot *CatalogSnapshot) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextId++
+	saved := *snapshot
+	saved.Id = strconv.Itoa(r.nextId)
+	saved.Effects = append([]EffectInfo(nil), snapshot.Effects...)
+	r.snapshots[snapshot.Account] = append(r.snapshots[snapshot.Account], &saved)
+	snapshot.Id = saved.Id
+	return nil
+}
+
+func (r *MemoryCatalogRepository) Latest(ctx context.Context, account string) (*CatalogSnapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshots := r.snapshots[account]
+	if len(snapshots) == 0 {
+		return nil, ErrCatalogNotFound
+	}
+	latest := *snapshots[len(snapshots)-1]
+	latest.Effects = append([]EffectInfo(nil), latest.Effects...)
+	return &latest, nil
+}
+
+func (r *MemoryCatalogRepository) Get(ctx context.Context, account string, id string) (*CatalogSnapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, snapshot := range r.snapshots[account] {
+		if snapshot.Id == id {
+			found := *snapshot
+			found.Effects = append([]EffectInfo(nil), found.Effects...)
+			return &found, nil
+		}
+	}
+	return nil, ErrCatalogNotFound
+}
+
+// FirestoreCatalogRepository はcatalogs/{account}/snapshots に保存する
+// エフェクトは差分と同じくIdかHashIdをキーにしたマップで持ち、一覧の順番はpositionで復元する
+// Firestoreは空のキーを受け付けないので、どちらも取れなかったエフェクトは保存しない
+type FirestoreCatalogRepository struct {
+	client *firestore.Client
+}
+
+func NewFirestoreCatalogRepository(client *firestore.Client) *FirestoreCatalogRepository {
+	return &FirestoreCatalogRepository{client: client}
+}
+
+type catalogEffectDoc struct {
+	Name     string `firestore:"name"`
+	Id       string `firestore:"id"`
+	HashId   string `firestore:"hashId"`
+	Position int    `firestore:"position"`
+}
+
+type catalogSnapshotDoc struct {
+	Account   string                      `firestore:"account"`
+	ScrapedAt time.Time                   `firestore:"scrapedAt"`
+	PageCount int                         `firestore:"pageCount"`
+	Total     int                         `firestore:"total"`
+	Effects   map[string]catalogEffectDoc `firestore:"effects"`
+	Diff      *CatalogDiff                `firestore:"diff"`
+}
+
+// catalogEffectDocs はエフェクトをキーごとのマップにする
+func catalogEffectDocs(effects []EffectInfo) map[string]catalogEffectDoc {
+	docs := make(map[string]catalogEffectDoc, len(effects))
+	for i, effect := range effects {
+		key := effectKey(effect)
+		if key == "" {
+			log.Printf("Skipping effect without id: %q", effect.Name)
+			continue
+		}
+		docs[key] = catalogEffectDoc{
+			Name:     effect.Name,
+			Id:       effect.Id,
+			HashId:   effect.HashId,
+			Position: i,
+		}
+	}
+	return docs
+}
+
+func (r *FirestoreCatalogRepository) snapshots(account string) *firestore.CollectionRef {
+	return r.client.Collection("catalogs").Doc(account).Collection("snapshots")
+}
+
+func (r *FirestoreCatalogRepository) Save(ctx context.Context, snapshot *CatalogSnapshot) error {
+	doc := catalogSnapshotDoc{
+		Account:   snapshot.Account,
+		ScrapedAt: snapshot.ScrapedAt,
+		PageCount: snapshot.PageCount,
+		Effects:   catalogEffectDocs(snapshot.Effects),
+		Diff:      snapshot.Diff,
+	}
+	doc.Total = len(doc.Effects)
+
+	ref, _, err := r.snapshots(snapshot.Account).Add(ctx, doc)
+	if err != nil {
+		return err
+	}
+	snapshot.Id = ref.ID
+	return nil
+}
+
+func (r *FirestoreCatalogRepository) Latest(ctx context.Context, account string) (*CatalogSnapshot, error) {
+	iter := r.snapshots(account).OrderBy("scrapedAt", firestore.Desc).Limit(1).Documents(ctx)
+	defer iter.Stop()
+
+	docSnap, err := iter.Next()
+	if err == iterator.Done {
+		return nil, ErrCatalogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshotFromDoc(docSnap)
+}
+
+func (r *FirestoreCatalogRepository) Get(ctx context.Context, account string, id string) (*CatalogSnapshot, error) {
+	docSnap, err := r.snapshots(account).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrCatalogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshotFromDoc(docSnap)
+}
+
+func snapshotFromDoc(docSnap *firestore.DocumentSnapshot) (*CatalogSnapshot, error) {
+	var doc catalogSnapshotDoc
+	if err := docSnap.DataTo(&doc); err != nil {
+		return nil, err
+	}
+
+	effects := make([]catalogEffectDoc, 0, len(doc.Effects))
+	for _, effect := range doc.Effects {
+		effects = append(effects, effect)
+	}
+	sort.Slice(effects, func(i, j int) bool { return effects[i].Position < effects[j].Position })
+
+	snapshot := &CatalogSnapshot{
+		Id:        docSnap.Ref.ID,
+		Account:   doc.Account,
+		ScrapedAt: doc.ScrapedAt,
+		PageCount: doc.PageCount,
+		Effects:   make([]EffectInfo, 0, len(effects)),
+		Diff:      doc.Diff,
+	}
+	for _, effect := range effects {
+		snapshot.Effects = append(snapshot.Effects, EffectInfo{Name: effect.Name, Id: effect.Id, HashId: effect.HashId})
+	}
+	return snapshot, nil
+}
+
+// saveCatalog は全ページ取得の結果をスナップショットとして保存する アカウントが分からなければ何もしない
+func saveCatalog(ctx context.Context, account string, result *CrawlResult) (*CatalogSnapshot, error) {
+	if account == "" || result.Truncated {
+		return nil, nil
+	}
+
+	repository, err := getCatalogRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &CatalogSnapshot{
+		Account:   account,
+		Effects:   result.Effects,
+		ScrapedAt: time.Now(),
+		PageCount: len(result.Pages),
+	}
+
+	// 前回のスナップショットとの差分を一緒に保存する
+	previous, err := repository.Latest(ctx, account)
+	if err == nil {
+		snapshot.Diff = DiffCatalogs(previous.Effects, snapshot.Effects)
+		snapshot.Diff.BaseSnapshotId = previous.Id
+	} else if !errors.Is(err, ErrCatalogNotFound) {
+		return nil, err
+	}
+
+	if err := repository.Save(ctx, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// allPagesResponse は全ページ取得の結果からレスポンスを作る
+func allPagesResponse(session *Session, result *CrawlResult) Response {
+	return Response{
+		SessionId: session.SessionId(),
+		DlSecKey:  result.DlSecKey,
+		Effects:   result.Effects,
+		IsNext:    result.Truncated,
+		Total:     len(result.Effects),
+		Pages:     result.Pages,
+		Truncated: result.Truncated,
+	}
+}
+
+// cachedCatalogResponse は保存済みの最新のスナップショットがあれば、CATALOG_REFRESH_TIMEOUT_MSの間だけ取得し直す
+// 間に合えば取得し直したものを保存して返し、間に合わないか失敗した場合は保存済みのものを返す
+// Cloud Functionsはレスポンスを返した後の処理を止めるので、裏では取得し直さない
+// 保存済みのものがなければfalse
+func cachedCatalogResponse(ctx context.Context, account string, session *Session, request RequestInfo) (Response, bool) {
+	repository, err := getCatalogRepository()
+	if err != nil {
+		log.Printf("Failed to open catalog repository: %v", err)
+		return Response{}, false
+	}
+
+	snapshot, err := repository.Latest(ctx, account)
+	if err != nil {
+		if !errors.Is(err, ErrCatalogNotFound) {
+			log.Printf("Failed to read catalog: %v", err)
+		}
+		return Response{}, false
+	}
+
+	refreshCtx, cancel := context.WithTimeout(ctx, envDuration("CATALOG_REFRESH_TIMEOUT_MS", defaultCatalogRefreshTimeout))
+	defer cancel()
+	result, err := crawlAllPages(refreshCtx, session, crawlOptions(request))
+	if err == nil && !result.Truncated {
+		if _, err := saveCatalog(ctx, account, result); err != nil {
+			log.Printf("Failed to save catalog: %v", err)
+		}
+		return allPagesResponse(session, result), true
+	}
+	if err != nil {
+		log.Printf("Failed to refresh catalog, returning the saved one: %v", err)
+	}
+
+	// 保存済みのものを返すだけなのでdlSecKeyは持たない
+	response := Response{
+		SessionId: session.SessionId(),
+		Effects:   snapshot.Effects,
+		Total:     len(snapshot.Effects),
+		Cached:    true,
+		ScrapedAt: &snapshot.ScrapedAt,
+	}
+	return response, true
+}
@@ -0,0 +1,146 @@
+package functions
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+// useMemoryCatalog はテストの間だけメモリ上の保存先を使う
+func useMemoryCatalog(t *testing.T) *MemoryCatalogRepository {
+	t.Helper()
+	repository := NewMemoryCatalogRepository()
+
+	getCatalogRepository()
+	previous, previousErr := catalogRepository, catalogRepositoryErr
+	catalogRepository, catalogRepositoryErr = repository, nil
+	t.Cleanup(func() {
+		catalogRepository, catalogRepositoryErr = previous, previousErr
+	})
+	return repository
+}
+
+func TestGetEffectList_cached(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	repository := useMemoryCatalog(t)
+	ctx := context.Background()
+	account := accountKey(testMailAddress)
+
+	// 保存済みのものがなければその場で全件取得して保存する
+	response, res := postGetEffectList(t, RequestInfo{Cached: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Cached || res.Total != 3 {
+		t.Errorf("expected a fresh catalog of 3; got cached=%v total=%d", res.Cached, res.Total)
+	}
+	snapshot, err := repository.Latest(ctx, account)
+	if err != nil {
+		t.Fatalf("expected snapshot to be saved: %v", err)
+	}
+	if len(snapshot.Effects) != 3 || snapshot.PageCount != 2 {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+
+	// 2回目は時間内に取得し直せればそれを保存して返す
+	upstream.SetEffects(append(append([]fakeupstream.Effect{}, testEffects...), fakeupstream.Effect{Id: "4", Name: "雪", HashId: "hash4"}))
+	response, res = postGetEffectList(t, RequestInfo{Cached: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Cached || res.Total != 4 {
+		t.Errorf("expected a refreshed catalog of 4; got cached=%v total=%d", res.Cached, res.Total)
+	}
+	snapshot, err = repository.Latest(ctx, account)
+	if err != nil {
+		t.Fatalf("Latest() error = %v", err)
+	}
+	if len(snapshot.Effects) != 4 {
+		t.Errorf("expected refreshed snapshot with 4 effects; got %d", len(snapshot.Effects))
+	}
+
+	// 間に合わなければ保存済みのものを返し、保存済みのものは変えない
+	t.Setenv("EFFECT_LIST_DELAY_MS", "500")
+	t.Setenv("CATALOG_REFRESH_TIMEOUT_MS", "50")
+	upstream.SetEffects(testEffects)
+	response, res = postGetEffectList(t, RequestInfo{Cached: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if !res.Cached || res.ScrapedAt == nil || len(res.Effects) != 4 {
+		t.Errorf("expected cached catalog of 4; got %+v", res)
+	}
+	if latest, _ := repository.Latest(ctx, account); latest.Id != snapshot.Id {
+		t.Errorf("expected the saved snapshot to be kept; got %s", latest.Id)
+	}
+}
+
+func TestGetEffectList_cachedRequiresLogin(t *testing.T) {
+	setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	useMemoryCatalog(t)
+
+	response, _ := postGetEffectList(t, RequestInfo{Cached: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+
+	// 保存済みのものがあってもメールアドレスだけでは読めない
+	for name, request := range map[string]RequestInfo{
+		"mail address only": {Cached: true, MailAddress: testMailAddress},
+		"wrong password":    {Cached: true, MailAddress: testMailAddress, Password: "wrong"},
+		"unknown session":   {Cached: true, SessionId: "unknown", MailAddress: testMailAddress},
+	} {
+		if response, _ := postGetEffectList(t, request); response.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status Unauthorized; got %v", name, response.Code)
+		}
+	}
+}
+
+func TestMemoryCatalogRepository(t *testing.T) {
+	repository := NewMemoryCatalogRepository()
+	ctx := context.Background()
+
+	if _, err := repository.Latest(ctx, "nobody"); err != ErrCatalogNotFound {
+		t.Errorf("Latest() error = %v, want ErrCatalogNotFound", err)
+	}
+
+	effects := []EffectInfo{{Name: "朝顔", Id: "1", HashId: "hash1"}}
+	snapshot := &CatalogSnapshot{Account: "account", Effects: effects, PageCount: 1}
+	if err := repository.Save(ctx, snapshot); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if snapshot.Id == "" {
+		t.Errorf("expected Save to set Id")
+	}
+
+	// 保存後に元のスライスを変えても保存済みのものは変わらない
+	effects[0].Name = "changed"
+	latest, err := repository.Latest(ctx, "account")
+	if err != nil {
+		t.Fatalf("Latest() error = %v", err)
+	}
+	if latest.Effects[0].Name != "朝顔" {
+		t.Errorf("snapshot was modified through the caller's slice")
+	}
+}
+
+func Test_catalogEffectDocs(t *testing.T) {
+	docs := catalogEffectDocs([]EffectInfo{
+		{Name: "朝顔", Id: "1", HashId: "hash1"},
+		{Name: "向日葵", Id: "2"},
+		{Name: "桜", HashId: "hash3"},
+		{Name: "不明1"},
+		{Name: "不明2"},
+	})
+	// Firestoreは空のキーを受け付けないので、IdもHashIdもないものは含めない
+	if len(docs) != 3 || docs[""].Name != "" {
+		t.Fatalf("unexpected docs: %+v", docs)
+	}
+	if docs["1"].Name != "朝顔" || docs["2"].Position != 1 || docs["hash:hash3"].Name != "桜" {
+		t.Errorf("unexpected docs: %+v", docs)
+	}
+}
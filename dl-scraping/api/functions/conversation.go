@@ -0,0 +1,508 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joho/godotenv"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// モデルに送る会話の履歴の発言数の既定値 古いものから省く
+	defaultChatHistoryTurns = 20
+	// 会話に保存しておく発言数の既定値 超えた分は古いものから捨てる
+	defaultChatMaxMessages = 100
+	// 1回の発言に添付できる画像の数と、1枚の大きさの上限の既定値
+	// 添付した画像は保存先と会話に残るので、1回のリクエストで際限なく保存されないようにする
+	defaultChatMaxImages     = 4
+	defaultChatMaxImageBytes = 5 << 20
+)
+
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// ConversationMessage は会話の中の1回分の発言
+type ConversationMessage struct {
+	// RoleUserかRoleAssistant
+	Role string `json:"role" firestore:"role"`
+	Text string `json:"text" firestore:"text"`
+	// 添付した画像の画像の保存先での名前 ドキュメントの上限(1MiB)を超えないように画像そのものは持たない
+	Images    []string  `json:"images,omitempty" firestore:"imageNames"`
+	CreatedAt time.Time `json:"createdAt" firestore:"createdAt"`
+}
+
+// Conversation はアカウントごとのモデルとの会話 発言は古い順
+type Conversation struct {
+	Id        string                `json:"id" firestore:"-"`
+	Account   string                `json:"-" firestore:"account"`
+	Model     string                `json:"model" firestore:"model"`
+	Messages  []ConversationMessage `json:"messages" firestore:"messages"`
+	CreatedAt time.Time             `json:"createdAt" firestore:"createdAt"`
+	UpdatedAt time.Time             `json:"updatedAt" firestore:"updatedAt"`
+}
+
+// history はモデルに送る履歴を返す 多い場合は新しいturns件に絞る
+// 絞った結果がアシスタントの発言から始まる場合は、それも省いてユーザーの発言から始める
+// 画像はstoreから読む 消えていたものは飛ばす
+func (c *Conversation) history(ctx context.Context, store ImageStore, turns int) ([]Message, error) {
+	messages := c.Messages
+	if turns > 0 && len(messages) > turns {
+		messages = messages[len(messages)-turns:]
+	}
+	for len(messages) > 0 && messages[0].Role != RoleUser {
+		messages = messages[1:]
+	}
+	history := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		var images []ImagePart
+		for _, name := range message.Images {
+			image, err := loadImagePart(ctx, store, name)
+			if errors.Is(err, ErrImageNotFound) {
+				log.Printf("Conversation image %s is missing", name)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, image)
+		}
+		history = append(history, Message{Role: message.Role, Text: message.Text, Images: images})
+	}
+	return history, nil
+}
+
+// append は発言を追加し、maxMessages件を超えた分を古いものから捨てる
+func (c *Conversation) append(model string, messages []ConversationMessage, maxMessages int, now time.Time) {
+	c.Model = model
+	c.Messages = append(append([]ConversationMessage(nil), c.Messages...), messages...)
+	if maxMessages > 0 && len(c.Messages) > maxMessages {
+		c.Messages = c.Messages[len(c.Messages)-maxMessages:]
+	}
+	c.UpdatedAt = now
+}
+
+// loadImagePart は保存先の画像をモデルに送る形で読む
+func loadImagePart(ctx context.Context, store ImageStore, name string) (ImagePart, error) {
+	reader, info, err := store.Get(ctx, name)
+	if err != nil {
+		return ImagePart{}, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return ImagePart{}, err
+	}
+	return ImagePart{MimeType: info.ContentType, Data: data}, nil
+}
+
+// chatImageName は会話に添付された画像の保存先での名前 同じ画像は同じ名前になる
+func chatImageName(account string, image ImagePart) string {
+	sum := sha256.Sum256(image.Data)
+	ext := ""
+	switch image.MimeType {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/png":
+		ext = ".png"
+	case "image/gif":
+		ext = ".gif"
+	case "image/webp":
+		ext = ".webp"
+	}
+	return fmt.Sprintf("chat/%s/%s%s", account, hex.EncodeToString(sum[:16]), ext)
+}
+
+// ConversationRepository はアカウントごとの会話を保存する
+type ConversationRepository interface {
+	// Get は会話を返す なければErrConversationNotFound
+	Get(ctx context.Context, account string, id string) (*Conversation, error)
+	// Append は会話に発言を追加して保存し、保存したものを返す idが空の場合は新しい会話を作る
+	// 同じ会話に同時に追加しても発言が消えないように、読み込みから保存までをまとめて行う
+	// 発言がmaxMessages件を超えた場合は古いものから捨てる
+	Append(ctx context.Context, account string, id string, model string, messages []ConversationMessage, maxMessages int) (*Conversation, error)
+}
+
+var (
+	conversationRepositoryOnce sync.Once
+	conversationRepository     ConversationRepository
+	conversationRepositoryErr  error
+)
+
+// getConversationRepository はcatalogStoreで選んだ保存先を返す
+func getConversationRepository() (ConversationRepository, error) {
+	conversationRepositoryOnce.Do(func() {
+		switch store := catalogStore(); store {
+		case "firestore":
+			client, err := newFirestoreClient(context.Background())
+			if err != nil {
+				conversationRepositoryErr = err
+				return
+			}
+			conversationRepository = NewFirestoreConversationRepository(client)
+		case "memory":
+			conversationRepository = NewMemoryConversationRepository()
+		default:
+			conversationRepositoryErr = errors.New("unknown conversation store: " + store)
+		}
+	})
+	return conversationRepository, conversationRepositoryErr
+}
+
+// MemoryConversationRepository はメモリ上に保存する 開発とテスト用
+type MemoryConversationRepository struct {
+	mu            sync.Mutex
+	conversations map[string]map[string]Conversation
+	nextId        int
+}
+
+func NewMemoryConversationRepository() *MemoryConversationRepository {
+	return &MemoryConversationRepository{conversations: make(map[string]map[string]Conversation)}
+}
+
+func (r *MemoryConversationRepository) Get(ctx context.Context, account string, id string) (*Conversation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conversation, ok := r.conversations[account][id]
+	if !ok {
+		return nil, ErrConversationNotFound
+	}
+	conversation.Messages = append([]ConversationMessage(nil), conversation.Messages...)
+	return &conversation, nil
+}
+
+func (r *MemoryConversationRepository) Append(ctx context.Context, account string, id string, model string, messages []ConversationMessage, maxMessages int) (*Conversation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	conversation := Conversation{Account: account, CreatedAt: now}
+	if id != "" {
+		saved, ok := r.conversations[account][id]
+		if !ok {
+			return nil, ErrConversationNotFound
+		}
+		conversation = saved
+	} else {
+		r.nextId++
+		conversation.Id = strconv.Itoa(r.nextId)
+	}
+	conversation.append(model, messages, maxMessages, now)
+
+	if r.conversations[account] == nil {
+		r.conversations[account] = make(map[string]Conversation)
+	}
+	r.conversations[account][conversation.Id] = conversation
+	conversation.Messages = append([]ConversationMessage(nil), conversation.Messages...)
+	return &conversation, nil
+}
+
+// FirestoreConversationRepository はconversations/{account}/items に保存する
+// 発言は1つのドキュメントに持つ 画像は名前だけを持ち、発言数も上限で切るのでドキュメントの上限(1MiB)に収まる
+type FirestoreConversationRepository struct {
+	client *firestore.Client
+}
+
+func NewFirestoreConversationRepository(client *firestore.Client) *FirestoreConversationRepository {
+	return &FirestoreConversationRepository{client: client}
+}
+
+func (r *FirestoreConversationRepository) items(account string) *firestore.CollectionRef {
+	return r.client.Collection("conversations").Doc(account).Collection("items")
+}
+
+func (r *FirestoreConversationRepository) Get(ctx context.Context, account string, id string) (*Conversation, error) {
+	docSnap, err := r.items(account).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var conversation Conversation
+	if err := docSnap.DataTo(&conversation); err != nil {
+		return nil, err
+	}
+	conversation.Id = docSnap.Ref.ID
+	return &conversation, nil
+}
+
+func (r *FirestoreConversationRepository) Append(ctx context.Context, account string, id string, model string, messages []ConversationMessage, maxMessages int) (*Conversation, error) {
+	ref := r.items(account).NewDoc()
+	if id != "" {
+		ref = r.items(account).Doc(id)
+	}
+
+	var conversation Conversation
+	err := r.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now()
+		conversation = Conversation{Account: account, CreatedAt: now}
+		if id != "" {
+			docSnap, err := tx.Get(ref)
+			if status.Code(err) == codes.NotFound {
+				return ErrConversationNotFound
+			}
+			if err != nil {
+				return err
+			}
+			if err := docSnap.DataTo(&conversation); err != nil {
+				return err
+			}
+		}
+		conversation.append(model, messages, maxMessages, now)
+		return tx.Set(ref, &conversation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	conversation.Id = ref.ID
+	return &conversation, nil
+}
+
+type RequestChat struct {
+	SessionId   string `json:"sessionId"`
+	MailAddress string `json:"mailAddress"`
+	Password    string `json:"password"`
+	// 続ける会話のId 空の場合は新しい会話を始める
+	ConversationId string `json:"conversationId"`
+	Message        string `json:"message"`
+	// 添付する画像のdata URL
+	Images []string `json:"images"`
+	// サムネイルを添付するエフェクトのId
+	EffectIds []string `json:"effectIds"`
+	// 指定しない場合は会話で使っていたモデル、新しい会話では環境変数AI_MODEL
+	Model string `json:"model"`
+}
+
+type ResponseChat struct {
+	Succeed        bool                  `json:"succeed"`
+	ConversationId string                `json:"conversationId"`
+	Reply          string                `json:"reply"`
+	Messages       []ConversationMessage `json:"messages"`
+	Usage          []UsageRecord         `json:"usage"`
+}
+
+const chatSystemInstructions = "You are a helpful assistant for the user's collection of phone theme effects. " +
+	"Answer follow-up questions using the conversation so far. Answer in the language of the user."
+
+// chatSystemPrompt は保存済みの一覧があればシステムの指示に加える
+func chatSystemPrompt(effects []EffectInfo) string {
+	if len(effects) == 0 {
+		return chatSystemInstructions
+	}
+	lines := make([]string, 0, len(effects))
+	for _, effect := range effects {
+		lines = append(lines, describeEffect(effect))
+	}
+	return fmt.Sprintf("%s\n\nEffects (id, name and visual tags):\n%s", chatSystemInstructions, strings.Join(lines, "\n"))
+}
+
+// Chat は会話を続けてモデルの回答を返す 会話は発言ごとに保存し、次のリクエストで続きから話せる
+func Chat(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	godotenv.Load()
+
+	// 画像はdata URLで届くので、上限の枚数と大きさから本文の大きさも制限する
+	maxImages := envInt("AI_CHAT_MAX_IMAGES", defaultChatMaxImages)
+	maxImageBytes := envInt("AI_CHAT_MAX_IMAGE_BYTES", defaultChatMaxImageBytes)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxImages)*int64(maxImageBytes)*4/3+1<<20)
+
+	var request RequestChat
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Message) == "" {
+		http.Error(w, "Message is empty", http.StatusBadRequest)
+		return
+	}
+	if len(request.Images)+len(request.EffectIds) > maxImages {
+		http.Error(w, fmt.Sprintf("Too many images (max %d)", maxImages), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	_, account, err := authenticate(r.Context(), request.SessionId, request.MailAddress, request.Password)
+	if err != nil {
+		log.Printf("Failed to acquire session: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	repository, err := getConversationRepository()
+	if err != nil {
+		log.Printf("Failed to open conversation repository: %v", err)
+		http.Error(w, "Failed to read conversation", http.StatusInternalServerError)
+		return
+	}
+	conversation := &Conversation{Account: account}
+	if request.ConversationId != "" {
+		conversation, err = repository.Get(r.Context(), account, request.ConversationId)
+		if errors.Is(err, ErrConversationNotFound) {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read conversation: %v", err)
+			http.Error(w, "Failed to read conversation", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 途中でモデルを変えた場合は、それ以降の発言に使う
+	modelName := request.Model
+	if modelName == "" {
+		modelName = conversation.Model
+	}
+	model, err := resolveModel(modelName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store, err := getImageStore()
+	if err != nil {
+		log.Printf("Failed to open image store: %v", err)
+		http.Error(w, "Failed to open image store", http.StatusInternalServerError)
+		return
+	}
+
+	// 会話には画像の名前だけを保存するので、モデルに送る前に保存先に置いておく
+	// 1枚でも大きすぎる場合は何も保存しない
+	var images []ImagePart
+	var imageNames []string
+	for _, dataUrl := range request.Images {
+		image, err := ParseDataUrl(dataUrl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(image.Data) > maxImageBytes {
+			http.Error(w, fmt.Sprintf("Image is too large (max %d bytes)", maxImageBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		images = append(images, image)
+	}
+	for _, image := range images {
+		name := chatImageName(account, image)
+		if _, err := store.Put(r.Context(), name, image.MimeType, bytes.NewReader(image.Data)); err != nil {
+			log.Printf("Failed to save chat image: %v", err)
+			http.Error(w, "Failed to save image", http.StatusInternalServerError)
+			return
+		}
+		imageNames = append(imageNames, name)
+	}
+	for _, effectId := range request.EffectIds {
+		image, err := fetchEffectImage(r.Context(), effectId)
+		if err != nil {
+			log.Printf("Failed to fetch effect image: %v", err)
+			http.Error(w, "Failed to fetch effect image", http.StatusBadGateway)
+			return
+		}
+		images = append(images, image)
+		imageNames = append(imageNames, effectImageName(effectId))
+	}
+
+	history, err := conversation.history(r.Context(), store, envInt("AI_CHAT_HISTORY_TURNS", defaultChatHistoryTurns))
+	if err != nil {
+		log.Printf("Failed to read conversation images: %v", err)
+		http.Error(w, "Failed to read conversation", http.StatusInternalServerError)
+		return
+	}
+
+	// 保存済みの一覧があれば、それについての質問に答えられるようにする
+	var effects []EffectInfo
+	catalogRepository, err := getCatalogRepository()
+	if err != nil {
+		log.Printf("Failed to open catalog repository: %v", err)
+		http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+		return
+	}
+	snapshot, err := catalogRepository.Latest(r.Context(), account)
+	if err == nil {
+		effects = withTags(r.Context(), snapshot.Effects, nil)
+	} else if !errors.Is(err, ErrCatalogNotFound) {
+		log.Printf("Failed to read catalog: %v", err)
+		http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+		return
+	}
+
+	client, err := NewLLMClient(r.Context(), model)
+	if err != nil {
+		log.Printf("Failed to create AI client: %v", err)
+		http.Error(w, "Failed to create AI client", http.StatusInternalServerError)
+		return
+	}
+	recorder := NewUsageRecorder(NewCachedClient(client, model, false), account, "chat")
+	defer recorder.Close()
+
+	response, err := recorder.Generate(r.Context(), GenerateRequest{
+		History:            history,
+		Prompt:             request.Message,
+		Images:             images,
+		SystemInstructions: chatSystemPrompt(effects),
+	})
+	if errors.Is(err, ErrUnsupportedCapability) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to generate reply: %v", err)
+		http.Error(w, "Failed to generate reply", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	conversation, err = repository.Append(r.Context(), account, request.ConversationId, model.Name, []ConversationMessage{
+		{Role: RoleUser, Text: request.Message, Images: imageNames, CreatedAt: now},
+		{Role: RoleAssistant, Text: response.Message, CreatedAt: now},
+	}, envInt("AI_CHAT_MAX_MESSAGES", defaultChatMaxMessages))
+	if err != nil {
+		log.Printf("Failed to save conversation: %v", err)
+		http.Error(w, "Failed to save conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ResponseChat{
+		Succeed:        true,
+		ConversationId: conversation.Id,
+		Reply:          response.Message,
+		Messages:       conversation.Messages,
+		Usage:          recorder.Records(),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,283 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useMemoryConversations はテストの間だけメモリ上の会話の保存先を使う
+func useMemoryConversations(t *testing.T) *MemoryConversationRepository {
+	t.Helper()
+	repository := NewMemoryConversationRepository()
+
+	getConversationRepository()
+	previous, previousErr := conversationRepository, conversationRepositoryErr
+	conversationRepository, conversationRepositoryErr = repository, nil
+	t.Cleanup(func() {
+		conversationRepository, conversationRepositoryErr = previous, previousErr
+	})
+	return repository
+}
+
+func postChat(t *testing.T, request RequestChat) (*httptest.ResponseRecorder, ResponseChat) {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/chat", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	Chat(response, req)
+
+	var res ResponseChat
+	if response.Code == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return response, res
+}
+
+func TestOpenAiClient_history(t *testing.T) {
+	var received map[string]interface{}
+	client, _ := newTestOpenAiClient(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(okOpenAiBody))
+	})
+
+	_, err := client.Generate(context.Background(), GenerateRequest{
+		History: []Message{
+			{Role: RoleUser, Text: "これは何?", Images: []ImagePart{{MimeType: "image/png", Data: []byte("png")}}},
+			{Role: RoleAssistant, Text: "桜のエフェクトです"},
+		},
+		Prompt:             "季節は?",
+		SystemInstructions: "日本語で答える",
+	})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	messages := received["messages"].([]interface{})
+	var roles []string
+	for _, message := range messages {
+		roles = append(roles, message.(map[string]interface{})["role"].(string))
+	}
+	if strings.Join(roles, ",") != "system,user,assistant,user" {
+		t.Fatalf("unexpected roles: %v", roles)
+	}
+	if content := messages[2].(map[string]interface{})["content"]; content != "桜のエフェクトです" {
+		t.Errorf("unexpected assistant content: %v", content)
+	}
+	// 履歴の画像も送る
+	if urls := requestImageUrls(received); len(urls) != 1 || !strings.HasPrefix(urls[0], "data:image/png;base64,") {
+		t.Errorf("unexpected image urls: %v", urls)
+	}
+}
+
+func TestConversation_history(t *testing.T) {
+	conversation := &Conversation{}
+	for _, text := range []string{"q1", "a1", "q2", "a2", "q3", "a3"} {
+		role := RoleUser
+		if strings.HasPrefix(text, "a") {
+			role = RoleAssistant
+		}
+		conversation.Messages = append(conversation.Messages, ConversationMessage{Role: role, Text: text})
+	}
+
+	tests := []struct {
+		turns int
+		want  string
+	}{
+		{0, "q1,a1,q2,a2,q3,a3"},
+		{4, "q2,a2,q3,a3"},
+		// アシスタントの発言から始まらないようにする
+		{3, "q3,a3"},
+	}
+	for _, tt := range tests {
+		var texts []string
+		history, _ := conversation.history(context.Background(), NewMemoryImageStore(), tt.turns)
+		for _, message := range history {
+			texts = append(texts, message.Text)
+		}
+		if got := strings.Join(texts, ","); got != tt.want {
+			t.Errorf("history(%d) = %s, want %s", tt.turns, got, tt.want)
+		}
+	}
+}
+
+func TestChat(t *testing.T) {
+	var requests []map[string]interface{}
+	setupFakeOpenAi(t, func(request map[string]interface{}) string {
+		requests = append(requests, request)
+		if len(requests) == 1 {
+			return "桜のエフェクトがあります"
+		}
+		return "春です"
+	})
+	setupFakeUpstream(t)
+	useMemoryCatalog(t)
+	useMemoryUsage(t)
+	repository := useMemoryConversations(t)
+
+	_, first := postChat(t, RequestChat{MailAddress: testMailAddress, Password: testPassword, Message: "花のエフェクトはある?"})
+	if !first.Succeed || first.ConversationId == "" || first.Reply != "桜のエフェクトがあります" {
+		t.Fatalf("unexpected first response: %+v", first)
+	}
+
+	response, second := postChat(t, RequestChat{
+		MailAddress:    testMailAddress,
+		Password:       testPassword,
+		ConversationId: first.ConversationId,
+		Message:        "季節は?",
+		Images:         []string{(ImagePart{MimeType: "image/jpeg", Data: []byte("jpeg")}).DataUrl()},
+	})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if second.ConversationId != first.ConversationId || second.Reply != "春です" || len(second.Messages) != 4 {
+		t.Fatalf("unexpected second response: %+v", second)
+	}
+	if len(second.Usage) != 1 || second.Usage[0].Caller != "chat" {
+		t.Errorf("unexpected usage: %+v", second.Usage)
+	}
+
+	// 2回目は1回目のやり取りを含めて送る
+	messages := requests[1]["messages"].([]interface{})
+	if len(messages) != 4 || messages[2].(map[string]interface{})["content"] != "桜のエフェクトがあります" {
+		t.Errorf("expected the first exchange in the history; got %v", messages)
+	}
+
+	saved, err := repository.Get(context.Background(), accountKey(testMailAddress), first.ConversationId)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(saved.Messages) != 4 || len(saved.Messages[2].Images) != 1 || saved.Model != "gpt-4o-mini-2024-07-18" {
+		t.Fatalf("unexpected saved conversation: %+v", saved)
+	}
+	// 画像は会話に持たず、画像の保存先に置いた名前で参照する
+	store, _ := getImageStore()
+	if image, err := loadImagePart(context.Background(), store, saved.Messages[2].Images[0]); err != nil || string(image.Data) != "jpeg" || image.MimeType != "image/jpeg" {
+		t.Errorf("expected the chat image in the image store; got %+v %v", image, err)
+	}
+
+	// 他のアカウントの会話は見えない
+	other, _ := repository.Append(context.Background(), accountKey("other@example.com"), "", "gpt-4o-mini", nil, 0)
+	response, _ = postChat(t, RequestChat{MailAddress: testMailAddress, Password: testPassword, ConversationId: other.Id, Message: "続き"})
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected status NotFound; got %v", response.Code)
+	}
+	// メールアドレスだけでは会話を読めない
+	response, _ = postChat(t, RequestChat{MailAddress: testMailAddress, ConversationId: first.ConversationId, Message: "続き"})
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized; got %v", response.Code)
+	}
+}
+
+func TestChat_imageLimits(t *testing.T) {
+	setupFakeOpenAi(t, func(request map[string]interface{}) string { return "はい" })
+	setupFakeUpstream(t)
+	useMemoryCatalog(t)
+	useMemoryUsage(t)
+	repository := useMemoryConversations(t)
+	store := useMemoryImages(t)
+	t.Setenv("AI_CHAT_MAX_IMAGES", "2")
+	t.Setenv("AI_CHAT_MAX_IMAGE_BYTES", "8")
+
+	image := func(size int) string {
+		return (ImagePart{MimeType: "image/png", Data: bytes.Repeat([]byte("a"), size)}).DataUrl()
+	}
+	for name, request := range map[string]RequestChat{
+		"too many images": {Images: []string{image(1), image(1)}, EffectIds: []string{"1"}},
+		"too large image": {Images: []string{image(1), image(9)}},
+		"too large body":  {Images: []string{image(4 << 20)}},
+	} {
+		request.MailAddress, request.Password, request.Message = testMailAddress, testPassword, "これは?"
+		if response, _ := postChat(t, request); response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected status RequestEntityTooLarge; got %v", name, response.Code)
+		}
+	}
+	// 断った発言の画像は保存しない
+	if images, _ := store.List(context.Background(), "chat/"); len(images) != 0 {
+		t.Errorf("expected no stored images; got %+v", images)
+	}
+
+	response, res := postChat(t, RequestChat{MailAddress: testMailAddress, Password: testPassword, Message: "これは?", Images: []string{image(8)}, EffectIds: []string{"1"}})
+	if response.Code != http.StatusOK || !res.Succeed {
+		t.Fatalf("expected status OK within the limits; got %v", response.Code)
+	}
+	if saved, _ := repository.Get(context.Background(), accountKey(testMailAddress), res.ConversationId); len(saved.Messages[0].Images) != 2 {
+		t.Errorf("unexpected saved images: %+v", saved.Messages[0])
+	}
+}
+
+func TestConversation_historyImages(t *testing.T) {
+	store := NewMemoryImageStore()
+	store.Put(context.Background(), "chat/a/1.png", "image/png", strings.NewReader("png"))
+	conversation := &Conversation{Messages: []ConversationMessage{
+		// 消えた画像は飛ばす
+		{Role: RoleUser, Text: "q1", Images: []string{"chat/a/1.png", "chat/a/missing.png"}},
+		{Role: RoleAssistant, Text: "a1"},
+	}}
+
+	history, err := conversation.history(context.Background(), store, 0)
+	if err != nil {
+		t.Fatalf("history() error = %v", err)
+	}
+	if len(history) != 2 || len(history[0].Images) != 1 || string(history[0].Images[0].Data) != "png" || history[0].Images[0].MimeType != "image/png" {
+		t.Errorf("unexpected history: %+v", history)
+	}
+}
+
+func TestMemoryConversationRepository_append(t *testing.T) {
+	repository := NewMemoryConversationRepository()
+	ctx := context.Background()
+
+	conversation, err := repository.Append(ctx, "account", "", "gpt-4o", []ConversationMessage{{Role: RoleUser, Text: "q1"}, {Role: RoleAssistant, Text: "a1"}}, 3)
+	if err != nil || conversation.Id == "" || conversation.CreatedAt.IsZero() {
+		t.Fatalf("unexpected conversation: %+v %v", conversation, err)
+	}
+	// 上限を超えた発言は古いものから捨てる
+	conversation, _ = repository.Append(ctx, "account", conversation.Id, "gpt-4o", []ConversationMessage{{Role: RoleUser, Text: "q2"}, {Role: RoleAssistant, Text: "a2"}}, 3)
+	var texts []string
+	for _, message := range conversation.Messages {
+		texts = append(texts, message.Text)
+	}
+	if strings.Join(texts, ",") != "a1,q2,a2" {
+		t.Errorf("unexpected messages: %v", texts)
+	}
+
+	if _, err := repository.Append(ctx, "other", conversation.Id, "gpt-4o", nil, 3); err != ErrConversationNotFound {
+		t.Errorf("expected ErrConversationNotFound for another account; got %v", err)
+	}
+}
+
+func TestChat_stub(t *testing.T) {
+	setupFakeUpstream(t)
+	setupStubProvider(t, "")
+	useMemoryResponseCache(t)
+	useMemoryCatalog(t)
+	useMemoryUsage(t)
+	useMemoryConversations(t)
+
+	_, first := postChat(t, RequestChat{MailAddress: testMailAddress, Password: testPassword, Message: "こんにちは"})
+	_, second := postChat(t, RequestChat{MailAddress: testMailAddress, Password: testPassword, ConversationId: first.ConversationId, Message: "こんにちは"})
+	// 同じ発言でも履歴が違うので応答が変わる
+	if first.Reply == "" || second.Reply == first.Reply || second.Usage[0].Cached {
+		t.Errorf("expected a reply depending on the history; got %q and %q", first.Reply, second.Reply)
+	}
+
+	for _, request := range []RequestChat{
+		{MailAddress: testMailAddress, Password: testPassword, Message: " "},
+		{MailAddress: testMailAddress, Password: testPassword, Message: "hi", Model: "gpt-3"},
+		{MailAddress: testMailAddress, Password: testPassword, Message: "hi", Images: []string{"not a data url"}},
+	} {
+		if response, _ := postChat(t, request); response.Code != http.StatusBadRequest {
+			t.Errorf("expected status BadRequest for %+v; got %v", request, response.Code)
+		}
+	}
+	if response, _ := postChat(t, RequestChat{Message: "hi"}); response.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized without account; got %v", response.Code)
+	}
+}
@@ -0,0 +1,314 @@
+package functions
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"asa-o.net/dl-scraping/functions/parser"
+)
+
+const (
+	// 全ページ取得時のページ数の上限の既定値
+	defaultMaxPages = 50
+	// 同時に取得するページ数の上限
+	maxParallelism = 8
+	// 同じドメインへのリクエストの間隔とゆらぎの既定値
+	defaultCrawlDelay  = 100 * time.Millisecond
+	defaultCrawlJitter = 50 * time.Millisecond
+)
+
+// PageTiming は全ページ取得時の1ページごとの結果
+type PageTiming struct {
+	Page       int   `json:"page"`
+	Count      int   `json:"count"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+// CrawlResult は全ページ取得の結果
+type CrawlResult struct {
+	Effects   []EffectInfo
+	DlSecKey  string
+	Pages     []PageTiming
+	Truncated bool
+}
+
+// CrawlOptions は全ページ取得の設定
+type CrawlOptions struct {
+	MaxPages    int
+	Parallelism int
+	Delay       time.Duration
+	Jitter      time.Duration
+	// 1ページ取得するたびにページ順に呼ばれる 同時には呼ばれない
+	// 取得とは別のgoroutineから呼ばれるので、時間がかかっても取得は止まらない
+	OnPage func(event PageEvent)
+}
+
+// PageEvent は全ページ取得中の1ページの取得結果
+// 並列に取得していてもページ順に届き、最終ページや失敗したページより後のものは届かない
+type PageEvent struct {
+	Page     int
+	Effects  []EffectInfo
+	IsNext   bool
+	Duration time.Duration
+	Err      error
+}
+
+// crawlOptions は環境変数とリクエストから全ページ取得の設定を組み立てる
+// EFFECT_LIST_MAX_PAGES, EFFECT_LIST_PARALLELISM, EFFECT_LIST_DELAY_MS, EFFECT_LIST_JITTER_MS
+// リクエストのページ数と並列数は環境変数の値を上限として優先する
+func crawlOptions(request RequestInfo) CrawlOptions {
+	options := CrawlOptions{
+		MaxPages:    envInt("EFFECT_LIST_MAX_PAGES", defaultMaxPages),
+		Parallelism: envInt("EFFECT_LIST_PARALLELISM", 1),
+		Delay:       envDuration("EFFECT_LIST_DELAY_MS", defaultCrawlDelay),
+		Jitter:      envDuration("EFFECT_LIST_JITTER_MS", defaultCrawlJitter),
+	}
+
+	// 0ページでは何も取得せずに全件削除されたように見えるので、既定値にする
+	if options.MaxPages < 1 {
+		options.MaxPages = defaultMaxPages
+	}
+	if request.MaxPages > 0 && request.MaxPages < options.MaxPages {
+		options.MaxPages = request.MaxPages
+	}
+	if request.Parallelism > 0 && request.Parallelism < options.Parallelism {
+		options.Parallelism = request.Parallelism
+	}
+	if options.Parallelism > maxParallelism {
+		options.Parallelism = maxParallelism
+	}
+	if options.Parallelism < 1 {
+		options.Parallelism = 1
+	}
+	return options
+}
+
+func envInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value >= 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value >= 0 {
+		return time.Duration(value) * time.Millisecond
+	}
+	return defaultValue
+}
+
+// fetchEffectListPage は一覧の指定ページを取得して解析する
+func fetchEffectListPage(session *Session, page int) (*parser.EffectListPage, error) {
+	pageParser, err := getPageParser()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := sessionManager.Fetch(session, os.Getenv("EFFECT_LIST_URL")+strconv.Itoa(page))
+	if err != nil {
+		return nil, err
+	}
+
+	return pageParser.ParseEffectList(body)
+}
+
+type crawledPage struct {
+	page     *parser.EffectListPage
+	duration time.Duration
+}
+
+// crawlAllPages は次ページがなくなるまで一覧をたどり、重複を除いた全件をページ順に返す
+// 最終ページが分からないので、並列数の分だけ先のページを取りに行き、最終ページより後の結果は捨てる
+// ctxがキャンセルされた場合はそれ以降のページを取りに行かない
+func crawlAllPages(ctx context.Context, session *Session, options CrawlOptions) (*CrawlResult, error) {
+	limiter := limiterFor(os.Getenv("EFFECT_LIST_URL"), options.Delay, options.Jitter)
+
+	var mu sync.Mutex
+	pages := make(map[int]crawledPage)
+	lastPage := options.MaxPages
+	var firstErr error
+
+	// stopped は指定ページを取りに行く必要がなくなったかを返す
+	stopped := func(page int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil || page > lastPage || ctx.Err() != nil
+	}
+
+	// OnPageはロックの外で1つのgoroutineから順に呼ぶ 書き込みが遅い場合でも他のページの取得を止めない
+	// 先に取りに行ったページは前のページが届くまで待たせ、最終ページより後のものは結果と同じく捨てる
+	events := make(chan PageEvent, options.MaxPages)
+	eventsDone := make(chan struct{})
+	go func() {
+		defer close(eventsDone)
+		pending := make(map[int]PageEvent)
+		next, finished := 1, false
+		for event := range events {
+			pending[event.Page] = event
+			for event, ok := pending[next]; ok && !finished; event, ok = pending[next] {
+				delete(pending, next)
+				next++
+				finished = event.Err != nil || !event.IsNext
+				if options.OnPage != nil {
+					options.OnPage(event)
+				}
+			}
+		}
+	}()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range jobs {
+				if stopped(page) {
+					continue
+				}
+				if err := limiter.Wait(ctx); err != nil {
+					continue
+				}
+
+				start := time.Now()
+				listPage, err := fetchEffectListPage(session, page)
+				duration := time.Since(start)
+
+				mu.Lock()
+				event := PageEvent{Page: page, Duration: duration, Err: err}
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					pages[page] = crawledPage{page: listPage, duration: duration}
+					if !listPage.HasNext && page < lastPage {
+						lastPage = page
+					}
+					event.Effects = toEffectInfos(listPage.Effects)
+					event.IsNext = listPage.HasNext
+				}
+				mu.Unlock()
+				events <- event
+			}
+		}()
+	}
+
+	for page := 1; page <= options.MaxPages && !stopped(page); page++ {
+		jobs <- page
+	}
+	close(jobs)
+	wg.Wait()
+	close(events)
+	<-eventsDone
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// ページ順にまとめる
+	result := &CrawlResult{}
+	seen := make(map[string]bool)
+	for page := 1; page <= lastPage; page++ {
+		crawled, ok := pages[page]
+		if !ok {
+			break
+		}
+		result.Pages = append(result.Pages, PageTiming{
+			Page:       page,
+			Count:      len(crawled.page.Effects),
+			DurationMs: crawled.duration.Milliseconds(),
+		})
+		if crawled.page.DlSecKey != "" {
+			result.DlSecKey = crawled.page.DlSecKey
+		}
+		result.Effects = appendUniqueEffects(result.Effects, seen, toEffectInfos(crawled.page.Effects))
+	}
+	if crawled, ok := pages[options.MaxPages]; ok && lastPage == options.MaxPages && crawled.page.HasNext {
+		result.Truncated = true
+	}
+
+	return result, nil
+}
+
+// appendUniqueEffects はまだ出てきていないエフェクトだけを追加する 差分と同じくIdかHashIdで同一視する
+// どちらも取れなかったエフェクトは同一か分からないので、全て追加する
+func appendUniqueEffects(effects []EffectInfo, seen map[string]bool, page []EffectInfo) []EffectInfo {
+	for _, effect := range page {
+		key := effectKey(effect)
+		if key != "" && seen[key] {
+			continue
+		}
+		seen[key] = true
+		effects = append(effects, effect)
+	}
+	return effects
+}
+
+// domainLimiter は同じドメインへのリクエストの開始に間隔をあける
+type domainLimiter struct {
+	mu     sync.Mutex
+	next   time.Time
+	delay  time.Duration
+	jitter time.Duration
+}
+
+var (
+	domainLimitersMu sync.Mutex
+	domainLimiters   = make(map[string]*domainLimiter)
+)
+
+// limiterFor はurlのホストごとのリミッターを返す 間隔とゆらぎは最後に指定された値を使う
+func limiterFor(rawUrl string, delay time.Duration, jitter time.Duration) *domainLimiter {
+	host := rawUrl
+	if u, err := url.Parse(rawUrl); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	domainLimitersMu.Lock()
+	defer domainLimitersMu.Unlock()
+
+	limiter, ok := domainLimiters[host]
+	if !ok {
+		limiter = &domainLimiter{}
+		domainLimiters[host] = limiter
+	}
+	limiter.mu.Lock()
+	limiter.delay = delay
+	limiter.jitter = jitter
+	limiter.mu.Unlock()
+	return limiter
+}
+
+// Wait は次のリクエストを開始してよい時刻まで待つ ctxがキャンセルされた場合は待つのをやめてエラーを返す
+func (l *domainLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	interval := l.delay
+	if l.jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(l.jitter)))
+	}
+	l.next = start.Add(interval)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,192 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// RenamedEffect は同じIdのまま名前が変わったエフェクト
+type RenamedEffect struct {
+	Id      string `json:"id" firestore:"id"`
+	HashId  string `json:"hashId" firestore:"hashId"`
+	OldName string `json:"oldName" firestore:"oldName"`
+	NewName string `json:"newName" firestore:"newName"`
+}
+
+// CatalogDiff は2つのスナップショットの差分
+// スナップショットと一緒に保存する
+type CatalogDiff struct {
+	BaseSnapshotId string          `json:"baseSnapshotId" firestore:"baseSnapshotId"`
+	Added          []EffectInfo    `json:"added" firestore:"added"`
+	Removed        []EffectInfo    `json:"removed" firestore:"removed"`
+	Renamed        []RenamedEffect `json:"renamed" firestore:"renamed"`
+}
+
+// IsEmpty は差分がないかを返す
+func (d *CatalogDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Renamed) == 0
+}
+
+// effectKey はエフェクトを同一視するためのキー Idが取れなかった場合はHashIdを使う
+// どちらも取れなかった場合は空文字を返すので、他のエフェクトと同一視しないこと
+func effectKey(effect EffectInfo) string {
+	if effect.Id != "" {
+		return effect.Id
+	}
+	if effect.HashId != "" {
+		return "hash:" + effect.HashId
+	}
+	return ""
+}
+
+// DiffCatalogs は前回と今回のエフェクト一覧を比べて、追加、削除、名前の変更を返す
+// 結果はそれぞれの一覧の順番に並ぶ
+func DiffCatalogs(previous []EffectInfo, current []EffectInfo) *CatalogDiff {
+	diff := &CatalogDiff{
+		Added:   []EffectInfo{},
+		Removed: []EffectInfo{},
+		Renamed: []RenamedEffect{},
+	}
+
+	previousByKey := make(map[string]EffectInfo, len(previous))
+	for _, effect := range previous {
+		previousByKey[effectKey(effect)] = effect
+	}
+	currentKeys := make(map[string]bool, len(current))
+
+	for _, effect := range current {
+		key := effectKey(effect)
+		currentKeys[key] = true
+
+		old, ok := previousByKey[key]
+		if !ok {
+			diff.Added = append(diff.Added, effect)
+			continue
+		}
+		if old.Name != effect.Name {
+			diff.Renamed = append(diff.Renamed, RenamedEffect{
+				Id:      effect.Id,
+				HashId:  effect.HashId,
+				OldName: old.Name,
+				NewName: effect.Name,
+			})
+		}
+	}
+
+	for _, effect := range previous {
+		if !currentKeys[effectKey(effect)] {
+			diff.Removed = append(diff.Removed, effect)
+		}
+	}
+
+	return diff
+}
+
+type RequestEffectDiff struct {
+	// GetEffectListなどでログインしたセッション アカウントはこのセッションから決める
+	SessionId string `json:"sessionId"`
+	// 指定した場合は最新のスナップショットとこのスナップショットを比べる
+	// 指定しない場合は保存時に計算した前回との差分を返す
+	BaseSnapshotId string `json:"baseSnapshotId"`
+}
+
+type ResponseEffectDiff struct {
+	Succeed    bool         `json:"succeed"`
+	SnapshotId string       `json:"snapshotId"`
+	ScrapedAt  *time.Time   `json:"scrapedAt,omitempty"`
+	Diff       *CatalogDiff `json:"diff"`
+}
+
+// latestCatalogDiff はアカウントの最新のスナップショットと、その差分を返す
+func latestCatalogDiff(ctx context.Context, account string, baseSnapshotId string) (*CatalogSnapshot, *CatalogDiff, error) {
+	repository, err := getCatalogRepository()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	latest, err := repository.Latest(ctx, account)
+	if err != nil {
+		return nil, nil, err
+	}
+	if baseSnapshotId == "" || baseSnapshotId == latest.Diff.baseId() {
+		return latest, latest.Diff, nil
+	}
+
+	base, err := repository.Get(ctx, account, baseSnapshotId)
+	if err != nil {
+		return nil, nil, err
+	}
+	diff := DiffCatalogs(base.Effects, latest.Effects)
+	diff.BaseSnapshotId = base.Id
+	return latest, diff, nil
+}
+
+// baseId は差分の比較元のスナップショットのIdを返す 差分がなければ空文字
+func (d *CatalogDiff) baseId() string {
+	if d == nil {
+		return ""
+	}
+	return d.BaseSnapshotId
+}
+
+// EffectDiff は前回の取得から追加、削除、名前が変わったエフェクトを返す
+func EffectDiff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// JSONデコード
+	var request RequestEffectDiff
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	godotenv.Load()
+
+	_, account, err := authenticate(r.Context(), request.SessionId, "", "")
+	if err != nil {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+
+	snapshot, diff, err := latestCatalogDiff(r.Context(), account, request.BaseSnapshotId)
+	if errors.Is(err, ErrCatalogNotFound) {
+		http.Error(w, "Catalog not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read catalog: %v", err)
+		http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+		return
+	}
+
+	response := ResponseEffectDiff{
+		Succeed:    true,
+		SnapshotId: snapshot.Id,
+		ScrapedAt:  &snapshot.ScrapedAt,
+		Diff:       diff,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
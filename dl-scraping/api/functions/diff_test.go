@@ -0,0 +1,123 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+func TestDiffCatalogs(t *testing.T) {
+	previous := []EffectInfo{
+		{Name: "朝顔", Id: "1", HashId: "hash1"},
+		{Name: "花火", Id: "2", HashId: "hash2"},
+		{Name: "紅葉", Id: "3", HashId: "hash3"},
+	}
+	current := []EffectInfo{
+		{Name: "朝顔", Id: "1", HashId: "hash1a"},
+		{Name: "大花火", Id: "2", HashId: "hash2"},
+		{Name: "雪", Id: "4", HashId: "hash4"},
+	}
+
+	diff := DiffCatalogs(previous, current)
+	if want := []EffectInfo{current[2]}; !reflect.DeepEqual(diff.Added, want) {
+		t.Errorf("Added = %+v, want %+v", diff.Added, want)
+	}
+	if want := []EffectInfo{previous[2]}; !reflect.DeepEqual(diff.Removed, want) {
+		t.Errorf("Removed = %+v, want %+v", diff.Removed, want)
+	}
+	want := []RenamedEffect{{Id: "2", HashId: "hash2", OldName: "花火", NewName: "大花火"}}
+	if !reflect.DeepEqual(diff.Renamed, want) {
+		t.Errorf("Renamed = %+v, want %+v", diff.Renamed, want)
+	}
+
+	if !DiffCatalogs(previous, previous).IsEmpty() {
+		t.Error("expected no difference for the same catalog")
+	}
+}
+
+func postEffectDiff(t *testing.T, request RequestEffectDiff) (*httptest.ResponseRecorder, ResponseEffectDiff) {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/effect-diff", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	EffectDiff(response, req)
+
+	var res ResponseEffectDiff
+	if response.Code == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return response, res
+}
+
+func TestEffectDiff(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	useMemoryCatalog(t)
+
+	response, login := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+
+	// まだ取得していなければ404
+	response, _ = postEffectDiff(t, RequestEffectDiff{SessionId: login.SessionId})
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("expected status NotFound; got %v", response.Code)
+	}
+
+	response, _ = postGetEffectList(t, RequestInfo{All: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	_, first := postEffectDiff(t, RequestEffectDiff{SessionId: login.SessionId})
+	if !first.Succeed || first.Diff != nil {
+		t.Errorf("expected no diff for the first snapshot; got %+v", first)
+	}
+
+	upstream.SetEffects([]fakeupstream.Effect{
+		{Id: "1", Name: "朝顔", HashId: "hash1"},
+		{Id: "2", Name: "大花火", HashId: "hash2"},
+		{Id: "4", Name: "雪", HashId: "hash4"},
+	})
+	response, list := postGetEffectList(t, RequestInfo{All: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+
+	// アカウントはsessionIdから分かる
+	_, second := postEffectDiff(t, RequestEffectDiff{SessionId: list.SessionId})
+	if second.Diff == nil || second.Diff.BaseSnapshotId != first.SnapshotId {
+		t.Fatalf("expected diff against %s; got %+v", first.SnapshotId, second.Diff)
+	}
+	if len(second.Diff.Added) != 1 || second.Diff.Added[0].Id != "4" {
+		t.Errorf("unexpected added: %+v", second.Diff.Added)
+	}
+	if len(second.Diff.Removed) != 1 || second.Diff.Removed[0].Id != "3" {
+		t.Errorf("unexpected removed: %+v", second.Diff.Removed)
+	}
+	if len(second.Diff.Renamed) != 1 || second.Diff.Renamed[0].NewName != "大花火" {
+		t.Errorf("unexpected renamed: %+v", second.Diff.Renamed)
+	}
+
+	response, _ = postEffectDiff(t, RequestEffectDiff{SessionId: list.SessionId, BaseSnapshotId: "unknown"})
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected status NotFound for unknown base; got %v", response.Code)
+	}
+	// 認証したセッションがなければ読めない
+	for _, body := range []string{`{"sessionId": "unknown"}`, `{"mailAddress": "` + testMailAddress + `"}`} {
+		req := httptest.NewRequest(http.MethodPost, "/effect-diff", strings.NewReader(body))
+		response := httptest.NewRecorder()
+		EffectDiff(response, req)
+		if response.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status Unauthorized; got %v", body, response.Code)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	// ブラウザやCDNにキャッシュさせる期間の既定値
+	defaultEffectImageMaxAge = 24 * time.Hour
+	// 上流から取得する画像の大きさの上限の既定値
+	defaultEffectImageMaxBytes = 5 << 20
+)
+
+// ErrInvalidEffectId はエフェクトIdに保存先の名前や上流のURLにそのまま使えない文字が入っている場合
+var ErrInvalidEffectId = errors.New("invalid effect id")
+
+// ErrUpstreamImage は上流から画像を取得できなかった場合や、取得したものが画像として使えない場合
+var ErrUpstreamImage = errors.New("failed to fetch upstream image")
+
+// upstreamReader は上流の画像を読む 上限を超えた場合や読み込みに失敗した場合はErrUpstreamImageを返す
+// io.LimitReaderは黙って打ち切るので、途中までの画像を保存しないためにこちらを使う
+type upstreamReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (u *upstreamReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.remaining -= int64(n)
+	if u.remaining < 0 {
+		return n, fmt.Errorf("%w: image exceeds the size limit", ErrUpstreamImage)
+	}
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("%w: %v", ErrUpstreamImage, err)
+	}
+	return n, err
+}
+
+// teeImage はurlの画像を取得し、確かめながらstoreとwに1回で書く
+// ステータス、画像の種類、大きさのいずれかが合わない場合や途中で失敗した場合は、storeに書きかけのものを残さない
+// wには途中まで書かれることがあるので、エラーの場合は捨てる
+func teeImage(ctx context.Context, store ImageStore, url, name string, w io.Writer) (*ImageInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpstreamImage, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpstreamImage, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: unexpected status %d", ErrUpstreamImage, resp.StatusCode)
+	}
+	maxBytes := int64(envInt("EFFECT_IMAGE_MAX_BYTES", defaultEffectImageMaxBytes))
+	if resp.ContentLength > maxBytes {
+		return nil, fmt.Errorf("%w: image exceeds the size limit (%d bytes)", ErrUpstreamImage, resp.ContentLength)
+	}
+	if header := resp.Header.Get("Content-Type"); header != "" && !strings.HasPrefix(header, "image/") {
+		return nil, fmt.Errorf("%w: unexpected content type %q", ErrUpstreamImage, header)
+	}
+
+	// エラーページを画像として保存しないように、先頭の中身からも種類を確かめる
+	head := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("%w: %v", ErrUpstreamImage, err)
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if n == 0 || !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("%w: body is not an image (%s)", ErrUpstreamImage, contentType)
+	}
+
+	body := &upstreamReader{r: io.MultiReader(bytes.NewReader(head), resp.Body), remaining: maxBytes}
+	return store.Put(ctx, name, contentType, io.TeeReader(body, w))
+}
+
+// openEffectImage はエフェクトのサムネイルを保存先から開く
+// なければ上流から取得し、保存しながら読んだものを返す
+// Idは保存先の名前と上流のURLに埋め込むので、使えない文字がある場合はErrInvalidEffectIdを返す
+func openEffectImage(ctx context.Context, store ImageStore, effectId string) (io.ReadCloser, *ImageInfo, error) {
+	if !validEffectId(effectId) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidEffectId, effectId)
+	}
+	name := effectImageName(effectId)
+	reader, info, err := store.Get(ctx, name)
+	if !errors.Is(err, ErrImageNotFound) {
+		return reader, info, err
+	}
+
+	var data bytes.Buffer
+	url := fmt.Sprintf(os.Getenv("EFFECT_IMAGE_URL"), effectId)
+	info, err = teeImage(ctx, store, url, name, &data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NopCloser(&data), info, nil
+}
+
+// etagMatches はIf-None-Matchの値にetagが含まれるかを返す 弱いETagも同じものとして比べる
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified は条件付きリクエストに対して画像が変わっていないかを返す
+// If-None-Matchがある場合はIf-Modified-Sinceより優先する
+func notModified(r *http.Request, etag string, updatedAt time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updatedAt.IsZero() {
+		return !updatedAt.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// EffectImage はエフェクトのサムネイルを画像のまま返す パスの最後がエフェクトId (GET /effect-image/{id})
+// ETagとLast-Modifiedを付けるので、ブラウザやCDNは条件付きリクエストで再取得を省ける
+// ?width=320&format=png のように指定すると縮小や形式を変えたものを返す (webpは作らない)
+func EffectImage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	effectId := path.Base(r.URL.Path)
+	if effectId == "" || effectId == "/" || effectId == "." || effectId == "effect-image" {
+		http.Error(w, "Effect id is empty", http.StatusBadRequest)
+		return
+	}
+
+	godotenv.Load()
+
+	variant, err := parseImageVariant(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store, err := getImageStore()
+	if err != nil {
+		log.Printf("Failed to open image store: %v", err)
+		http.Error(w, "Failed to open image store", http.StatusInternalServerError)
+		return
+	}
+
+	reader, info, err := openEffectImageVariant(r.Context(), store, effectId, variant)
+	if errors.Is(err, ErrImageVariant) || errors.Is(err, ErrInvalidEffectId) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrUpstreamImage) {
+		log.Printf("Failed to download effect image %s: %v", effectId, err)
+		http.Error(w, "Failed to download effect image", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read effect image %s: %v", effectId, err)
+		http.Error(w, "Failed to read effect image", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	etag := `"` + info.ETag + `"`
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(envDuration("EFFECT_IMAGE_MAX_AGE_MS", defaultEffectImageMaxAge).Seconds())))
+	if !info.UpdatedAt.IsZero() {
+		header.Set("Last-Modified", info.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, info.UpdatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Type", info.ContentType)
+	header.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Printf("Failed to write effect image %s: %v", effectId, err)
+	}
+}
@@ -0,0 +1,105 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+func getEffectImage(t *testing.T, method string, effectId string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/effect-image/"+effectId, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	response := httptest.NewRecorder()
+	EffectImage(response, req)
+	return response
+}
+
+func TestEffectImage(t *testing.T) {
+	setupFakeUpstream(t)
+	store := useMemoryImages(t)
+
+	response := getEffectImage(t, http.MethodGet, "1", nil)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if !bytes.Equal(response.Body.Bytes(), fakeupstream.ImageData("1")) {
+		t.Errorf("unexpected image (%d bytes)", response.Body.Len())
+	}
+	header := response.Header()
+	etag := header.Get("ETag")
+	if header.Get("Content-Type") != "image/jpeg" || !strings.HasPrefix(etag, `"`) || header.Get("Last-Modified") == "" {
+		t.Errorf("unexpected headers: %v", header)
+	}
+	if header.Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("unexpected Cache-Control: %q", header.Get("Cache-Control"))
+	}
+	if ok, _ := store.Exists(context.Background(), "images/1.jpg"); !ok {
+		t.Error("expected downloaded image to be stored")
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"same etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"weak etag in list", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"other etag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, http.StatusOK},
+		// If-None-MatchがあればIf-Modified-Sinceは見ない
+		{"etag wins", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		response := getEffectImage(t, http.MethodGet, "1", tt.header)
+		if response.Code != tt.want {
+			t.Errorf("%s: expected status %v; got %v", tt.name, tt.want, response.Code)
+		}
+		if response.Code == http.StatusNotModified && (response.Body.Len() != 0 || response.Header().Get("ETag") != etag) {
+			t.Errorf("%s: unexpected 304 response: %v %q", tt.name, response.Header(), response.Body.String())
+		}
+	}
+
+	// 画像が変わればETagも変わる
+	store.Put(context.Background(), "images/1.jpg", "image/jpeg", strings.NewReader("updated"))
+	response = getEffectImage(t, http.MethodGet, "1", map[string]string{"If-None-Match": etag})
+	if response.Code != http.StatusOK || response.Body.String() != "updated" || response.Header().Get("ETag") == etag {
+		t.Errorf("expected updated image; got %v %q", response.Code, response.Body.String())
+	}
+
+	response = getEffectImage(t, http.MethodHead, "1", nil)
+	if response.Code != http.StatusOK || response.Body.Len() != 0 || response.Header().Get("Content-Length") != "7" {
+		t.Errorf("unexpected HEAD response: %v %v", response.Code, response.Header())
+	}
+}
+
+func TestEffectImage_errors(t *testing.T) {
+	setupFakeUpstream(t)
+	useMemoryImages(t)
+	t.Setenv("EFFECT_IMAGE_URL", "http://127.0.0.1:0/img/theme_%s.jpg")
+
+	if response := getEffectImage(t, http.MethodGet, "1", nil); response.Code != http.StatusBadGateway {
+		t.Errorf("expected status BadGateway for unreachable upstream; got %v", response.Code)
+	}
+	if response := getEffectImage(t, http.MethodGet, "", nil); response.Code != http.StatusBadRequest {
+		t.Errorf("expected status BadRequest without id; got %v", response.Code)
+	}
+	if response := getEffectImage(t, http.MethodPost, "1", nil); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status MethodNotAllowed; got %v", response.Code)
+	}
+	// 上流のURLの書式や保存先の名前を変えてしまうIdは取得しない
+	for _, effectId := range []string{"1%25s", "1.jpg", "1%3Fx", "1%3Fwidth=8"} {
+		if response := getEffectImage(t, http.MethodGet, effectId, nil); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status BadRequest; got %v", effectId, response.Code)
+		}
+	}
+}
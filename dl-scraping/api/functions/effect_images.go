@@ -0,0 +1,292 @@
+package functions
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const (
+	// 上流から同時に取得する画像数の既定値
+	defaultEffectImagesParallelism = 4
+	// 1回のリクエストで指定できるエフェクト数の既定値
+	defaultEffectImagesMax = 200
+	// manifestのパートやファイルの名前 エフェクトIdには'.'が入らないので、画像の名前と重ならない
+	effectImagesManifestName = "_manifest.json"
+)
+
+type RequestEffectImages struct {
+	EffectIds []string `json:"effectIds"`
+	// "multipart"か"zip" 未指定の場合はAcceptヘッダーにapplication/zipがあればzip、なければmultipart
+	Format string `json:"format"`
+}
+
+// EffectImagesManifest はまとめて返した画像の一覧 応答の最後に_manifest.jsonとして付ける
+type EffectImagesManifest struct {
+	Images []EffectImageEntry `json:"images"`
+	// 取得できなかったエフェクトのId
+	Failed []string `json:"failed"`
+}
+
+type EffectImageEntry struct {
+	EffectId    string    `json:"effectId"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	ETag        string    `json:"etag"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+type effectImageResult struct {
+	data []byte
+	info *ImageInfo
+	err  error
+}
+
+// validEffectId はIdがファイル名やヘッダーにそのまま使える文字だけでできているかを返す
+func validEffectId(effectId string) bool {
+	if effectId == "" {
+		return false
+	}
+	for _, c := range effectId {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// readEffectImage はエフェクトのサムネイルを保存先から読む なければ上流から取得して保存する
+func readEffectImage(ctx context.Context, store ImageStore, effectId string) ([]byte, *ImageInfo, error) {
+	reader, info, err := openEffectImage(ctx, store, effectId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, info, nil
+}
+
+// fetchEffectImages はeffectIdsの画像を同時にparallelism件まで取得する
+// 結果はeffectIdsと同じ順番のチャネルに届くので、取得し終えたものから順に書き出せる
+func fetchEffectImages(ctx context.Context, store ImageStore, effectIds []string, parallelism int) []chan effectImageResult {
+	results := make([]chan effectImageResult, len(effectIds))
+	for i := range results {
+		results[i] = make(chan effectImageResult, 1)
+	}
+
+	jobs := make(chan int)
+	for i := 0; i < max(parallelism, 1); i++ {
+		go func() {
+			for index := range jobs {
+				data, info, err := readEffectImage(ctx, store, effectIds[index])
+				results[index] <- effectImageResult{data: data, info: info, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := range effectIds {
+			jobs <- i
+		}
+	}()
+	return results
+}
+
+// effectImagesWriter は画像を1件ずつ応答の形式に合わせて書く
+type effectImagesWriter interface {
+	writeImage(effectId string, info *ImageInfo, data []byte) error
+	writeManifest(manifest EffectImagesManifest) error
+	Close() error
+}
+
+type multipartImagesWriter struct {
+	writer *multipart.Writer
+}
+
+// writeImage はエフェクトIdを名前にしたフォームのファイルとして書く ブラウザではResponse.formData()で読める
+func (m *multipartImagesWriter) writeImage(effectId string, info *ImageInfo, data []byte) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, effectId, effectFileName(effectId)))
+	header.Set("Content-Type", info.ContentType)
+	header.Set("ETag", `"`+info.ETag+`"`)
+	part, err := m.writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(data)
+	return err
+}
+
+func (m *multipartImagesWriter) writeManifest(manifest EffectImagesManifest) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, effectImagesManifestName))
+	header.Set("Content-Type", "application/json")
+	part, err := m.writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(part).Encode(manifest)
+}
+
+func (m *multipartImagesWriter) Close() error {
+	return m.writer.Close()
+}
+
+type zipImagesWriter struct {
+	writer *zip.Writer
+}
+
+// writeImage は画像をそのまま入れる jpegなどは圧縮しても小さくならないため
+func (z *zipImagesWriter) writeImage(effectId string, info *ImageInfo, data []byte) error {
+	file, err := z.writer.CreateHeader(&zip.FileHeader{
+		Name:     effectFileName(effectId),
+		Method:   zip.Store,
+		Modified: info.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+func (z *zipImagesWriter) writeManifest(manifest EffectImagesManifest) error {
+	file, err := z.writer.Create(effectImagesManifestName)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(file).Encode(manifest)
+}
+
+func (z *zipImagesWriter) Close() error {
+	return z.writer.Close()
+}
+
+// effectFileName は応答の中の画像のファイル名 保存先の名前の拡張子を使う
+func effectFileName(effectId string) string {
+	return effectId + path.Ext(effectImageName(effectId))
+}
+
+// EffectImages は複数のエフェクトのサムネイルをまとめて返す
+// 保存先にないものは上流から同時にEFFECT_IMAGES_PARALLELISM件まで取得する
+// 取得できなかったものは飛ばし、最後のmanifestのfailedに入れる
+func EffectImages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request RequestEffectImages
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	godotenv.Load()
+
+	// 同じIdは1回だけ返す
+	seen := make(map[string]bool)
+	var effectIds []string
+	for _, id := range request.EffectIds {
+		if !seen[id] {
+			seen[id] = true
+			effectIds = append(effectIds, id)
+		}
+	}
+	if len(effectIds) == 0 {
+		http.Error(w, "Effect ids are empty", http.StatusBadRequest)
+		return
+	}
+	if limit := envInt("EFFECT_IMAGES_MAX", defaultEffectImagesMax); len(effectIds) > limit {
+		http.Error(w, fmt.Sprintf("Too many effect ids (max %d)", limit), http.StatusBadRequest)
+		return
+	}
+
+	store, err := getImageStore()
+	if err != nil {
+		log.Printf("Failed to open image store: %v", err)
+		http.Error(w, "Failed to open image store", http.StatusInternalServerError)
+		return
+	}
+
+	format := request.Format
+	if format == "" {
+		format = "multipart"
+		if strings.Contains(r.Header.Get("Accept"), "application/zip") {
+			format = "zip"
+		}
+	}
+	var writer effectImagesWriter
+	switch format {
+	case "multipart":
+		multipartWriter := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/form-data; boundary="+multipartWriter.Boundary())
+		writer = &multipartImagesWriter{writer: multipartWriter}
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="effect-images.zip"`)
+		writer = &zipImagesWriter{writer: zip.NewWriter(w)}
+	default:
+		http.Error(w, "Unknown format: "+format, http.StatusBadRequest)
+		return
+	}
+
+	// 途中で書き込みに失敗した場合は残りの取得もやめる
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	results := fetchEffectImages(ctx, store, effectIds, envInt("EFFECT_IMAGES_PARALLELISM", defaultEffectImagesParallelism))
+	manifest := EffectImagesManifest{Images: []EffectImageEntry{}, Failed: []string{}}
+	for i, effectId := range effectIds {
+		result := <-results[i]
+		if result.err != nil {
+			log.Printf("Failed to read effect image %s: %v", effectId, result.err)
+			manifest.Failed = append(manifest.Failed, effectId)
+			continue
+		}
+		if err := writer.writeImage(effectId, result.info, result.data); err != nil {
+			log.Printf("Failed to write effect images: %v", err)
+			return
+		}
+		manifest.Images = append(manifest.Images, EffectImageEntry{
+			EffectId:    effectId,
+			ContentType: result.info.ContentType,
+			Size:        int64(len(result.data)),
+			ETag:        result.info.ETag,
+			UpdatedAt:   result.info.UpdatedAt,
+		})
+	}
+
+	if err := writer.writeManifest(manifest); err != nil {
+		log.Printf("Failed to write effect images: %v", err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to write effect images: %v", err)
+	}
+}
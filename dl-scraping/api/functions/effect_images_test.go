@@ -0,0 +1,180 @@
+package functions
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+func postEffectImages(t *testing.T, request RequestEffectImages, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/effect-images", bytes.NewReader(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	response := httptest.NewRecorder()
+	EffectImages(response, req)
+	return response
+}
+
+// readMultipartImages はmultipartの応答から名前ごとの中身を読む
+func readMultipartImages(t *testing.T, response *httptest.ResponseRecorder) (map[string][]byte, []string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("unexpected content type %q: %v", response.Header().Get("Content-Type"), err)
+	}
+	reader := multipart.NewReader(response.Body, params["boundary"])
+	parts := make(map[string][]byte)
+	var names []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read part: %v", err)
+		}
+		data, _ := io.ReadAll(part)
+		parts[part.FormName()] = data
+		names = append(names, part.FormName())
+	}
+	return parts, names
+}
+
+func TestEffectImages_multipart(t *testing.T) {
+	setupFakeUpstream(t)
+	store := useMemoryImages(t)
+	// 2は保存済みのものを返す
+	store.Put(context.Background(), "images/2.jpg", "image/jpeg", bytes.NewReader(fakeupstream.ImageData("2")))
+	// manifestという名前のエフェクトがあってもmanifestと重ならない
+	store.Put(context.Background(), "images/manifest.jpg", "image/jpeg", bytes.NewReader(fakeupstream.ImageData("manifest")))
+
+	response := postEffectImages(t, RequestEffectImages{EffectIds: []string{"3", "1", "404", "2", "1", "../1", "manifest"}}, "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	parts, names := readMultipartImages(t, response)
+	// 指定した順に、重複を除いて返し、最後にmanifestを付ける
+	if strings.Join(names, ",") != "3,1,2,manifest,_manifest.json" {
+		t.Fatalf("unexpected parts: %v", names)
+	}
+	for _, id := range []string{"1", "2", "3", "manifest"} {
+		if !bytes.Equal(parts[id], fakeupstream.ImageData(id)) {
+			t.Errorf("unexpected image %s (%d bytes)", id, len(parts[id]))
+		}
+	}
+
+	var manifest EffectImagesManifest
+	if err := json.Unmarshal(parts["_manifest.json"], &manifest); err != nil {
+		t.Fatalf("failed to decode manifest: %v", err)
+	}
+	if len(manifest.Images) != 4 || manifest.Images[0].EffectId != "3" || manifest.Images[3].EffectId != "manifest" || manifest.Images[0].ETag == "" {
+		t.Errorf("unexpected manifest images: %+v", manifest.Images)
+	}
+	if strings.Join(manifest.Failed, ",") != "404,../1" {
+		t.Errorf("unexpected failed ids: %v", manifest.Failed)
+	}
+	// 取得したものは保存先に残す
+	if images, _ := store.List(context.Background(), "images/"); len(images) != 4 {
+		t.Errorf("expected 4 stored images; got %+v", images)
+	}
+}
+
+func TestEffectImages_zip(t *testing.T) {
+	setupFakeUpstream(t)
+	useMemoryImages(t)
+
+	for _, response := range []*httptest.ResponseRecorder{
+		postEffectImages(t, RequestEffectImages{EffectIds: []string{"1", "2"}, Format: "zip"}, ""),
+		postEffectImages(t, RequestEffectImages{EffectIds: []string{"1", "2"}}, "application/zip"),
+	} {
+		if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("unexpected response: %v %v", response.Code, response.Header())
+		}
+		archive, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+		if err != nil {
+			t.Fatalf("failed to open zip: %v", err)
+		}
+		var names []string
+		for _, file := range archive.File {
+			names = append(names, file.Name)
+			if file.Name == "_manifest.json" {
+				continue
+			}
+			reader, _ := file.Open()
+			data, _ := io.ReadAll(reader)
+			reader.Close()
+			if !bytes.Equal(data, fakeupstream.ImageData(strings.TrimSuffix(file.Name, ".jpg"))) {
+				t.Errorf("unexpected image %s (%d bytes)", file.Name, len(data))
+			}
+		}
+		if strings.Join(names, ",") != "1.jpg,2.jpg,_manifest.json" {
+			t.Errorf("unexpected files: %v", names)
+		}
+	}
+}
+
+func TestEffectImages_parallelism(t *testing.T) {
+	var inFlight, maxInFlight, calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			previous := atomic.LoadInt32(&maxInFlight)
+			if current <= previous || atomic.CompareAndSwapInt32(&maxInFlight, previous, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(fakeupstream.ImageData(strings.TrimSuffix(r.URL.Path[1:], ".jpg")))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("EFFECT_IMAGE_URL", upstream.URL+"/%s.jpg")
+	t.Setenv("EFFECT_IMAGES_PARALLELISM", "3")
+	useMemoryImages(t)
+
+	var effectIds []string
+	for i := 0; i < 12; i++ {
+		effectIds = append(effectIds, strconv.Itoa(i))
+	}
+	response := postEffectImages(t, RequestEffectImages{EffectIds: effectIds}, "")
+	_, names := readMultipartImages(t, response)
+	if len(names) != 13 || atomic.LoadInt32(&calls) != 12 {
+		t.Fatalf("expected 12 images and a manifest; got %v after %d calls", names, calls)
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 3 || max < 2 {
+		t.Errorf("expected up to 3 concurrent downloads; got %d", max)
+	}
+}
+
+func TestEffectImages_invalid(t *testing.T) {
+	useMemoryImages(t)
+	t.Setenv("EFFECT_IMAGES_MAX", "2")
+
+	for name, request := range map[string]RequestEffectImages{
+		"empty":    {},
+		"too many": {EffectIds: []string{"1", "2", "3"}},
+		"format":   {EffectIds: []string{"1"}, Format: "tar"},
+	} {
+		if response := postEffectImages(t, request, ""); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status BadRequest; got %v", name, response.Code)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// fakeupstream はテスト用の上流サイトの偽物
+// ログイン、エフェクト一覧、エフェクト画像、エフェクト変更をhttptestで提供する
+package fakeupstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const sessionCookieName = "JSESSIONID"
+
+// Effect は偽サイトに登録するエフェクト
+type Effect struct {
+	Id     string
+	Name   string
+	HashId string
+}
+
+// Server は上流サイトの偽物
+type Server struct {
+	*httptest.Server
+
+	MailAddress string
+	Password    string
+	PageSize    int
+
+	mu        sync.Mutex
+	effects   []Effect
+	sessions  map[string]string // key: JSESSIONID, value: dlSecKey
+	selected  string
+	requests  map[string]int
+	failPaths map[string]int
+}
+
+// New は偽サイトを起動する 使い終わったらCloseを呼ぶこと
+func New(mailAddress string, password string, effects []Effect) *Server {
+	s := &Server{
+		MailAddress: mailAddress,
+		Password:    password,
+		PageSize:    2,
+		effects:     effects,
+		sessions:    make(map[string]string),
+		requests:    make(map[string]int),
+		failPaths:   make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/list", s.handleList)
+	mux.HandleFunc("/change", s.handleChange)
+	mux.HandleFunc("/img/", s.handleImage)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Env は関数が参照する環境変数を偽サイトに向けた値を返す
+func (s *Server) Env() map[string]string {
+	return map[string]string{
+		"TOP_URL":          s.URL + "/",
+		"LOGIN_URL":        s.URL + "/login?mail=%s&pass=%s",
+		"EFFECT_LIST_URL":  s.URL + "/list?page=",
+		"EFFECT_IMAGE_URL": s.URL + "/img/theme_%s.jpg",
+		"CHANGE_URL":       s.URL + "/change?ti=%s&no=%d&__DL__SEC__KEY__=%s",
+	}
+}
+
+// ExpireSessions は全てのセッションを切る
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]string)
+}
+
+// SetEffects は登録されているエフェクトを差し替える
+func (s *Server) SetEffects(effects []Effect) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.effects = effects
+}
+
+// Selected は最後に変更されたエフェクトのHashIdを返す
+func (s *Server) Selected() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selected
+}
+
+// Requests はパスごとのリクエスト数を返す
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// FailNext は指定したパスへの次のn回のリクエストを500で失敗させる
+func (s *Server) FailNext(path string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPaths[path] = n
+}
+
+// ImageData はエフェクトIDごとに決まった色のjpeg画像を返す
+func ImageData(id string) []byte {
+	n, _ := strconv.Atoi(id)
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	c := color.RGBA{R: uint8(n * 40), G: uint8(n * 80), B: uint8(n * 120), A: 255}
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, nil)
+	return buf.Bytes()
+}
+
+// begin はリクエストを記録し、失敗させる設定があればtrueを返す
+func (s *Server) begin(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[r.URL.Path]++
+	if s.failPaths[r.URL.Path] > 0 {
+		s.failPaths[r.URL.Path]--
+		http.Error(w, "upstream error", http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
+// sessionKey はリクエストのセッションに紐づくdlSecKeyを返す セッションが無効なら空文字
+func (s *Server) sessionKey(r *http.Request) (string, string) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cookie.Value, s.sessions[cookie.Value]
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if s.begin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("mail") != s.MailAddress || query.Get("pass") != s.Password {
+		writeErrorPage(w, "メールアドレスまたはパスワードが違います")
+		return
+	}
+
+	sessionId := randomHex()
+	s.mu.Lock()
+	s.sessions[sessionId] = randomHex()
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: sessionId, Path: "/"})
+	fmt.Fprint(w, "<html><body><div id=\"top\">ようこそ</div></body></html>")
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if s.begin(w, r) {
+		return
+	}
+
+	_, dlSecKey := s.sessionKey(r)
+	if dlSecKey == "" {
+		writeErrorPage(w, "セッションが切れました")
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	s.mu.Lock()
+	effects := s.effects
+	pageSize := s.PageSize
+	s.mu.Unlock()
+
+	start := (page - 1) * pageSize
+	end := start + pageSize
+	if start > len(effects) {
+		start = len(effects)
+	}
+	if end > len(effects) {
+		end = len(effects)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<html><body><ul class=\"list\">")
+	for _, effect := range effects[start:end] {
+		fmt.Fprintf(&buf,
+			"<li class=\"item\"><a href=\"/change?ti=%s&amp;__DL__SEC__KEY__=%s\"><img src=\"/img/theme_%s.jpg\"></a><div class=\"name\">%s</div></li>",
+			url.QueryEscape(effect.HashId), dlSecKey, effect.Id, html.EscapeString(effect.Name))
+	}
+	buf.WriteString("</ul><ul class=\"pager\">")
+	if end < len(effects) {
+		fmt.Fprintf(&buf, "<li class=\"pagerNext\"><a href=\"/list?page=%d\">次へ</a></li>", page+1)
+	}
+	buf.WriteString("</ul></body></html>")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) handleChange(w http.ResponseWriter, r *http.Request) {
+	if s.begin(w, r) {
+		return
+	}
+
+	sessionId, dlSecKey := s.sessionKey(r)
+	query := r.URL.Query()
+	if dlSecKey == "" || query.Get("__DL__SEC__KEY__") != dlSecKey {
+		writeErrorPage(w, "セッションが切れました")
+		return
+	}
+
+	// 変更のたびにdlSecKeyを振り直す
+	newKey := randomHex()
+	s.mu.Lock()
+	s.sessions[sessionId] = newKey
+	s.selected = query.Get("ti")
+	s.mu.Unlock()
+
+	fmt.Fprintf(w, "<html><body><div class=\"dfultSlct\"><a href=\"/list?__DL__SEC__KEY__=%s\">設定中</a></div></body></html>", newKey)
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	if s.begin(w, r) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/img/")
+	if !strings.HasPrefix(name, "theme_") || !strings.HasSuffix(name, ".jpg") {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(name, "theme_"), ".jpg")
+
+	s.mu.Lock()
+	found := false
+	for _, effect := range s.effects {
+		if effect.Id == id {
+			found = true
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(ImageData(id))
+}
+
+func writeErrorPage(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body><div id=\"error\">%s</div></body></html>", html.EscapeString(message))
+}
+
+func randomHex() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
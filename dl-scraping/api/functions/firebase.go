@@ -0,0 +1,39 @@
+package functions
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+)
+
+const firebaseProjectId = "asa-o-experiment"
+
+var ErrServiceAccountKeyNotSet = errors.New("service account key is not set")
+
+// serviceAccountOption は環境変数SERVICE_ACCOUNT_KEYの秘密鍵から認証情報を作る
+// 秘密鍵は環境変数にbase64エンコードして格納
+func serviceAccountOption() (option.ClientOption, error) {
+	encodedServiceAccountKey := os.Getenv("SERVICE_ACCOUNT_KEY")
+	if encodedServiceAccountKey == "" {
+		return nil, ErrServiceAccountKeyNotSet
+	}
+
+	serviceAccountKey, err := base64.StdEncoding.DecodeString(encodedServiceAccountKey)
+	if err != nil {
+		return nil, err
+	}
+	return option.WithCredentialsJSON(serviceAccountKey), nil
+}
+
+// newFirestoreClient はサービスアカウントでFirestoreクライアントを作る
+func newFirestoreClient(ctx context.Context) (*firestore.Client, error) {
+	sa, err := serviceAccountOption()
+	if err != nil {
+		return nil, err
+	}
+	return firestore.NewClient(ctx, firebaseProjectId, sa)
+}
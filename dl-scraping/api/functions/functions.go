@@ -4,22 +4,17 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"regexp"
-	"strconv"
-	"sync"
+	"time"
 
-	"cloud.google.com/go/firestore"
-	"cloud.google.com/go/storage"
+	"asa-o.net/dl-scraping/functions/parser"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
-	"github.com/gocolly/colly"
 	"github.com/joho/godotenv"
-	"google.golang.org/api/option"
 )
 
 type Response struct {
@@ -27,12 +22,36 @@ type Response struct {
 	DlSecKey  string       `json:"dlSecKey"`
 	Effects   []EffectInfo `json:"effects"`
 	IsNext    bool         `json:"isNext"`
+
+	// allモードの場合のみ
+	Total     int          `json:"total,omitempty"`
+	Pages     []PageTiming `json:"pages,omitempty"`
+	Truncated bool         `json:"truncated,omitempty"`
+
+	// 取得し直せずに保存済みのスナップショットを返した場合のみ
+	Cached    bool       `json:"cached,omitempty"`
+	ScrapedAt *time.Time `json:"scrapedAt,omitempty"`
 }
 
 type EffectInfo struct {
 	Name   string
 	Id     string
 	HashId string
+	// TagEffectsでタグ付けした場合のみ
+	Tags *EffectTags `json:",omitempty" firestore:"-"`
+}
+
+// toEffectInfos はパーサーの結果をレスポンス用の型に変換する
+func toEffectInfos(effects []parser.Effect) []EffectInfo {
+	infos := make([]EffectInfo, 0, len(effects))
+	for _, effect := range effects {
+		infos = append(infos, EffectInfo{
+			Name:   effect.Name,
+			Id:     effect.Id,
+			HashId: effect.HashId,
+		})
+	}
+	return infos
 }
 
 type RequestInfo struct {
@@ -40,95 +59,36 @@ type RequestInfo struct {
 	Page        int    `json:"page"`
 	MailAddress string `json:"mailAddress"`
 	Password    string `json:"password"`
+	// trueの場合はPageを無視して全ページを取得する
+	All         bool `json:"all"`
+	MaxPages    int  `json:"maxPages"`
+	Parallelism int  `json:"parallelism"`
+	// trueの場合は全件を取得し直し、時間内に終わらなければ保存済みの全件を返す 保存済みのものがなければallと同じ
+	Cached bool `json:"cached"`
+	// 指定した場合はタグが条件を満たすエフェクトだけを返す
+	Filter *EffectFilter `json:"filter"`
 }
 
 func init() {
 	functions.HTTP("GetEffectList", GetEffectList)
 	functions.HTTP("ChangeEffect", ChangeEffect)
 	functions.HTTP("GetEffectImage", GetEffectImage)
+	functions.HTTP("StreamEffectList", StreamEffectList)
+	functions.HTTP("EffectDiff", EffectDiff)
+	functions.HTTP("TagEffects", TagEffects)
+	functions.HTTP("SearchEffects", SearchEffects)
+	functions.HTTP("AiUsage", AiUsage)
+	functions.HTTP("AskEffects", AskEffects)
+	functions.HTTP("Chat", Chat)
+	functions.HTTP("EffectImage", EffectImage)
+	functions.HTTP("EffectImages", EffectImages)
 	functions.HTTP("Hello", Hello)
 }
 
-func extractHashId(link string) string {
-	u, err := url.Parse(link)
-	if err != nil {
-		log.Printf("Error parsing URL: %v", err)
-		return ""
-	}
-	return u.Query().Get("ti")
-}
-
-func extractIdFromImgSrc(imgSrc string) string {
-	re := regexp.MustCompile(`theme_(\d+)\.jpg`)
-	matches := re.FindStringSubmatch(imgSrc)
-	if len(matches) > 1 {
-		return matches[1]
-	}
-	return ""
-}
-
-func downloadFileFromStorage(ctx context.Context, client *storage.Client, bucketName, objectName, localFilePath string) error {
-	bucket := client.Bucket(bucketName)
-	object := bucket.Object(objectName)
-	reader, err := object.NewReader(ctx)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
-
-	file, err := os.Create(localFilePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	_, err = io.Copy(file, reader)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func downloadImageLocal(url, filepath string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	file, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func downloadImage(ctx context.Context, client *storage.Client, bucketName, url, objectName string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	bucket := client.Bucket(bucketName)
-	object := bucket.Object(objectName)
-	writer := object.NewWriter(ctx)
-	defer writer.Close()
-
-	_, err = io.Copy(writer, resp.Body)
-	if err != nil {
-		return err
-	}
-
-	return nil
+// downloadImage はurlの画像を取得してstoreにnameで保存する
+func downloadImage(ctx context.Context, store ImageStore, url, name string) error {
+	_, err := teeImage(ctx, store, url, name, io.Discard)
+	return err
 }
 
 func buildLoginUrl(mailAddress string, password string) string {
@@ -161,126 +121,57 @@ func GetEffectList(w http.ResponseWriter, r *http.Request) {
 
 	godotenv.Load()
 
-	// 秘密鍵は環境変数にbase64エンコードして格納
-	encodedServiceAccountKey := os.Getenv("SERVICE_ACCOUNT_KEY")
-	if encodedServiceAccountKey == "" {
-		http.Error(w, "Service account key is not set", http.StatusInternalServerError)
-		return
-	}
-
-	// 秘密鍵のデコード
-	serviceAccountKey, err := base64.StdEncoding.DecodeString(encodedServiceAccountKey)
+	// セッションの取得 sessionIdがなければログインする 保存済みのものを返す場合も先に認証する
+	session, account, err := authenticate(r.Context(), request.SessionId, request.MailAddress, request.Password)
 	if err != nil {
-		http.Error(w, "Failed to decode service account key", http.StatusInternalServerError)
+		log.Printf("Failed to acquire session: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
 		return
 	}
 
-	// Firestoreクライアントの初期化
-	ctx := context.Background()
-	sa := option.WithCredentialsJSON(serviceAccountKey)
-	client, err := firestore.NewClient(ctx, "asa-o-experiment", sa)
-	if err != nil {
-		log.Fatalf("Failed to create Firestore client: %v", err)
-	}
-	defer client.Close()
-
-	// Storageクライアントの初期化
-	storageClient, err := storage.NewClient(ctx, sa)
-	if err != nil {
-		log.Fatalf("Failed to create Storage client: %v", err)
-	}
-	defer storageClient.Close()
-
-	c := colly.NewCollector(
-		colly.AllowURLRevisit(),
-	)
-
-	var sessionId string
-	if request.SessionId == "" {
-		c.Visit(buildLoginUrl(request.MailAddress, request.Password))
-		cookies := c.Cookies(os.Getenv("TOP_URL"))
-		for _, cookie := range cookies {
-			fmt.Printf("Cookie: %s = %s\n", cookie.Name, cookie.Value)
-			if cookie.Name == "JSESSIONID" {
-				sessionId = cookie.Value
+	if request.Cached {
+		if response, ok := cachedCatalogResponse(r.Context(), account, session, request); ok {
+			response.Effects = withTags(r.Context(), response.Effects, request.Filter)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
+			return
 		}
-	} else {
-		sessionId = request.SessionId
-		c.OnRequest(func(r *colly.Request) {
-			r.Ctx.Put("cookie", "JSESSIONID="+sessionId)
-			r.Headers.Set("Cookie", r.Ctx.Get("cookie"))
-		})
 	}
 
-	var effects []EffectInfo
-	imgUrl := os.Getenv("EFFECT_IMAGE_URL")
-	var dlSecKey string
-	var dlSecKeyOnce sync.Once
-
-	c.OnHTML("li.item", func(e *colly.HTMLElement) {
-		info := EffectInfo{
-			Name:   e.ChildText("div.name"),
-			Id:     extractIdFromImgSrc(e.ChildAttr("img", "src")),
-			HashId: extractHashId(e.ChildAttr("a", "href")),
+	var response Response
+	if request.All || request.Cached {
+		var result *CrawlResult
+		result, err = crawlAllPages(r.Context(), session, crawlOptions(request))
+		if err == nil {
+			response = allPagesResponse(session, result)
+			if _, err := saveCatalog(r.Context(), account, result); err != nil {
+				log.Printf("Failed to save catalog: %v", err)
+			}
 		}
-		effects = append(effects, info)
-		fmt.Println(info.Name)
-
-		dlSecKeyOnce.Do(func() {
-			link := e.ChildAttr("a", "href")
-			u, _ := url.Parse(link)
-			dlSecKey = u.Query().Get("__DL__SEC__KEY__")
-		})
-
-		if false {
-			isEnableStorage := true
-			if isEnableStorage {
-				objectName := fmt.Sprintf("images/%s.jpg", info.Name)
-				err := downloadImage(ctx, storageClient, "asa-o-experiment.appspot.com", fmt.Sprintf(imgUrl, info.Id), objectName)
-				if err != nil {
-					log.Printf("Error downloading image: %v", err)
-				} else {
-					fmt.Printf("Image saved to Firebase Storage: %s\n", objectName)
-				}
-			} else {
-				imagePath := fmt.Sprintf("bin/images/%s.jpg", info.Name)
-				err := downloadImageLocal(fmt.Sprintf(imgUrl, info.Id), imagePath)
-				if err != nil {
-					log.Printf("Error downloading image: %v", err)
-				} else {
-					fmt.Printf("Image saved to %s\n", imagePath)
-				}
+	} else {
+		var page *parser.EffectListPage
+		page, err = fetchEffectListPage(session, request.Page)
+		if err == nil {
+			response = Response{
+				SessionId: session.SessionId(),
+				DlSecKey:  page.DlSecKey,
+				Effects:   toEffectInfos(page.Effects),
+				IsNext:    page.HasNext,
 			}
 		}
-	})
-	var pagerNextExists bool
-	c.OnHTML("li.pagerNext", func(e *colly.HTMLElement) {
-		pagerNextExists = true
-	})
-
-	c.OnError(func(_ *colly.Response, err error) {
-		log.Fatalf("Error fetching URL: %v", err)
-	})
-
-	c.Visit(os.Getenv("EFFECT_LIST_URL") + strconv.Itoa(request.Page))
-
-	response := Response{
-		SessionId: sessionId,
-		DlSecKey:  dlSecKey,
-		Effects:   effects,
-		IsNext:    pagerNextExists,
 	}
-
-	// // firestoreへの書き込み
-	// _, _, err = client.Collection("effects").Add(ctx, map[string]interface{}{
-	// 	"seccionId": response.SessionId,
-	// 	"dlSecKey":  response.DlSecKey,
-	// 	"effects":   response.Effects,
-	// })
-	// if err != nil {
-	// 	log.Fatalf("Failed adding data to Firestore: %v", err)
-	// }
+	if errors.Is(err, ErrSessionExpired) {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching effect list: %v", err)
+		http.Error(w, "Failed to fetch effect list", http.StatusBadGateway)
+		return
+	}
+	response.Effects = withTags(r.Context(), response.Effects, request.Filter)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -318,72 +209,37 @@ func GetEffectImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encodedServiceAccountKey := os.Getenv("SERVICE_ACCOUNT_KEY")
-	if encodedServiceAccountKey == "" {
-		http.Error(w, "Service account key is not set", http.StatusInternalServerError)
-		return
-	}
+	godotenv.Load()
 
-	serviceAccountKey, err := base64.StdEncoding.DecodeString(encodedServiceAccountKey)
+	store, err := getImageStore()
 	if err != nil {
-		http.Error(w, "Failed to decode service account key", http.StatusInternalServerError)
+		log.Printf("Failed to open image store: %v", err)
+		http.Error(w, "Failed to open image store", http.StatusInternalServerError)
 		return
 	}
 
-	// Storageクライアントの初期化
-	ctx := context.Background()
-	sa := option.WithCredentialsJSON(serviceAccountKey)
-	storageClient, err := storage.NewClient(ctx, sa)
+	// storageにあればそれを返す なければダウンロードして返し、storageに保存
+	reader, _, err := openEffectImage(r.Context(), store, request.EffectId)
+	if errors.Is(err, ErrInvalidEffectId) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrUpstreamImage) {
+		log.Printf("Failed to download image: %v", err)
+		http.Error(w, "Failed to download image", http.StatusBadGateway)
+		return
+	}
 	if err != nil {
-		log.Fatalf("Failed to create Storage client: %v", err)
+		log.Printf("Failed to read image: %v", err)
+		http.Error(w, "Failed to read image", http.StatusInternalServerError)
+		return
 	}
-	defer storageClient.Close()
-
-	// storageにあればそれを返す なければダウンロードして返し、storageに保存
-	objectName := fmt.Sprintf("images/%s.jpg", request.EffectId)
-	bucket := storageClient.Bucket("asa-o-experiment.appspot.com")
-	object := bucket.Object(objectName)
-
-	var imageData []byte
-	// ファイルが存在するかチェック
-	_, err = object.Attrs(ctx)
-	if err == nil {
-		reader, err := object.NewReader(ctx)
-		if err != nil {
-			http.Error(w, "Failed to read existing image", http.StatusInternalServerError)
-			return
-		}
-		defer reader.Close()
-
-		imageData, err = io.ReadAll(reader)
-		if err != nil {
-			http.Error(w, "Failed to read image data", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		url := fmt.Sprintf(os.Getenv("EFFECT_IMAGE_URL"), request.EffectId)
-
-		resp, err := http.Get(url)
-		if err != nil {
-			http.Error(w, "download error", http.StatusForbidden)
-			return
-		}
-		defer resp.Body.Close()
-
-		writer := object.NewWriter(ctx)
-		defer writer.Close()
-
-		_, err = io.Copy(writer, resp.Body)
-		if err != nil {
-			http.Error(w, "Failed Download Image", http.StatusInternalServerError)
-			return
-		}
+	defer reader.Close()
 
-		imageData, err = io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "Failed to read image data", http.StatusInternalServerError)
-			return
-		}
+	imageData, err := io.ReadAll(reader)
+	if err != nil {
+		http.Error(w, "Failed to read image data", http.StatusInternalServerError)
+		return
 	}
 
 	encodedImage := base64.StdEncoding.EncodeToString(imageData)
@@ -433,42 +289,34 @@ func ChangeEffect(w http.ResponseWriter, r *http.Request) {
 
 	godotenv.Load()
 
-	c := colly.NewCollector(
-		colly.AllowURLRevisit(),
-	)
-
-	sessionId := request.SessionId
-	c.OnRequest(func(r *colly.Request) {
-		r.Ctx.Put("cookie", "JSESSIONID="+sessionId)
-		r.Headers.Set("Cookie", r.Ctx.Get("cookie"))
-	})
+	pageParser, err := getPageParser()
+	if err != nil {
+		http.Error(w, "Failed to load page parser", http.StatusInternalServerError)
+		return
+	}
 
+	succeed := false
+	sessionId := ""
 	dlSecKey := ""
-	c.OnHTML("div.dfultSlct", func(e *colly.HTMLElement) {
-		link := e.ChildAttr("a", "href")
-		u, _ := url.Parse(link)
-		dlSecKey = u.Query().Get("__DL__SEC__KEY__")
-	})
-
-	succeed := true
-	c.OnHTML("div#error", func(e *colly.HTMLElement) {
+
+	session, err := sessionManager.Acquire(r.Context(), request.SessionId, "", "")
+	if err == nil {
+		var body []byte
+		body, err = sessionManager.Fetch(session, fmt.Sprintf(os.Getenv("CHANGE_URL"), request.HashId, 0, request.DlSecKey))
+		if err == nil {
+			var page *parser.ChangePage
+			page, err = pageParser.ParseChangeResult(body)
+			if err == nil {
+				succeed = true
+				sessionId = session.SessionId()
+				dlSecKey = page.DlSecKey
+			}
+		}
+	}
+	if err != nil {
 		// セッションが切れている場合はエラーを返す
-		log.Print("Session expired")
-		sessionId = ""
-		dlSecKey = ""
-		succeed = false
-	})
-
-	// // レスポンスの内容をすべてログに出力
-	// c.OnResponse(func(r *colly.Response) {
-	// 	log.Printf("Response received: %s", string(r.Body))
-	// })
-
-	c.OnError(func(_ *colly.Response, err error) {
-		log.Printf("Error fetching URL: %v", err)
-	})
-
-	c.Visit(fmt.Sprintf(os.Getenv("CHANGE_URL"), request.HashId, 0, request.DlSecKey))
+		log.Printf("Failed to change effect: %v", err)
+	}
 
 	response := ResponseChangeEffect{
 		Succeed:   succeed,
@@ -1,23 +1,174 @@
 package functions
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"asa-o.net/dl-scraping/functions/fakeupstream"
 	"cloud.google.com/go/storage"
-	"github.com/joho/godotenv"
+	"google.golang.org/api/option"
 )
 
+const (
+	testMailAddress = "test@example.com"
+	testPassword    = "password"
+)
+
+var testEffects = []fakeupstream.Effect{
+	{Id: "1", Name: "朝顔", HashId: "hash1"},
+	{Id: "2", Name: "花火", HashId: "hash2"},
+	{Id: "3", Name: "紅葉", HashId: "hash3"},
+}
+
+// setupFakeUpstream は偽の上流サイトを起動し、環境変数をそこに向ける
+func setupFakeUpstream(t *testing.T) *fakeupstream.Server {
+	t.Helper()
+	upstream := fakeupstream.New(testMailAddress, testPassword, testEffects)
+	t.Cleanup(upstream.Close)
+	for key, value := range upstream.Env() {
+		t.Setenv(key, value)
+	}
+	// .envにサービスアカウントがあっても保存先はメモリにする
+	t.Setenv("CATALOG_STORE", "memory")
+	useMemoryImages(t)
+	useMemorySessions(t)
+	// 前のテストの偽サイトでログインしたセッションを使い回さない
+	previous := sessionManager
+	sessionManager = NewSessionManager()
+	t.Cleanup(func() {
+		sessionManager = previous
+	})
+	return upstream
+}
+
+// useMemorySessions はセッションの保存先をテストごとに空のメモリにする
+func useMemorySessions(t *testing.T) *MemorySessionRepository {
+	t.Helper()
+	repository := NewMemorySessionRepository()
+
+	getSessionRepository()
+	previous, previousErr := sessionRepository, sessionRepositoryErr
+	sessionRepository, sessionRepositoryErr = repository, nil
+	t.Cleanup(func() {
+		sessionRepository, sessionRepositoryErr = previous, previousErr
+	})
+	return repository
+}
+
+// fakeStorage はStorageのJSON APIのうち、アップロードだけを受け付ける偽物
+type fakeStorage struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeStorage(t *testing.T) *fakeStorage {
+	t.Helper()
+	fs := &fakeStorage{objects: make(map[string][]byte)}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.handleUpload))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+func (fs *fakeStorage) handleUpload(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != http.MethodPost || name == "" || err != nil {
+		http.Error(w, "unsupported", http.StatusBadRequest)
+		return
+	}
+
+	// 1つ目のパートはメタデータ、2つ目が本体
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	if _, err := reader.NextPart(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	media, err := reader.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, _ := io.ReadAll(media)
+
+	fs.mu.Lock()
+	fs.objects[name] = data
+	fs.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "bucket": "test-bucket", "size": strconv.Itoa(len(data))})
+}
+
+func (fs *fakeStorage) object(name string) []byte {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.objects[name]
+}
+
+func postGetEffectList(t *testing.T, request RequestInfo) (*httptest.ResponseRecorder, Response) {
+	t.Helper()
+	bodyJSON, _ := json.Marshal(request)
+	response := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(bodyJSON))
+
+	GetEffectList(response, req)
+
+	var res Response
+	if response.Code == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return response, res
+}
+
+func postChangeEffect(t *testing.T, request RequestChangeEffect) ResponseChangeEffect {
+	t.Helper()
+	bodyJSON, _ := json.Marshal(request)
+	response := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(bodyJSON))
+
+	ChangeEffect(response, req)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+
+	var res ResponseChangeEffect
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return res
+}
+
 func Test_downloadImage(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	fs := newFakeStorage(t)
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithEndpoint(fs.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	store := NewGCSImageStore(client, "test-bucket")
+
 	type args struct {
 		ctx        context.Context
-		client     *storage.Client
-		bucketName string
+		store      ImageStore
 		url        string
 		objectName string
 	}
@@ -26,84 +177,406 @@ func Test_downloadImage(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			name: "upstream image is saved to storage",
+			args: args{ctx, store, upstream.URL + "/img/theme_1.jpg", "images/1.jpg"},
+		},
+		{
+			name:    "missing upstream image is not saved",
+			args:    args{ctx, store, upstream.URL + "/img/theme_404.jpg", "images/404.jpg"},
+			wantErr: true,
+		},
+		{
+			name:    "unreachable upstream",
+			args:    args{ctx, store, "http://127.0.0.1:0/img/theme_1.jpg", "images/unreachable.jpg"},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := downloadImage(tt.args.ctx, tt.args.client, tt.args.bucketName, tt.args.url, tt.args.objectName); (err != nil) != tt.wantErr {
+			if err := downloadImage(tt.args.ctx, tt.args.store, tt.args.url, tt.args.objectName); (err != nil) != tt.wantErr {
 				t.Errorf("downloadImage() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
+
+	if got := fs.object("images/1.jpg"); !bytes.Equal(got, fakeupstream.ImageData("1")) {
+		t.Errorf("stored image does not match upstream image (%d bytes)", len(got))
+	}
+	if got := fs.object("images/404.jpg"); got != nil {
+		t.Errorf("expected missing image not to be stored; got %d bytes", len(got))
+	}
 }
 
 func TestGetEffectList(t *testing.T) {
-	godotenv.Load()
-	mail := os.Getenv("TEST_MAIL_ADDRESS")
-	pass := os.Getenv("TEST_PASSWORD")
-
-	bodyJSON := `{"sessionId":"","page":1,"mailAddress":"` + mail + `","password":"` + pass + `"}`
-	response := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(bodyJSON))
+	setupFakeUpstream(t)
 
-	GetEffectList(response, req)
+	response, res := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: testPassword})
 	if response.Code != http.StatusOK {
-		t.Errorf("expected status OK; got %v", response.Code)
+		t.Fatalf("expected status OK; got %v", response.Code)
 	}
 
-	var res Response
-	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
-		return
+	if res.SessionId == "" {
+		t.Errorf("expected sessionId")
+	}
+	if res.DlSecKey == "" {
+		t.Errorf("expected dlSecKey")
+	}
+	if !res.IsNext {
+		t.Errorf("expected isNext on first page")
+	}
+	want := []EffectInfo{
+		{Name: "朝顔", Id: "1", HashId: "hash1"},
+		{Name: "花火", Id: "2", HashId: "hash2"},
+	}
+	if len(res.Effects) != len(want) {
+		t.Fatalf("got %d effects, want %d", len(res.Effects), len(want))
+	}
+	for i := range want {
+		if res.Effects[i] != want[i] {
+			t.Errorf("effects[%d] = %+v, want %+v", i, res.Effects[i], want[i])
+		}
 	}
 }
 
 func TestGetEffectList_2page(t *testing.T) {
-	godotenv.Load()
-	mail := os.Getenv("TEST_MAIL_ADDRESS")
-	pass := os.Getenv("TEST_PASSWORD")
+	setupFakeUpstream(t)
 
-	bodyJSON := `{"sessionId":"","page":1,"mailAddress":"` + mail + `","password":"` + pass + `"}`
-	response := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(bodyJSON))
+	response, res := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
 
-	GetEffectList(response, req)
+	response, next := postGetEffectList(t, RequestInfo{SessionId: res.SessionId, Page: 2})
 	if response.Code != http.StatusOK {
-		t.Errorf("expected status OK; got %v", response.Code)
+		t.Fatalf("expected status OK; got %v", response.Code)
 	}
 
-	var res Response
-	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
-		return
+	if next.IsNext {
+		t.Errorf("expected last page")
+	}
+	if len(next.Effects) != 1 || next.Effects[0].HashId != "hash3" {
+		t.Errorf("unexpected effects on page 2: %+v", next.Effects)
 	}
+}
+
+func TestGetEffectList_invalidLogin(t *testing.T) {
+	setupFakeUpstream(t)
+
+	response, _ := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: "wrong"})
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized; got %v", response.Code)
+	}
+}
 
-	nextJSON := `{"sessionId":"` + res.SessionId + `","page":2,"mailAddress":"","password":""}`
-	nextReq := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(nextJSON))
+func TestGetEffectList_expired(t *testing.T) {
+	upstream := setupFakeUpstream(t)
 
-	GetEffectList(response, nextReq)
+	response, res := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: testPassword})
 	if response.Code != http.StatusOK {
-		t.Errorf("expected status OK; got %v", response.Code)
+		t.Fatalf("expected status OK; got %v", response.Code)
 	}
 
-	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
-		return
+	upstream.ExpireSessions()
+	logins := upstream.Requests("/login")
+
+	// パスワードは持っていないので、上流で切れたセッションは切れたことを返す
+	response, _ = postGetEffectList(t, RequestInfo{SessionId: res.SessionId, Page: 2})
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status Unauthorized; got %v", response.Code)
+	}
+	if upstream.Requests("/login") != logins {
+		t.Errorf("expected no relogin without credentials")
+	}
+
+	// 認証情報を送り直せばログインし直して続けられる
+	response, next := postGetEffectList(t, RequestInfo{Page: 2, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if next.SessionId == res.SessionId {
+		t.Errorf("expected a new sessionId after login")
+	}
+	if upstream.Requests("/login") != logins+1 {
+		t.Errorf("expected one login; got %d", upstream.Requests("/login")-logins)
 	}
 
+	// 発行していないセッションは切れたことを返す
+	response, _ = postGetEffectList(t, RequestInfo{SessionId: "unknown-session", Page: 1})
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized; got %v", response.Code)
+	}
+}
+
+func TestSessionManager_eviction(t *testing.T) {
+	setupFakeUpstream(t)
+	t.Setenv("SESSION_TTL_MS", "50")
+	manager := NewSessionManager()
+	ctx := context.Background()
+
+	// 発行していないIDは認証情報がなければ受け付けず、登録もしない
+	if _, err := manager.Acquire(ctx, "client-made-id", "", ""); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("expected ErrSessionExpired for unknown id; got %v", err)
+	}
+	if len(manager.sessions) != 0 {
+		t.Errorf("expected no sessions; got %d", len(manager.sessions))
+	}
+
+	session, err := manager.Acquire(ctx, "", testMailAddress, testPassword)
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	if s, ok := manager.Lookup(session.SessionId()); !ok || s != session {
+		t.Fatalf("expected session to be registered")
+	}
+
+	// 使われないまま期限を過ぎたセッションは捨てる
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := manager.Lookup(session.SessionId()); ok {
+		t.Errorf("expected expired session to be evicted")
+	}
+	if len(manager.sessions) != 0 || len(manager.accounts) != 0 {
+		t.Errorf("expected no sessions after eviction; got %d %d", len(manager.sessions), len(manager.accounts))
+	}
+	// 保存先の記録も同じ期限で切れる
+	if _, err := manager.Acquire(ctx, session.SessionId(), "", ""); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("expected ErrSessionExpired after ttl; got %v", err)
+	}
+}
+
+func TestSessionManager_restore(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	ctx := context.Background()
+
+	session, err := NewSessionManager().Acquire(ctx, "", testMailAddress, testPassword)
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+
+	// 別のインスタンスでもセッションIDだけで続けられる
+	manager := NewSessionManager()
+	restored, err := manager.Acquire(ctx, session.SessionId(), "", "")
+	if err != nil {
+		t.Fatalf("failed to restore session: %v", err)
+	}
+	if restored.Account != session.Account || restored.SessionId() != session.SessionId() {
+		t.Errorf("unexpected restored session: %q %q", restored.Account, restored.SessionId())
+	}
+	if _, err := manager.Fetch(restored, upstream.Env()["EFFECT_LIST_URL"]+"1"); err != nil {
+		t.Fatalf("failed to fetch with restored session: %v", err)
+	}
+
+	// 上流で切れていればエラーページで気付き、記録も消す
+	upstream.ExpireSessions()
+	if _, err := manager.Fetch(restored, upstream.Env()["EFFECT_LIST_URL"]+"1"); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("expected ErrSessionExpired; got %v", err)
+	}
+	if _, err := NewSessionManager().Acquire(ctx, session.SessionId(), "", ""); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("expected forgotten session to be rejected; got %v", err)
+	}
 }
 
 func TestChangeEffect(t *testing.T) {
-	godotenv.Load()
+	upstream := setupFakeUpstream(t)
 
-	bodyJSON := `{"sessionId":"","hashId":"1","dlSecKey":"1"}`
-	response := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(bodyJSON))
+	res := postChangeEffect(t, RequestChangeEffect{SessionId: "", HashId: "1", DlSecKey: "1"})
+	if res.Succeed {
+		t.Errorf("expected failure without session")
+	}
 
-	ChangeEffect(response, req)
+	response, list := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: testPassword})
 	if response.Code != http.StatusOK {
-		t.Errorf("expected status OK; got %v", response.Code)
+		t.Fatalf("expected status OK; got %v", response.Code)
 	}
 
-	var res Response
-	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
-		return
+	res = postChangeEffect(t, RequestChangeEffect{SessionId: list.SessionId, HashId: "hash2", DlSecKey: list.DlSecKey})
+	if !res.Succeed {
+		t.Fatalf("expected change to succeed")
+	}
+	if upstream.Selected() != "hash2" {
+		t.Errorf("selected = %q, want %q", upstream.Selected(), "hash2")
+	}
+	if res.DlSecKey == "" || res.DlSecKey == list.DlSecKey {
+		t.Errorf("expected a renewed dlSecKey; got %q", res.DlSecKey)
+	}
+
+	// 更新されたdlSecKeyで続けて変更できる
+	res = postChangeEffect(t, RequestChangeEffect{SessionId: res.SessionId, HashId: "hash1", DlSecKey: res.DlSecKey})
+	if !res.Succeed || upstream.Selected() != "hash1" {
+		t.Errorf("expected second change to succeed; got %+v selected=%q", res, upstream.Selected())
+	}
+
+	// 古いdlSecKeyは拒否される
+	res = postChangeEffect(t, RequestChangeEffect{SessionId: res.SessionId, HashId: "hash3", DlSecKey: "stale"})
+	if res.Succeed || strings.Contains(upstream.Selected(), "hash3") {
+		t.Errorf("expected change with stale dlSecKey to fail; got %+v", res)
+	}
+}
+
+func TestGetEffectList_all(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	// ページをまたいで同じエフェクトが出てきても1件にまとめる
+	upstream.SetEffects(append(append([]fakeupstream.Effect{}, testEffects...), testEffects[0]))
+
+	response, res := postGetEffectList(t, RequestInfo{All: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Total != 3 || len(res.Effects) != 3 {
+		t.Errorf("total = %d, effects = %d; want 3", res.Total, len(res.Effects))
+	}
+	if len(res.Pages) != 2 {
+		t.Errorf("got %d pages, want 2", len(res.Pages))
+	}
+	if res.IsNext || res.Truncated {
+		t.Errorf("expected complete catalog")
+	}
+
+	response, res = postGetEffectList(t, RequestInfo{All: true, MaxPages: 1, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if !res.Truncated || res.Total != 2 {
+		t.Errorf("expected truncated result with 2 effects; got truncated=%v total=%d", res.Truncated, res.Total)
+	}
+}
+
+func TestGetEffectList_allParallel(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	t.Setenv("EFFECT_LIST_JITTER_MS", "0")
+
+	var effects []fakeupstream.Effect
+	for i := 1; i <= 9; i++ {
+		id := strconv.Itoa(i)
+		effects = append(effects, fakeupstream.Effect{Id: id, Name: "effect" + id, HashId: "hash" + id})
+	}
+	upstream.SetEffects(effects)
+
+	// リクエストの並列数は環境変数の値までしか上げられない
+	t.Setenv("EFFECT_LIST_PARALLELISM", "3")
+	if options := crawlOptions(RequestInfo{Parallelism: 8}); options.Parallelism != 3 {
+		t.Errorf("parallelism = %d, want 3", options.Parallelism)
+	}
+
+	response, res := postGetEffectList(t, RequestInfo{All: true, Parallelism: 3, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Total != len(effects) {
+		t.Fatalf("total = %d, want %d", res.Total, len(effects))
+	}
+	// 並列に取得してもページ順に並ぶ
+	for i, effect := range res.Effects {
+		if effect.HashId != effects[i].HashId {
+			t.Errorf("effects[%d] = %q, want %q", i, effect.HashId, effects[i].HashId)
+		}
+	}
+	for i, page := range res.Pages {
+		if page.Page != i+1 {
+			t.Errorf("pages[%d].Page = %d, want %d", i, page.Page, i+1)
+		}
+	}
+	if len(res.Pages) != 5 {
+		t.Errorf("got %d pages, want 5", len(res.Pages))
+	}
+}
+
+func Test_crawlAllPages_slowOnPage(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	t.Setenv("EFFECT_LIST_JITTER_MS", "0")
+	var effects []fakeupstream.Effect
+	for i := 1; i <= 9; i++ {
+		id := strconv.Itoa(i)
+		effects = append(effects, fakeupstream.Effect{Id: id, Name: "effect" + id, HashId: "hash" + id})
+	}
+	upstream.SetEffects(effects)
+
+	session, _, err := authenticate(context.Background(), "", testMailAddress, testPassword)
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	requests := upstream.Requests("/list")
+
+	// 書き込みが止まっていても残りのページは取得する
+	release := make(chan struct{})
+	var calls atomic.Int32
+	options := CrawlOptions{MaxPages: 10, Parallelism: 2, OnPage: func(event PageEvent) {
+		calls.Add(1)
+		<-release
+	}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := crawlAllPages(context.Background(), session, options)
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for upstream.Requests("/list")-requests < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	fetched := upstream.Requests("/list") - requests
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("failed to crawl: %v", err)
+	}
+	if fetched < 5 {
+		t.Errorf("expected all pages to be fetched while OnPage was blocked; got %d", fetched)
+	}
+	if calls.Load() < 5 {
+		t.Errorf("expected OnPage for every page; got %d calls", calls.Load())
+	}
+}
+
+func Test_appendUniqueEffects(t *testing.T) {
+	seen := make(map[string]bool)
+	effects := appendUniqueEffects(nil, seen, []EffectInfo{
+		{Id: "1", HashId: "hash1"},
+		{Id: "2"},
+		{HashId: "hash3"},
+		{Name: "unknown1"},
+	})
+	effects = appendUniqueEffects(effects, seen, []EffectInfo{
+		{Id: "1", HashId: "hash1"},
+		{Id: "2", HashId: "hash2"},
+		{HashId: "hash3"},
+		{Name: "unknown2"},
+	})
+	// IdもHashIdも取れなかったものは重複として除かない
+	if len(effects) != 5 || effects[3].Name != "unknown1" || effects[4].Name != "unknown2" {
+		t.Errorf("unexpected effects: %+v", effects)
+	}
+}
+
+func Test_crawlOptions_maxPages(t *testing.T) {
+	t.Setenv("EFFECT_LIST_MAX_PAGES", "0")
+	if options := crawlOptions(RequestInfo{}); options.MaxPages != defaultMaxPages {
+		t.Errorf("maxPages = %d, want %d", options.MaxPages, defaultMaxPages)
+	}
+	t.Setenv("EFFECT_LIST_MAX_PAGES", "10")
+	if options := crawlOptions(RequestInfo{MaxPages: 3}); options.MaxPages != 3 {
+		t.Errorf("maxPages = %d, want 3", options.MaxPages)
+	}
+}
+
+func Test_domainLimiter(t *testing.T) {
+	limiter := limiterFor("http://limiter.example.com/list", 20*time.Millisecond, 0)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.Wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected requests to be spaced out; took %v", elapsed)
+	}
+
+	// キャンセルされたら待たずに戻る
+	slow := limiterFor("http://slow.example.com/list", time.Hour, 0)
+	slow.Wait(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := slow.Wait(ctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled; got %v", err)
 	}
 }
@@ -0,0 +1,468 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	// 画像を保存するバケットの既定値
+	defaultImageBucket = "asa-o-experiment.appspot.com"
+	// ローカルに保存する場合のディレクトリの既定値
+	defaultImageDir = "bin/images"
+)
+
+var (
+	ErrImageNotFound = errors.New("image not found")
+	// 署名付きURLを発行できない保存先の場合
+	ErrSignedUrlUnsupported = errors.New("signed url is not supported")
+)
+
+// ImageInfo は保存した画像の情報
+type ImageInfo struct {
+	Name        string
+	ContentType string
+	Size        int64
+	UpdatedAt   time.Time
+	// 内容が変わると変わる値 HTTPのETagに使う
+	ETag string
+}
+
+// ImageStore はエフェクトの画像の保存先 名前は"images/123.jpg"のような/区切りのパス
+type ImageStore interface {
+	// Get は画像を読むReaderを返す 使い終わったらCloseする なければErrImageNotFound
+	Get(ctx context.Context, name string) (io.ReadCloser, *ImageInfo, error)
+	// Put はrの内容を保存して、保存した画像の情報を返す
+	// rが途中で失敗した場合は書きかけのものを残さず、前の内容もそのまま残す
+	Put(ctx context.Context, name string, contentType string, r io.Reader) (*ImageInfo, error)
+	Exists(ctx context.Context, name string) (bool, error)
+	// Delete は画像を消す なければErrImageNotFound
+	Delete(ctx context.Context, name string) error
+	// List はprefixで始まる画像を名前の順に返す
+	List(ctx context.Context, prefix string) ([]ImageInfo, error)
+	// SignedURL は期限付きで直接読めるURLを返す 対応していない保存先はErrSignedUrlUnsupported
+	SignedURL(ctx context.Context, name string, expires time.Duration) (string, error)
+}
+
+// effectImageName はエフェクトのサムネイルを保存する名前
+func effectImageName(effectId string) string {
+	return fmt.Sprintf("images/%s.jpg", effectId)
+}
+
+// imageContentType は拡張子から画像の種類を決める
+func imageContentType(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+var (
+	imageStoreOnce sync.Once
+	imageStore     ImageStore
+	imageStoreErr  error
+)
+
+// getImageStore は環境変数IMAGE_STOREで選んだ保存先を返す
+// gcs, local, memoryのいずれか 未指定の場合はgcs
+// Cloud Functionsではローカルのディレクトリに書き込めないため、localは明示した場合だけ使う
+// gcsはSERVICE_ACCOUNT_KEYがあればそのサービスアカウント、なければアプリケーションのデフォルト認証情報で接続する
+// gcsのバケットはIMAGE_BUCKET、localのディレクトリはIMAGE_DIRで変えられる
+func getImageStore() (ImageStore, error) {
+	imageStoreOnce.Do(func() {
+		store := os.Getenv("IMAGE_STORE")
+		if store == "" {
+			store = "gcs"
+		}
+		switch store {
+		case "gcs":
+			var options []option.ClientOption
+			if os.Getenv("SERVICE_ACCOUNT_KEY") != "" {
+				sa, err := serviceAccountOption()
+				if err != nil {
+					imageStoreErr = err
+					return
+				}
+				options = append(options, sa)
+			}
+			client, err := storage.NewClient(context.Background(), options...)
+			if err != nil {
+				imageStoreErr = err
+				return
+			}
+			bucket := os.Getenv("IMAGE_BUCKET")
+			if bucket == "" {
+				bucket = defaultImageBucket
+			}
+			imageStore = NewGCSImageStore(client, bucket)
+		case "local":
+			dir := os.Getenv("IMAGE_DIR")
+			if dir == "" {
+				dir = defaultImageDir
+			}
+			imageStore = NewLocalImageStore(dir)
+		case "memory":
+			imageStore = NewMemoryImageStore()
+		default:
+			imageStoreErr = errors.New("unknown image store: " + store)
+		}
+	})
+	return imageStore, imageStoreErr
+}
+
+// GCSImageStore はCloud Storageのバケットに保存する
+type GCSImageStore struct {
+	client *storage.Client
+	bucket string
+}
+
+func NewGCSImageStore(client *storage.Client, bucket string) *GCSImageStore {
+	return &GCSImageStore{client: client, bucket: bucket}
+}
+
+func (s *GCSImageStore) Get(ctx context.Context, name string) (io.ReadCloser, *ImageInfo, error) {
+	reader, err := s.client.Bucket(s.bucket).Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, &ImageInfo{
+		Name:        name,
+		ContentType: reader.Attrs.ContentType,
+		Size:        reader.Attrs.Size,
+		UpdatedAt:   reader.Attrs.LastModified,
+		ETag:        strconv.FormatInt(reader.Attrs.Generation, 10),
+	}, nil
+}
+
+func (s *GCSImageStore) Put(ctx context.Context, name string, contentType string, r io.Reader) (*ImageInfo, error) {
+	// 途中で失敗した場合はコンテキストを取り消して、アップロードを確定させない
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := s.client.Bucket(s.bucket).Object(name).NewWriter(ctx)
+	writer.ContentType = contentType
+	if _, err := io.Copy(writer, r); err != nil {
+		cancel()
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	attrs := writer.Attrs()
+	return &ImageInfo{
+		Name:        name,
+		ContentType: contentType,
+		Size:        attrs.Size,
+		UpdatedAt:   attrs.Updated,
+		ETag:        strconv.FormatInt(attrs.Generation, 10),
+	}, nil
+}
+
+func (s *GCSImageStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.client.Bucket(s.bucket).Object(name).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *GCSImageStore) Delete(ctx context.Context, name string) error {
+	err := s.client.Bucket(s.bucket).Object(name).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+func (s *GCSImageStore) List(ctx context.Context, prefix string) ([]ImageInfo, error) {
+	iter := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	var images []ImageInfo
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, ImageInfo{
+			Name:        attrs.Name,
+			ContentType: attrs.ContentType,
+			Size:        attrs.Size,
+			UpdatedAt:   attrs.Updated,
+			ETag:        strconv.FormatInt(attrs.Generation, 10),
+		})
+	}
+	return images, nil
+}
+
+// SignedURL はV4署名のURLを返す 署名にはクライアントのサービスアカウントの秘密鍵を使う
+func (s *GCSImageStore) SignedURL(ctx context.Context, name string, expires time.Duration) (string, error) {
+	return s.client.Bucket(s.bucket).SignedURL(name, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(expires),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+// LocalImageStore はローカルのディレクトリに保存する 開発用
+type LocalImageStore struct {
+	dir string
+}
+
+func NewLocalImageStore(dir string) *LocalImageStore {
+	return &LocalImageStore{dir: dir}
+}
+
+// path は名前をディレクトリの中のパスにする ディレクトリの外を指す名前はエラー
+func (s *LocalImageStore) path(name string) (string, error) {
+	if name == "" || !fs.ValidPath(name) {
+		return "", fmt.Errorf("invalid image name: %q", name)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+func (s *LocalImageStore) Get(ctx context.Context, name string) (io.ReadCloser, *ImageInfo, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, localImageInfo(name, stat), nil
+}
+
+// Put は一時ファイルに書いてから名前を変えるので、読む側に書きかけのファイルが見えない
+func (s *LocalImageStore) Put(ctx context.Context, name string, contentType string, r io.Reader) (*ImageInfo, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return localImageInfo(name, stat), nil
+}
+
+func (s *LocalImageStore) Exists(ctx context.Context, name string) (bool, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *LocalImageStore) Delete(ctx context.Context, name string) error {
+	filePath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+func (s *LocalImageStore) List(ctx context.Context, prefix string) ([]ImageInfo, error) {
+	var images []ImageInfo
+	err := filepath.WalkDir(s.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && filePath == s.dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		// 書き込み中の一時ファイルは含めない
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+		relative, err := filepath.Rel(s.dir, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relative)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		images = append(images, *localImageInfo(name, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// localImageInfo はファイルの情報から画像の情報を作る ETagは更新日時と大きさから作る
+func localImageInfo(name string, stat fs.FileInfo) *ImageInfo {
+	return &ImageInfo{
+		Name:        name,
+		ContentType: imageContentType(name),
+		Size:        stat.Size(),
+		UpdatedAt:   stat.ModTime(),
+		ETag:        fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
+
+func (s *LocalImageStore) SignedURL(ctx context.Context, name string, expires time.Duration) (string, error) {
+	return "", ErrSignedUrlUnsupported
+}
+
+// MemoryImageStore はメモリ上に保存する テスト用
+type MemoryImageStore struct {
+	mu     sync.Mutex
+	images map[string]memoryImage
+}
+
+type memoryImage struct {
+	data        []byte
+	contentType string
+	updatedAt   time.Time
+	etag        string
+}
+
+func (image memoryImage) info(name string) ImageInfo {
+	return ImageInfo{
+		Name:        name,
+		ContentType: image.contentType,
+		Size:        int64(len(image.data)),
+		UpdatedAt:   image.updatedAt,
+		ETag:        image.etag,
+	}
+}
+
+func NewMemoryImageStore() *MemoryImageStore {
+	return &MemoryImageStore{images: make(map[string]memoryImage)}
+}
+
+func (s *MemoryImageStore) Get(ctx context.Context, name string) (io.ReadCloser, *ImageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image, ok := s.images[name]
+	if !ok {
+		return nil, nil, ErrImageNotFound
+	}
+	info := image.info(name)
+	return io.NopCloser(bytes.NewReader(image.data)), &info, nil
+}
+
+func (s *MemoryImageStore) Put(ctx context.Context, name string, contentType string, r io.Reader) (*ImageInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := sha256.Sum256(data)
+	image := memoryImage{data: data, contentType: contentType, updatedAt: time.Now(), etag: hex.EncodeToString(sum[:8])}
+	s.images[name] = image
+	info := image.info(name)
+	return &info, nil
+}
+
+func (s *MemoryImageStore) Exists(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.images[name]
+	return ok, nil
+}
+
+func (s *MemoryImageStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.images[name]; !ok {
+		return ErrImageNotFound
+	}
+	delete(s.images, name)
+	return nil
+}
+
+func (s *MemoryImageStore) List(ctx context.Context, prefix string) ([]ImageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var images []ImageInfo
+	for name, image := range s.images {
+		if strings.HasPrefix(name, prefix) {
+			images = append(images, image.info(name))
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+func (s *MemoryImageStore) SignedURL(ctx context.Context, name string, expires time.Duration) (string, error) {
+	return "", ErrSignedUrlUnsupported
+}
@@ -0,0 +1,255 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+// useMemoryImages はテストの間だけメモリ上の画像の保存先を使う
+func useMemoryImages(t *testing.T) *MemoryImageStore {
+	t.Helper()
+	store := NewMemoryImageStore()
+
+	getImageStore()
+	previous, previousErr := imageStore, imageStoreErr
+	imageStore, imageStoreErr = store, nil
+	t.Cleanup(func() {
+		imageStore, imageStoreErr = previous, previousErr
+	})
+	return store
+}
+
+// failingReader はnバイトを返したあとで失敗する
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func TestImageStore(t *testing.T) {
+	stores := map[string]ImageStore{
+		"local":  NewLocalImageStore(filepath.Join(t.TempDir(), "images")),
+		"memory": NewMemoryImageStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if images, err := store.List(ctx, ""); err != nil || len(images) != 0 {
+				t.Fatalf("expected empty store; got %v, %v", images, err)
+			}
+			if _, _, err := store.Get(ctx, "images/1.jpg"); !errors.Is(err, ErrImageNotFound) {
+				t.Errorf("expected ErrImageNotFound; got %v", err)
+			}
+
+			for _, name := range []string{"images/1.jpg", "images/2.jpg", "thumbnails/1.jpg"} {
+				info, err := store.Put(ctx, name, "image/jpeg", strings.NewReader("data of "+name))
+				if err != nil {
+					t.Fatalf("Put(%q) error = %v", name, err)
+				}
+				if info.Name != name || info.Size != int64(len("data of "+name)) || info.ETag == "" {
+					t.Errorf("unexpected info from Put(%q): %+v", name, info)
+				}
+			}
+			reader, info, err := store.Get(ctx, "images/1.jpg")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			data, _ := io.ReadAll(reader)
+			reader.Close()
+			if string(data) != "data of images/1.jpg" || info.ContentType != "image/jpeg" || info.Size != int64(len(data)) || info.UpdatedAt.IsZero() {
+				t.Errorf("unexpected image %q: %+v", data, info)
+			}
+			if ok, err := store.Exists(ctx, "images/2.jpg"); !ok || err != nil {
+				t.Errorf("expected images/2.jpg to exist; got %v, %v", ok, err)
+			}
+
+			images, err := store.List(ctx, "images/")
+			if err != nil || len(images) != 2 || images[0].Name != "images/1.jpg" || images[1].Name != "images/2.jpg" {
+				t.Errorf("unexpected list: %+v, %v", images, err)
+			}
+
+			// 途中で失敗した書き込みは前の内容を残す
+			if _, err := store.Put(ctx, "images/1.jpg", "image/jpeg", &failingReader{n: 3}); err == nil {
+				t.Error("expected error from failing reader")
+			}
+			reader, _, _ = store.Get(ctx, "images/1.jpg")
+			data, _ = io.ReadAll(reader)
+			reader.Close()
+			if string(data) != "data of images/1.jpg" {
+				t.Errorf("expected previous image after failed put; got %q", data)
+			}
+
+			if err := store.Delete(ctx, "images/2.jpg"); err != nil {
+				t.Errorf("Delete() error = %v", err)
+			}
+			if ok, _ := store.Exists(ctx, "images/2.jpg"); ok {
+				t.Error("expected images/2.jpg to be deleted")
+			}
+			if err := store.Delete(ctx, "images/2.jpg"); !errors.Is(err, ErrImageNotFound) {
+				t.Errorf("expected ErrImageNotFound; got %v", err)
+			}
+			if images, _ := store.List(ctx, ""); len(images) != 2 {
+				t.Errorf("expected 2 images after delete; got %+v", images)
+			}
+
+			if _, err := store.SignedURL(ctx, "images/1.jpg", time.Hour); !errors.Is(err, ErrSignedUrlUnsupported) {
+				t.Errorf("expected ErrSignedUrlUnsupported; got %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalImageStore_invalidName(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalImageStore(filepath.Join(dir, "images"))
+	for _, name := range []string{"../secret.jpg", "/etc/passwd", "images/../../secret.jpg", ""} {
+		if _, err := store.Put(context.Background(), name, "image/jpeg", strings.NewReader("x")); err == nil {
+			t.Errorf("expected error for %q", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "secret.jpg")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the directory; got %v", err)
+	}
+}
+
+func TestGetEffectImage(t *testing.T) {
+	setupFakeUpstream(t)
+	store := useMemoryImages(t)
+
+	post := func(effectId string) ResponseGetEffectImage {
+		t.Helper()
+		body, _ := json.Marshal(RequestGetEffectImage{EffectId: effectId})
+		response := httptest.NewRecorder()
+		GetEffectImage(response, httptest.NewRequest(http.MethodPost, "/get-effect-image", bytes.NewReader(body)))
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status OK; got %v", response.Code)
+		}
+		var res ResponseGetEffectImage
+		json.NewDecoder(response.Body).Decode(&res)
+		return res
+	}
+
+	// 取得した画像を返し、保存先にも残す
+	res := post("1")
+	if data, _ := base64.StdEncoding.DecodeString(res.Image); !res.Succeed || !bytes.Equal(data, fakeupstream.ImageData("1")) {
+		t.Errorf("expected upstream image on the first request; got %d bytes", len(data))
+	}
+	reader, _, err := store.Get(context.Background(), "images/1.jpg")
+	if err != nil {
+		t.Fatalf("expected downloaded image to be stored; got %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(data, fakeupstream.ImageData("1")) {
+		t.Errorf("stored image does not match upstream image (%d bytes)", len(data))
+	}
+
+	// 保存先にあればそれを返す
+	store.Put(context.Background(), "images/1.jpg", "image/jpeg", bytes.NewReader([]byte("stored")))
+	res = post("1")
+	if data, _ := base64.StdEncoding.DecodeString(res.Image); !res.Succeed || string(data) != "stored" {
+		t.Errorf("expected stored image; got %+v", res)
+	}
+}
+
+func TestGetEffectImage_invalidId(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	store := useMemoryImages(t)
+
+	for _, effectId := range []string{"", "%s", "../1", "1?x", "1.jpg"} {
+		body, _ := json.Marshal(RequestGetEffectImage{EffectId: effectId})
+		response := httptest.NewRecorder()
+		GetEffectImage(response, httptest.NewRequest(http.MethodPost, "/get-effect-image", bytes.NewReader(body)))
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status BadRequest; got %v", effectId, response.Code)
+		}
+	}
+	if images, _ := store.List(context.Background(), ""); len(images) != 0 || upstream.Requests("/img/theme_1.jpg") != 0 {
+		t.Errorf("expected nothing to be fetched or stored; got %+v", images)
+	}
+}
+
+func TestGetEffectImage_invalidUpstream(t *testing.T) {
+	jpeg := fakeupstream.ImageData("1")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img/notfound.jpg":
+			http.NotFound(w, r)
+		case "/img/html.jpg":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>maintenance</body></html>"))
+		case "/img/mislabeled.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("<html><body>login required</body></html>"))
+		case "/img/large.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.(http.Flusher).Flush()
+			// Content-Lengthなしで上限より多く送る
+			w.Write(append(jpeg, make([]byte, 2048)...))
+		case "/img/truncated.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Header().Set("Content-Length", strconv.Itoa(len(jpeg)+1000))
+			w.Write(jpeg)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv("EFFECT_IMAGE_URL", upstream.URL+"/img/%s.jpg")
+	t.Setenv("EFFECT_IMAGE_MAX_BYTES", strconv.Itoa(len(jpeg)+1024))
+	store := useMemoryImages(t)
+
+	for _, effectId := range []string{"notfound", "html", "mislabeled", "large", "truncated"} {
+		body, _ := json.Marshal(RequestGetEffectImage{EffectId: effectId})
+		response := httptest.NewRecorder()
+		GetEffectImage(response, httptest.NewRequest(http.MethodPost, "/get-effect-image", bytes.NewReader(body)))
+		if response.Code != http.StatusBadGateway {
+			t.Errorf("%s: expected status BadGateway; got %v", effectId, response.Code)
+		}
+	}
+	// 失敗したものは保存しない
+	if images, _ := store.List(context.Background(), ""); len(images) != 0 {
+		t.Errorf("expected nothing to be stored; got %+v", images)
+	}
+}
+
+func TestTeeImage_localCleanup(t *testing.T) {
+	jpeg := fakeupstream.ImageData("1")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(jpeg)+1000))
+		w.Write(jpeg)
+	}))
+	t.Cleanup(upstream.Close)
+	dir := t.TempDir()
+	store := NewLocalImageStore(dir)
+
+	var client bytes.Buffer
+	if _, err := teeImage(context.Background(), store, upstream.URL, "images/1.jpg", &client); !errors.Is(err, ErrUpstreamImage) {
+		t.Fatalf("expected error for truncated body; got %v", err)
+	}
+	// 一時ファイルも残さない
+	entries, _ := os.ReadDir(filepath.Join(dir, "images"))
+	if len(entries) != 0 {
+		t.Errorf("expected no files after failed download; got %v", entries)
+	}
+}
@@ -0,0 +1,216 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 作成できるサムネイルの幅の既定値 EFFECT_IMAGE_WIDTHSでカンマ区切りで指定する
+	defaultEffectImageWidths = "160,320,640"
+	// jpegで保存する場合の品質の既定値
+	defaultEffectImageJpegQuality = 85
+	// 縮小のために展開する画像の画素数の上限の既定値 EFFECT_IMAGE_MAX_PIXELSで変えられる
+	// 小さなファイルでも展開すると巨大になる画像で、メモリを使い切らないようにする
+	defaultEffectImageMaxPixels = 4096 * 4096
+)
+
+// ErrImageVariant は指定された幅や形式の画像を作れない場合
+var ErrImageVariant = errors.New("unsupported image variant")
+
+// ImageVariant はサムネイルの幅と形式 ゼロ値は元の画像
+type ImageVariant struct {
+	// 0の場合は元の幅のまま
+	Width int
+	// "jpeg"か"png" 空の場合はjpeg
+	Format string
+}
+
+// variantExtensions は形式ごとの拡張子
+// webpは標準ライブラリにエンコーダーがなく、可逆圧縮だけでは写真がjpegより大きくなるため作らない
+var variantExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+}
+
+// effectImageWidths はEFFECT_IMAGE_WIDTHSで許可された幅 任意の幅を許すと保存先に際限なく増えるため
+func effectImageWidths() []int {
+	value := os.Getenv("EFFECT_IMAGE_WIDTHS")
+	if value == "" {
+		value = defaultEffectImageWidths
+	}
+	var widths []int
+	for _, field := range strings.Split(value, ",") {
+		if width, err := strconv.Atoi(strings.TrimSpace(field)); err == nil && width > 0 {
+			widths = append(widths, width)
+		}
+	}
+	return widths
+}
+
+// parseImageVariant はクエリのwidthとformatから作る画像を決める
+func parseImageVariant(query url.Values) (ImageVariant, error) {
+	var variant ImageVariant
+	if value := query.Get("width"); value != "" {
+		width, err := strconv.Atoi(value)
+		if err != nil {
+			return variant, fmt.Errorf("%w: invalid width %q", ErrImageVariant, value)
+		}
+		allowed := false
+		for _, w := range effectImageWidths() {
+			allowed = allowed || w == width
+		}
+		if !allowed {
+			return variant, fmt.Errorf("%w: width %d is not allowed (allowed: %v)", ErrImageVariant, width, effectImageWidths())
+		}
+		variant.Width = width
+	}
+
+	format := strings.ToLower(query.Get("format"))
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if format != "" {
+		if _, ok := variantExtensions[format]; !ok {
+			return variant, fmt.Errorf("%w: format %q is not supported", ErrImageVariant, format)
+		}
+		// 元の画像はjpegなので、jpegの指定は形式の変換をしない
+		if format != "jpeg" {
+			variant.Format = format
+		}
+	}
+	return variant, nil
+}
+
+// variantImageName は元の画像と同じ場所に置くサムネイルの名前 (images/{id}.w320.png など)
+// エフェクトIdには'.'が入らないので、元の画像や他のエフェクトの名前と重ならない
+func variantImageName(effectId string, variant ImageVariant) string {
+	name := effectImageName(effectId)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if variant.Width > 0 {
+		base += fmt.Sprintf(".w%d", variant.Width)
+	}
+	if variant.Format != "" {
+		ext = variantExtensions[variant.Format]
+	}
+	return base + ext
+}
+
+// resizeImage は幅がwidthになるように縦横比を保って縮小する 元の幅以下の場合はそのまま返す
+// 縮小元の画素を面積で平均するので、大きく縮めてもちらつかない
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if width <= 0 || width >= bounds.Dx() {
+		return src
+	}
+	height := max(bounds.Dy()*width/bounds.Dx(), 1)
+
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*bounds.Dy()/height, max((y+1)*bounds.Dy()/height, y*bounds.Dy()/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*bounds.Dx()/width, max((x+1)*bounds.Dx()/width, x*bounds.Dx()/width+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				offset := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(rgba.Pix[offset+c])
+					}
+					offset += 4
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			offset := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[offset+c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return dst
+}
+
+// encodeImage はformatの形式で書き出す
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: envInt("EFFECT_IMAGE_JPEG_QUALITY", defaultEffectImageJpegQuality)})
+	case "png":
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("%w: format %q is not supported", ErrImageVariant, format)
+}
+
+// openEffectImageVariant はエフェクトのサムネイルをvariantの幅と形式で開く
+// 初めて指定されたものは元の画像から作り、元の画像と同じ保存先に保存する
+func openEffectImageVariant(ctx context.Context, store ImageStore, effectId string, variant ImageVariant) (io.ReadCloser, *ImageInfo, error) {
+	if variant == (ImageVariant{}) {
+		return openEffectImage(ctx, store, effectId)
+	}
+
+	if !validEffectId(effectId) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidEffectId, effectId)
+	}
+	name := variantImageName(effectId, variant)
+	reader, info, err := store.Get(ctx, name)
+	if !errors.Is(err, ErrImageNotFound) {
+		return reader, info, err
+	}
+
+	original, _, err := openEffectImage(ctx, store, effectId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer original.Close()
+	data, err := io.ReadAll(original)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 展開する前に大きさだけ読んで、上限を超えるものは展開しない
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode effect image %s: %w", effectId, err)
+	}
+	maxPixels := envInt("EFFECT_IMAGE_MAX_PIXELS", defaultEffectImageMaxPixels)
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxPixels/config.Height {
+		return nil, nil, fmt.Errorf("%w: image %s is too large (%dx%d)", ErrUpstreamImage, effectId, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode effect image %s: %w", effectId, err)
+	}
+	// 形式の指定がない場合は元の画像の名前に合わせてjpegにする
+	format := variant.Format
+	if format == "" {
+		format = "jpeg"
+	}
+
+	var resized bytes.Buffer
+	if err := encodeImage(&resized, resizeImage(img, variant.Width), format); err != nil {
+		return nil, nil, err
+	}
+	info, err = store.Put(ctx, name, imageContentType(name), bytes.NewReader(resized.Bytes()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NopCloser(&resized), info, nil
+}
@@ -0,0 +1,156 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseImageVariant(t *testing.T) {
+	t.Setenv("EFFECT_IMAGE_WIDTHS", "8, 320")
+
+	tests := []struct {
+		query   string
+		want    ImageVariant
+		wantErr bool
+	}{
+		{"", ImageVariant{}, false},
+		{"width=8", ImageVariant{Width: 8}, false},
+		{"width=320&format=PNG", ImageVariant{Width: 320, Format: "png"}, false},
+		// 元の画像がjpegなので変換しない
+		{"format=jpg", ImageVariant{}, false},
+		{"width=100", ImageVariant{}, true},
+		{"width=abc", ImageVariant{}, true},
+		{"format=webp", ImageVariant{}, true},
+		{"format=avif", ImageVariant{}, true},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := parseImageVariant(query)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseImageVariant(%q) = %+v, %v", tt.query, got, err)
+		}
+	}
+
+	if name := variantImageName("1", ImageVariant{Width: 320, Format: "png"}); name != "images/1.w320.png" {
+		t.Errorf("unexpected variant name %q", name)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	// 左半分が黒、右半分が白の画像を縮めると境目以外はそのまま残る
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x >= 20 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	resized := resizeImage(src, 10)
+	if resized.Bounds().Dx() != 10 || resized.Bounds().Dy() != 5 {
+		t.Fatalf("unexpected size %v", resized.Bounds())
+	}
+	if r, _, _, _ := resized.At(0, 2).RGBA(); r != 0 {
+		t.Errorf("expected black on the left; got %v", resized.At(0, 2))
+	}
+	if r, _, _, _ := resized.At(9, 2).RGBA(); r != 0xffff {
+		t.Errorf("expected white on the right; got %v", resized.At(9, 2))
+	}
+	// 大きくはしない
+	if resizeImage(src, 80) != image.Image(src) {
+		t.Error("expected the original image for a larger width")
+	}
+}
+
+func TestEffectImage_variant(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	store := useMemoryImages(t)
+	t.Setenv("EFFECT_IMAGE_WIDTHS", "8")
+
+	response := getEffectImage(t, http.MethodGet, "1?width=8&format=png", nil)
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("unexpected response: %v %v", response.Code, response.Header())
+	}
+	img, err := png.Decode(bytes.NewReader(response.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode png: %v", err)
+	}
+	if img.Bounds().Dx() != 8 || img.Bounds().Dy() != 8 {
+		t.Errorf("unexpected size %v", img.Bounds())
+	}
+
+	// 元の画像と並べて保存し、2回目は保存したものを返す
+	for _, name := range []string{"images/1.jpg", "images/1.w8.png"} {
+		if ok, _ := store.Exists(context.Background(), name); !ok {
+			t.Errorf("expected %s to be stored", name)
+		}
+	}
+	etag := response.Header().Get("ETag")
+	requests := upstream.Requests("/img/theme_1.jpg")
+	response = getEffectImage(t, http.MethodGet, "1?width=8&format=png", map[string]string{"If-None-Match": etag})
+	if response.Code != http.StatusNotModified || upstream.Requests("/img/theme_1.jpg") != requests {
+		t.Errorf("expected stored variant; got %v after %d requests", response.Code, upstream.Requests("/img/theme_1.jpg"))
+	}
+
+	// 元の画像は変わらない
+	response = getEffectImage(t, http.MethodGet, "1", nil)
+	if response.Header().Get("Content-Type") != "image/jpeg" || response.Header().Get("ETag") == etag {
+		t.Errorf("unexpected original image: %v", response.Header())
+	}
+
+	// 展開すると上限を超える画像は縮小しない
+	t.Setenv("EFFECT_IMAGE_MAX_PIXELS", "10")
+	if response := getEffectImage(t, http.MethodGet, "1?width=8", nil); response.Code != http.StatusBadGateway {
+		t.Errorf("expected status BadGateway for a large image; got %v", response.Code)
+	}
+	if ok, _ := store.Exists(context.Background(), "images/1.w8.jpg"); ok {
+		t.Error("expected no variant for a large image")
+	}
+
+	for _, query := range []string{"width=9", "format=webp", "format=avif"} {
+		if response := getEffectImage(t, http.MethodGet, "1?"+query, nil); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status BadRequest; got %v", query, response.Code)
+		}
+	}
+}
+
+func TestEffectImage_variantSize(t *testing.T) {
+	setupFakeUpstream(t)
+	store := useMemoryImages(t)
+	t.Setenv("EFFECT_IMAGE_WIDTHS", "160")
+
+	// 写真に近い、なめらかな変化にノイズの乗った画像を元の画像にする
+	random := rand.New(rand.NewSource(1))
+	src := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			noise := random.Intn(16)
+			src.Set(x, y, color.RGBA{uint8(x*255/640 + noise/2), uint8(y*255/480 + noise/2), uint8(128 + noise), 255})
+		}
+	}
+	var original bytes.Buffer
+	jpeg.Encode(&original, src, &jpeg.Options{Quality: 90})
+	store.Put(context.Background(), "images/photo.jpg", "image/jpeg", bytes.NewReader(original.Bytes()))
+
+	// サムネイルはどの形式でも元の画像より小さい
+	for _, query := range []string{"width=160", "width=160&format=png"} {
+		response := getEffectImage(t, http.MethodGet, "photo?"+query, nil)
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %v", query, response.Code)
+		}
+		if response.Body.Len() >= original.Len() {
+			t.Errorf("%s: thumbnail is %d bytes; original is %d bytes", query, response.Body.Len(), original.Len())
+		}
+	}
+}
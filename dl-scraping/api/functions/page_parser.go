@@ -0,0 +1,26 @@
+package functions
+
+import (
+	"sync"
+
+	"asa-o.net/dl-scraping/functions/parser"
+)
+
+var (
+	pageParserOnce sync.Once
+	defaultParser  *parser.Parser
+	pageParserErr  error
+)
+
+// getPageParser は設定されたバージョンのセレクタを使うパーサーを返す
+func getPageParser() (*parser.Parser, error) {
+	pageParserOnce.Do(func() {
+		config, err := parser.LoadConfigFromEnv()
+		if err != nil {
+			pageParserErr = err
+			return
+		}
+		defaultParser, pageParserErr = config.Parser("")
+	})
+	return defaultParser, pageParserErr
+}
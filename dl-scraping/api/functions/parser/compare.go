@@ -0,0 +1,58 @@
+package parser
+
+import "fmt"
+
+// Comparison は同じページを2つのセレクタバージョンで解析した結果
+type Comparison struct {
+	Base        *EffectListPage
+	Candidate   *EffectListPage
+	Differences []string
+}
+
+// Equal は2つの結果に差がないかを返す
+func (c *Comparison) Equal() bool {
+	return len(c.Differences) == 0
+}
+
+// CompareEffectList は一覧ページを2つのバージョンで解析し、差分を返す
+// 新しいセレクタを出す前に古いセレクタと同じ結果になるかを確かめるのに使う
+func (c *Config) CompareEffectList(body []byte, baseVersion string, candidateVersion string) (*Comparison, error) {
+	baseParser, err := c.Parser(baseVersion)
+	if err != nil {
+		return nil, err
+	}
+	candidateParser, err := c.Parser(candidateVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := baseParser.ParseEffectList(body)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := candidateParser.ParseEffectList(body)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := &Comparison{Base: base, Candidate: candidate}
+	if base.HasNext != candidate.HasNext {
+		comparison.Differences = append(comparison.Differences, fmt.Sprintf("hasNext: %v != %v", base.HasNext, candidate.HasNext))
+	}
+	if base.DlSecKey != candidate.DlSecKey {
+		comparison.Differences = append(comparison.Differences, fmt.Sprintf("dlSecKey: %q != %q", base.DlSecKey, candidate.DlSecKey))
+	}
+	if base.IsError != candidate.IsError {
+		comparison.Differences = append(comparison.Differences, fmt.Sprintf("isError: %v != %v", base.IsError, candidate.IsError))
+	}
+	if len(base.Effects) != len(candidate.Effects) {
+		comparison.Differences = append(comparison.Differences, fmt.Sprintf("effects: %d != %d", len(base.Effects), len(candidate.Effects)))
+		return comparison, nil
+	}
+	for i := range base.Effects {
+		if base.Effects[i] != candidate.Effects[i] {
+			comparison.Differences = append(comparison.Differences, fmt.Sprintf("effects[%d]: %+v != %+v", i, base.Effects[i], candidate.Effects[i]))
+		}
+	}
+	return comparison, nil
+}
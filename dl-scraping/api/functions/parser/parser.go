@@ -0,0 +1,146 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Effect はエフェクト一覧ページの1項目
+type Effect struct {
+	Name   string
+	Id     string
+	HashId string
+}
+
+// EffectListPage はエフェクト一覧ページの解析結果
+type EffectListPage struct {
+	Effects     []Effect
+	HasNext     bool
+	DlSecKey    string
+	ErrorBanner string
+	IsError     bool
+}
+
+// ChangePage はエフェクト変更ページの解析結果
+type ChangePage struct {
+	DlSecKey    string
+	ErrorBanner string
+	IsError     bool
+}
+
+// Parser は上流ページを型付きの結果に変換する
+type Parser struct {
+	version   string
+	selectors SelectorSet
+	imageIdRe *regexp.Regexp
+}
+
+func New(version string, selectors SelectorSet) (*Parser, error) {
+	imageIdRe, err := regexp.Compile(selectors.ImageIdPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image id pattern in selector version %q: %w", version, err)
+	}
+	return &Parser{
+		version:   version,
+		selectors: selectors,
+		imageIdRe: imageIdRe,
+	}, nil
+}
+
+// Version はこのパーサーが使っているセレクタのバージョン
+func (p *Parser) Version() string {
+	return p.version
+}
+
+// ParseEffectList はエフェクト一覧ページを解析する
+func (p *Parser) ParseEffectList(body []byte) (*EffectListPage, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	page := &EffectListPage{}
+	page.IsError, page.ErrorBanner = p.errorBanner(doc)
+
+	doc.Find(p.selectors.Item).Each(func(_ int, item *goquery.Selection) {
+		link := childAttr(item, p.selectors.ItemLink, "href")
+		page.Effects = append(page.Effects, Effect{
+			Name:   strings.TrimSpace(item.Find(p.selectors.ItemName).Text()),
+			Id:     p.ExtractImageId(childAttr(item, p.selectors.ItemImage, "src")),
+			HashId: queryParam(link, p.selectors.HashIdParam),
+		})
+
+		if page.DlSecKey == "" {
+			page.DlSecKey = queryParam(link, p.selectors.DlSecKeyParam)
+		}
+	})
+
+	page.HasNext = doc.Find(p.selectors.PagerNext).Length() > 0
+
+	return page, nil
+}
+
+// ParseChangeResult はエフェクト変更後のページを解析する
+func (p *Parser) ParseChangeResult(body []byte) (*ChangePage, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ChangePage{}
+	page.IsError, page.ErrorBanner = p.errorBanner(doc)
+
+	doc.Find(p.selectors.DefaultSelect).Each(func(_ int, s *goquery.Selection) {
+		page.DlSecKey = queryParam(childAttr(s, p.selectors.ItemLink, "href"), p.selectors.DlSecKeyParam)
+	})
+
+	return page, nil
+}
+
+// IsErrorPage はセッション切れなどのエラーページかを返す
+func (p *Parser) IsErrorPage(body []byte) (bool, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	isError, _ := p.errorBanner(doc)
+	return isError, nil
+}
+
+// ExtractImageId は画像のsrcからエフェクトIDを取り出す
+func (p *Parser) ExtractImageId(imgSrc string) string {
+	matches := p.imageIdRe.FindStringSubmatch(imgSrc)
+	if len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
+
+func (p *Parser) errorBanner(doc *goquery.Document) (bool, string) {
+	banner := doc.Find(p.selectors.ErrorBanner)
+	if banner.Length() == 0 {
+		return false, ""
+	}
+	return true, strings.TrimSpace(banner.First().Text())
+}
+
+func childAttr(s *goquery.Selection, selector string, attrName string) string {
+	attr, _ := s.Find(selector).Attr(attrName)
+	return strings.TrimSpace(attr)
+}
+
+func queryParam(link string, name string) string {
+	if link == "" {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get(name)
+}
@@ -0,0 +1,117 @@
+package parser
+
+import (
+	"testing"
+)
+
+const effectListHtml = `<html><body>
+<ul>
+  <li class="item"><a href="/change?ti=hash1&__DL__SEC__KEY__=key1"><img src="/img/theme_101.jpg"></a><div class="name"> 朝顔 </div></li>
+  <li class="item"><a href="/change?ti=hash2&__DL__SEC__KEY__=key1"><img src="/img/theme_102.jpg"></a><div class="name">花火</div></li>
+</ul>
+<ul class="pager"><li class="pagerNext"><a href="?page=2">次へ</a></li></ul>
+</body></html>`
+
+func defaultParser(t *testing.T) *Parser {
+	t.Helper()
+	config, err := LoadConfig(defaultConfigJson)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	p, err := config.Parser("")
+	if err != nil {
+		t.Fatalf("Parser() error = %v", err)
+	}
+	return p
+}
+
+func TestParseEffectList(t *testing.T) {
+	p := defaultParser(t)
+
+	page, err := p.ParseEffectList([]byte(effectListHtml))
+	if err != nil {
+		t.Fatalf("ParseEffectList() error = %v", err)
+	}
+
+	want := []Effect{
+		{Name: "朝顔", Id: "101", HashId: "hash1"},
+		{Name: "花火", Id: "102", HashId: "hash2"},
+	}
+	if len(page.Effects) != len(want) {
+		t.Fatalf("got %d effects, want %d", len(page.Effects), len(want))
+	}
+	for i := range want {
+		if page.Effects[i] != want[i] {
+			t.Errorf("effects[%d] = %+v, want %+v", i, page.Effects[i], want[i])
+		}
+	}
+	if !page.HasNext {
+		t.Errorf("HasNext = false, want true")
+	}
+	if page.DlSecKey != "key1" {
+		t.Errorf("DlSecKey = %q, want %q", page.DlSecKey, "key1")
+	}
+	if page.IsError {
+		t.Errorf("IsError = true, want false")
+	}
+}
+
+func TestParseChangeResult(t *testing.T) {
+	p := defaultParser(t)
+
+	tests := []struct {
+		name         string
+		body         string
+		wantDlSecKey string
+		wantIsError  bool
+	}{
+		{
+			name:         "changed",
+			body:         `<div class="dfultSlct"><a href="/list?__DL__SEC__KEY__=key2">設定中</a></div>`,
+			wantDlSecKey: "key2",
+		},
+		{
+			name:        "session expired",
+			body:        `<div id="error">セッションが切れました</div>`,
+			wantIsError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := p.ParseChangeResult([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("ParseChangeResult() error = %v", err)
+			}
+			if page.DlSecKey != tt.wantDlSecKey {
+				t.Errorf("DlSecKey = %q, want %q", page.DlSecKey, tt.wantDlSecKey)
+			}
+			if page.IsError != tt.wantIsError {
+				t.Errorf("IsError = %v, want %v", page.IsError, tt.wantIsError)
+			}
+		})
+	}
+}
+
+func TestCompareEffectList(t *testing.T) {
+	config, err := LoadConfig([]byte(`{
+		"current": "v1",
+		"sets": {
+			"v1": {"item": "li.item", "itemName": "div.name", "itemLink": "a", "itemImage": "img", "pagerNext": "li.pagerNext", "errorBanner": "div#error", "imageIdPattern": "theme_(\\d+)\\.jpg", "hashIdParam": "ti", "dlSecKeyParam": "__DL__SEC__KEY__"},
+			"v2": {"item": "li.item", "itemName": "div.title", "itemLink": "a", "itemImage": "img", "pagerNext": "li.pagerNext", "errorBanner": "div#error", "imageIdPattern": "theme_(\\d+)\\.jpg", "hashIdParam": "ti", "dlSecKeyParam": "__DL__SEC__KEY__"}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	comparison, err := config.CompareEffectList([]byte(effectListHtml), "v1", "v2")
+	if err != nil {
+		t.Fatalf("CompareEffectList() error = %v", err)
+	}
+	if comparison.Equal() {
+		t.Errorf("expected differences between v1 and v2")
+	}
+	if len(comparison.Differences) != 2 {
+		t.Errorf("got %d differences, want 2: %v", len(comparison.Differences), comparison.Differences)
+	}
+}
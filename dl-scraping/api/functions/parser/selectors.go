@@ -0,0 +1,96 @@
+package parser
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// SelectorSet は上流ページのマークアップに対応するセレクタの組
+// 上流のマークアップが変わったら新しいバージョンを追加する
+type SelectorSet struct {
+	Item           string `json:"item"`
+	ItemName       string `json:"itemName"`
+	ItemLink       string `json:"itemLink"`
+	ItemImage      string `json:"itemImage"`
+	PagerNext      string `json:"pagerNext"`
+	DefaultSelect  string `json:"defaultSelect"`
+	ErrorBanner    string `json:"errorBanner"`
+	ImageIdPattern string `json:"imageIdPattern"`
+	HashIdParam    string `json:"hashIdParam"`
+	DlSecKeyParam  string `json:"dlSecKeyParam"`
+}
+
+// Config はバージョンごとのセレクタの組と、現在使うバージョンを持つ
+type Config struct {
+	Current string                 `json:"current"`
+	Sets    map[string]SelectorSet `json:"sets"`
+}
+
+//go:embed selectors.json
+var defaultConfigJson []byte
+
+// LoadConfig はjsonからセレクタ設定を読み込む
+func LoadConfig(data []byte) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid selector config: %w", err)
+	}
+	if len(config.Sets) == 0 {
+		return nil, fmt.Errorf("selector config has no sets")
+	}
+	if _, ok := config.Sets[config.Current]; !ok {
+		return nil, fmt.Errorf("current selector version %q is not defined", config.Current)
+	}
+	return &config, nil
+}
+
+// LoadConfigFromEnv は環境変数PARSER_SELECTORS_FILEのファイルがあればそれを、なければ組み込みの設定を読み込む
+// PARSER_SELECTOR_VERSIONが指定されていれば現在のバージョンを上書きする
+func LoadConfigFromEnv() (*Config, error) {
+	data := defaultConfigJson
+	if path := os.Getenv("PARSER_SELECTORS_FILE"); path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = fileData
+	}
+
+	config, err := LoadConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if version := os.Getenv("PARSER_SELECTOR_VERSION"); version != "" {
+		if _, ok := config.Sets[version]; !ok {
+			return nil, fmt.Errorf("selector version %q is not defined", version)
+		}
+		config.Current = version
+	}
+	return config, nil
+}
+
+// Versions は定義されているバージョンを昇順で返す
+func (c *Config) Versions() []string {
+	versions := make([]string, 0, len(c.Sets))
+	for version := range c.Sets {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Parser は指定したバージョンのセレクタを使うパーサーを返す 空文字の場合は現在のバージョン
+func (c *Config) Parser(version string) (*Parser, error) {
+	if version == "" {
+		version = c.Current
+	}
+	set, ok := c.Sets[version]
+	if !ok {
+		return nil, fmt.Errorf("selector version %q is not defined", version)
+	}
+	return New(version, set)
+}
@@ -0,0 +1,312 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/joho/godotenv"
+)
+
+// 検索結果の件数の既定値
+const defaultSearchLimit = 20
+
+type RequestSearchEffects struct {
+	SessionId   string `json:"sessionId"`
+	MailAddress string `json:"mailAddress"`
+	Password    string `json:"password"`
+	Query       string `json:"query"`
+	// 指定しない場合は環境変数AI_MODEL どちらもなければキーワードで検索する
+	Model string `json:"model"`
+	Limit int    `json:"limit"`
+}
+
+// SearchResult は検索にヒットしたエフェクト
+type SearchResult struct {
+	Effect EffectInfo `json:"effect"`
+	Score  float64    `json:"score"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+type ResponseSearchEffects struct {
+	Succeed bool   `json:"succeed"`
+	Query   string `json:"query"`
+	// model: モデルで並べ替えた keyword: キーワードで並べ替えた
+	Method  string         `json:"method"`
+	Results []SearchResult `json:"results"`
+	Usage   []UsageRecord  `json:"usage"`
+}
+
+// searchAnswer は検索でモデルに答えさせる形
+type searchAnswer struct {
+	Results []searchAnswerItem `json:"results" description:"クエリに合うエフェクト 合う順"`
+}
+
+type searchAnswerItem struct {
+	Id     string  `json:"id"`
+	Score  float64 `json:"score" description:"0から1 1が最も合う"`
+	Reason string  `json:"reason" description:"合うと判断した理由 短く"`
+}
+
+const searchSystemInstructions = "You help users find phone theme effects in their collection. " +
+	"Given a request and a list of effects (id, name and visual tags), return only the effects that match the request, best match first. " +
+	"Use only ids from the list."
+
+// describeEffect は検索でモデルに渡す1行の説明を作る
+func describeEffect(effect EffectInfo) string {
+	line := fmt.Sprintf("id=%s name=%s", effect.Id, effect.Name)
+	if tags := effect.Tags; tags != nil {
+		line += fmt.Sprintf(" colors=%s mood=%s characters=%s season=%s hasText=%t",
+			strings.Join(tags.Colors, ","), tags.Mood, strings.Join(tags.Characters, ","), tags.Season, tags.HasText)
+	}
+	return line
+}
+
+// rankEffectsWithModel はモデルにクエリを解釈させてエフェクトを並べる
+// モデルが返した一覧にないIdは捨てる
+func rankEffectsWithModel(ctx context.Context, client LLMClient, query string, effects []EffectInfo) ([]SearchResult, error) {
+	lines := make([]string, 0, len(effects))
+	for _, effect := range effects {
+		lines = append(lines, describeEffect(effect))
+	}
+
+	ranked, _, err := GenerateTyped[searchAnswer](ctx, client, GenerateRequest{
+		Prompt:             fmt.Sprintf("Request: %s\n\nEffects:\n%s", query, strings.Join(lines, "\n")),
+		SystemInstructions: searchSystemInstructions,
+	}, structuredRetries())
+	if err != nil {
+		return nil, err
+	}
+
+	effectsById := make(map[string]EffectInfo, len(effects))
+	for _, effect := range effects {
+		effectsById[effect.Id] = effect
+	}
+	results := []SearchResult{}
+	seen := make(map[string]bool)
+	for _, result := range ranked.Results {
+		effect, ok := effectsById[result.Id]
+		if !ok || seen[result.Id] {
+			continue
+		}
+		seen[result.Id] = true
+		results = append(results, SearchResult{Effect: effect, Score: result.Score, Reason: result.Reason})
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results, nil
+}
+
+// keywordAliases は日本語のキーワードをタグの値に読み替える
+var keywordAliases = map[string][]string{
+	"春":   {"spring"},
+	"夏":   {"summer"},
+	"秋":   {"autumn"},
+	"冬":   {"winter"},
+	"赤":   {"red"},
+	"青":   {"blue"},
+	"緑":   {"green"},
+	"黄":   {"yellow"},
+	"白":   {"white"},
+	"黒":   {"black"},
+	"猫":   {"cat"},
+	"犬":   {"dog"},
+	"文字":  {"text"},
+	"落ち着": {"calm"},
+	"静か":  {"calm"},
+	"楽し":  {"happy", "festive"},
+	"かわい": {"cute"},
+}
+
+// searchKeywords はクエリを比べるためのキーワードに分ける
+func searchKeywords(query string) []string {
+	query = strings.ToLower(query)
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return unicode.IsSpace(r) || (unicode.IsPunct(r) && r != '-') || unicode.IsSymbol(r)
+	})
+
+	var keywords []string
+	for _, word := range words {
+		// "autumn-ish"のような語は前半も使う
+		if head, _, ok := strings.Cut(word, "-"); ok && head != "" {
+			keywords = append(keywords, head)
+		}
+		keywords = append(keywords, word)
+	}
+	for alias, values := range keywordAliases {
+		if strings.Contains(query, alias) {
+			keywords = append(keywords, values...)
+		}
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+// rankEffectsByKeyword はモデルを使わずにキーワードの一致でエフェクトを並べる
+// 名前がクエリに含まれる場合と、キーワードが名前かタグに含まれる場合に点を付ける
+// 同点の場合は一覧の順番
+func rankEffectsByKeyword(query string, effects []EffectInfo) []SearchResult {
+	keywords := searchKeywords(query)
+	lowerQuery := strings.ToLower(query)
+
+	results := []SearchResult{}
+	for _, effect := range effects {
+		name := strings.ToLower(effect.Name)
+		var tagWords []string
+		if tags := effect.Tags; tags != nil {
+			tagWords = append(tagWords, tags.Colors...)
+			tagWords = append(tagWords, tags.Characters...)
+			tagWords = append(tagWords, tags.Mood, tags.Season)
+			if tags.HasText {
+				tagWords = append(tagWords, "text")
+			}
+		}
+
+		score := 0.0
+		var matched []string
+		if name != "" && strings.Contains(lowerQuery, name) {
+			score += 2
+			matched = append(matched, effect.Name)
+		}
+		for _, keyword := range keywords {
+			if strings.Contains(name, keyword) {
+				score++
+				matched = append(matched, keyword)
+				continue
+			}
+			for _, tag := range tagWords {
+				if tag != "" && tag == keyword {
+					score++
+					matched = append(matched, keyword)
+					break
+				}
+			}
+		}
+		if score > 0 {
+			results = append(results, SearchResult{Effect: effect, Score: score, Reason: "matched: " + strings.Join(matched, ", ")})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results
+}
+
+// searchModelName は検索に使うモデル名を返す 設定がなければ空文字
+func searchModelName(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	return os.Getenv("AI_MODEL")
+}
+
+// searchEffects はモデルが設定されていればモデルで、なければキーワードで検索する
+// モデルでの検索に失敗した場合もキーワードでの検索に切り替える
+// モデルを使った場合は、失敗した場合も含めて使用量を返す
+func searchEffects(ctx context.Context, account string, modelName string, query string, effects []EffectInfo) ([]SearchResult, string, []UsageRecord) {
+	usage := []UsageRecord{}
+	if modelName != "" {
+		results, err := func() ([]SearchResult, error) {
+			model, err := resolveModel(modelName)
+			if err != nil {
+				return nil, err
+			}
+			client, err := NewLLMClient(ctx, model)
+			if err != nil {
+				return nil, err
+			}
+			recorder := NewUsageRecorder(NewCachedClient(client, model, false), account, "search-effects")
+			defer func() { usage = recorder.Records() }()
+			defer recorder.Close()
+			return rankEffectsWithModel(ctx, recorder, query, effects)
+		}()
+		if err == nil {
+			return results, "model", usage
+		}
+		log.Printf("Failed to search with model, falling back to keywords: %v", err)
+	}
+	return rankEffectsByKeyword(query, effects), "keyword", usage
+}
+
+// SearchEffects は保存済みの一覧から、自由文のクエリに合うエフェクトを合う順に返す
+func SearchEffects(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// JSONデコード
+	var request RequestSearchEffects
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Query) == "" {
+		http.Error(w, "Query is empty", http.StatusBadRequest)
+		return
+	}
+
+	godotenv.Load()
+
+	_, account, err := authenticate(r.Context(), request.SessionId, request.MailAddress, request.Password)
+	if err != nil {
+		log.Printf("Failed to acquire session: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	repository, err := getCatalogRepository()
+	if err != nil {
+		log.Printf("Failed to open catalog repository: %v", err)
+		http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+		return
+	}
+	snapshot, err := repository.Latest(r.Context(), account)
+	if errors.Is(err, ErrCatalogNotFound) {
+		http.Error(w, "Catalog not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read catalog: %v", err)
+		http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+		return
+	}
+
+	effects := withTags(r.Context(), snapshot.Effects, nil)
+	results, method, usage := searchEffects(r.Context(), account, searchModelName(request.Model), request.Query, effects)
+
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	response := ResponseSearchEffects{
+		Succeed: true,
+		Query:   request.Query,
+		Method:  method,
+		Results: results,
+		Usage:   usage,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,121 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postSearchEffects(t *testing.T, request RequestSearchEffects) (*httptest.ResponseRecorder, ResponseSearchEffects) {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/search-effects", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	SearchEffects(response, req)
+
+	var res ResponseSearchEffects
+	if response.Code == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return response, res
+}
+
+// setupSearchCatalog は保存済みの一覧とタグを用意する
+func setupSearchCatalog(t *testing.T) {
+	t.Helper()
+	setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	useMemoryCatalog(t)
+	tags := useMemoryTags(t)
+
+	response, _ := postGetEffectList(t, RequestInfo{All: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	for id, tagJson := range testTags {
+		var effectTags EffectTags
+		json.Unmarshal([]byte(tagJson), &effectTags)
+		tags.Save(context.Background(), id, normalizeTags(&effectTags))
+	}
+}
+
+func TestSearchEffects_keyword(t *testing.T) {
+	setupSearchCatalog(t)
+	t.Setenv("AI_MODEL", "")
+
+	response, res := postSearchEffects(t, RequestSearchEffects{MailAddress: testMailAddress, Password: testPassword, Query: "秋っぽくて落ち着いた"})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Method != "keyword" {
+		t.Errorf("expected keyword search; got %s", res.Method)
+	}
+	// 紅葉はautumnとcalmの両方、朝顔はcalmのみ
+	if len(res.Results) != 2 || res.Results[0].Effect.Id != "3" || res.Results[1].Effect.Id != "1" {
+		t.Errorf("unexpected results: %+v", res.Results)
+	}
+
+	// 名前での一致
+	_, res = postSearchEffects(t, RequestSearchEffects{MailAddress: testMailAddress, Password: testPassword, Query: "花火みたいなやつ"})
+	if len(res.Results) != 1 || res.Results[0].Effect.Id != "2" {
+		t.Errorf("expected 花火; got %+v", res.Results)
+	}
+
+	_, res = postSearchEffects(t, RequestSearchEffects{MailAddress: testMailAddress, Password: testPassword, Query: "something autumn-ish", Limit: 1})
+	if len(res.Results) != 1 || res.Results[0].Effect.Id != "3" {
+		t.Errorf("expected 紅葉; got %+v", res.Results)
+	}
+}
+
+func TestSearchEffects_model(t *testing.T) {
+	setupSearchCatalog(t)
+	setupFakeOpenAi(t, func(request map[string]interface{}) string {
+		messages := request["messages"].([]interface{})
+		prompt := messages[len(messages)-1].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})["text"].(string)
+		if !strings.Contains(prompt, "season=autumn") {
+			t.Errorf("expected tags in prompt; got %s", prompt)
+		}
+		// 一覧にないIdは無視される
+		return `{"results": [{"id": "1", "score": 0.4, "reason": "calm"}, {"id": "99", "score": 1, "reason": "unknown"}, {"id": "3", "score": 0.9, "reason": "autumn leaves"}]}`
+	})
+
+	response, res := postSearchEffects(t, RequestSearchEffects{MailAddress: testMailAddress, Password: testPassword, Query: "something autumn-ish and calm"})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Method != "model" {
+		t.Errorf("expected model search; got %s", res.Method)
+	}
+	if len(res.Results) != 2 || res.Results[0].Effect.Id != "3" || res.Results[0].Effect.Tags == nil || res.Results[1].Effect.Id != "1" {
+		t.Errorf("unexpected results: %+v", res.Results)
+	}
+}
+
+func TestSearchEffects_modelFailure(t *testing.T) {
+	setupSearchCatalog(t)
+	setupFakeOpenAi(t, func(request map[string]interface{}) string {
+		return "not json"
+	})
+
+	// モデルの結果が読めなければキーワードで検索する
+	_, res := postSearchEffects(t, RequestSearchEffects{MailAddress: testMailAddress, Password: testPassword, Query: "秋"})
+	if res.Method != "keyword" || len(res.Results) != 1 || res.Results[0].Effect.Id != "3" {
+		t.Errorf("expected keyword fallback; got %+v", res)
+	}
+
+	response, _ := postSearchEffects(t, RequestSearchEffects{MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("expected status BadRequest for empty query; got %v", response.Code)
+	}
+	// メールアドレスだけでは他人の一覧を検索できない
+	response, _ = postSearchEffects(t, RequestSearchEffects{MailAddress: testMailAddress, Query: "秋"})
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized without password; got %v", response.Code)
+	}
+}
@@ -0,0 +1,551 @@
+package functions
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gocolly/colly"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrLoginFailed     = errors.New("login failed")
+	ErrSessionExpired  = errors.New("session expired")
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+const (
+	sessionCookieName = "JSESSIONID"
+	// 使われなくなったセッションを捨てるまでの時間の既定値
+	defaultSessionTTL = 30 * time.Minute
+	// 期限切れのセッションをまとめて捨てる間隔
+	sessionSweepInterval = time.Minute
+	// 保存先の書き込みを待つ時間 リクエストのcontextがない箇所で使う
+	sessionSaveTimeout = 5 * time.Second
+	// 認証情報付きのリクエストで同じアカウントのセッションを使い回すのは、この時間内に使えたものだけ
+	// 上流で切れていても再ログインできないため
+	sessionReuseWindow = time.Minute
+)
+
+// Session は上流サイトとのログインセッション
+// クッキージャーを保持し、同じセッションのリクエストは全てこのジャーを通す
+// パスワードは持たないので、上流でセッションが切れたら認証情報付きのリクエストでログインし直してもらう
+type Session struct {
+	// 上流がIDを振り直すと変わるので、他のゴルーチンからはSessionIdで読む
+	Id string
+	// ログインしたアカウントのキー accountKeyで作る
+	Account string
+
+	// 最終利用時刻(UnixNano) 管理側がロックの順番を気にせず読めるようにatomicにする
+	lastUsed atomic.Int64
+	// 同じアカウントのセッションを使い回すときにパスワードを照合するためのHMAC
+	passwordDigest []byte
+	// 保存先に書いた有効期限 半分を過ぎたら書き直す
+	savedUntil time.Time
+	jar        *cookiejar.Jar
+	// 取得は並行して行い、IDの振り直しの間だけ排他する
+	mu sync.RWMutex
+}
+
+// SessionId は現在のセッションIDを返す
+func (s *Session) SessionId() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Id
+}
+
+// expired は最終利用からttl以上経っているかを返す
+func (s *Session) expired(now time.Time, ttl time.Duration) bool {
+	return now.Sub(time.Unix(0, s.lastUsed.Load())) >= ttl
+}
+
+// sessionPasswordKey はパスワードのHMACの鍵 インスタンスごとに作り、どこにも保存しない
+var sessionPasswordKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func passwordDigest(password string) []byte {
+	mac := hmac.New(sha256.New, sessionPasswordKey)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// SessionRecord はインスタンスをまたいでセッションを引き継ぐための記録
+// クッキーはクライアントが送るJSESSIONIDから作り直すので、アカウントと期限だけを持つ
+type SessionRecord struct {
+	Account   string    `firestore:"account"`
+	ExpiresAt time.Time `firestore:"expiresAt"`
+}
+
+// SessionRepository はセッションIDごとの記録を保存する
+// セッションIDはそのまま使えてしまうので、キーにはハッシュを使う
+type SessionRepository interface {
+	// Get は記録を返す なければ、または期限切れならErrSessionNotFound
+	Get(ctx context.Context, sessionId string) (*SessionRecord, error)
+	Save(ctx context.Context, sessionId string, record SessionRecord) error
+	Delete(ctx context.Context, sessionId string) error
+}
+
+// sessionKey はセッションIDから保存先のキーを作る
+func sessionKey(sessionId string) string {
+	sum := sha256.Sum256([]byte(sessionId))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	sessionRepositoryOnce sync.Once
+	sessionRepository     SessionRepository
+	sessionRepositoryErr  error
+)
+
+// getSessionRepository はcatalogStoreで選んだ保存先を返す
+func getSessionRepository() (SessionRepository, error) {
+	sessionRepositoryOnce.Do(func() {
+		switch store := catalogStore(); store {
+		case "firestore":
+			client, err := newFirestoreClient(context.Background())
+			if err != nil {
+				sessionRepositoryErr = err
+				return
+			}
+			sessionRepository = NewFirestoreSessionRepository(client)
+		case "memory":
+			sessionRepository = NewMemorySessionRepository()
+		default:
+			sessionRepositoryErr = errors.New("unknown catalog store: " + store)
+		}
+	})
+	return sessionRepository, sessionRepositoryErr
+}
+
+// MemorySessionRepository はメモリ上に保存する 開発とテスト用
+type MemorySessionRepository struct {
+	mu      sync.Mutex
+	records map[string]SessionRecord
+}
+
+func NewMemorySessionRepository() *MemorySessionRepository {
+	return &MemorySessionRepository{records: make(map[string]SessionRecord)}
+}
+
+func (r *MemorySessionRepository) Get(ctx context.Context, sessionId string) (*SessionRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := sessionKey(sessionId)
+	record, ok := r.records[key]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if !time.Now().Before(record.ExpiresAt) {
+		delete(r.records, key)
+		return nil, ErrSessionNotFound
+	}
+	return &record, nil
+}
+
+func (r *MemorySessionRepository) Save(ctx context.Context, sessionId string, record SessionRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[sessionKey(sessionId)] = record
+	return nil
+}
+
+func (r *MemorySessionRepository) Delete(ctx context.Context, sessionId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.records, sessionKey(sessionId))
+	return nil
+}
+
+// FirestoreSessionRepository はsessions/{sessionKey}に保存する
+// 期限切れのドキュメントは読むときに無視する 削除はexpiresAtにTTLポリシーを設定して任せる
+type FirestoreSessionRepository struct {
+	client *firestore.Client
+}
+
+func NewFirestoreSessionRepository(client *firestore.Client) *FirestoreSessionRepository {
+	return &FirestoreSessionRepository{client: client}
+}
+
+func (r *FirestoreSessionRepository) Get(ctx context.Context, sessionId string) (*SessionRecord, error) {
+	docSnap, err := r.client.Collection("sessions").Doc(sessionKey(sessionId)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record SessionRecord
+	if err := docSnap.DataTo(&record); err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(record.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	return &record, nil
+}
+
+func (r *FirestoreSessionRepository) Save(ctx context.Context, sessionId string, record SessionRecord) error {
+	_, err := r.client.Collection("sessions").Doc(sessionKey(sessionId)).Set(ctx, record)
+	return err
+}
+
+func (r *FirestoreSessionRepository) Delete(ctx context.Context, sessionId string) error {
+	_, err := r.client.Collection("sessions").Doc(sessionKey(sessionId)).Delete(ctx)
+	return err
+}
+
+// SessionManager はログイン、クッキーの保持、セッション切れの検知を受け持つ
+// ハンドラはcollyのクッキーを直接触らず、ここからセッションを受け取る
+// インスタンスが入れ替わっても続けられるように、発行したセッションはSessionRepositoryにも記録する
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*Session // key: JSESSIONID
+	accounts map[string]*Session // key: アカウントのキー
+	// 最後に期限切れのセッションを捨てた時刻
+	lastSweep time.Time
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*Session),
+		accounts: make(map[string]*Session),
+	}
+}
+
+// 関数インスタンスが生きている間はセッションを使い回す
+var sessionManager = NewSessionManager()
+
+// sessionTTL はSESSION_TTL_MSで指定したセッションの有効期間を返す
+func sessionTTL() time.Duration {
+	return envDuration("SESSION_TTL_MS", defaultSessionTTL)
+}
+
+// Acquire は有効なセッションを返す
+// sessionIdがこのインスタンスで管理しているものか、保存先に記録があるものならそれを使う
+// なければ同じアカウントの直近に使えたセッションを使い回すか新たにログインする
+// 発行していないsessionIdは認証情報がなければErrSessionExpiredを返す 任意のIDでセッションを増やせないようにするため
+func (m *SessionManager) Acquire(ctx context.Context, sessionId string, mailAddress string, password string) (*Session, error) {
+	if s, ok := m.Lookup(sessionId); ok {
+		return s, nil
+	}
+	if sessionId != "" {
+		s, err := m.restore(ctx, sessionId)
+		if err == nil {
+			return s, nil
+		}
+		if !errors.Is(err, ErrSessionNotFound) {
+			log.Printf("Failed to restore session: %v", err)
+		}
+	}
+
+	if mailAddress == "" || password == "" {
+		return nil, ErrSessionExpired
+	}
+
+	account := accountKey(mailAddress)
+	digest := passwordDigest(password)
+	m.mu.Lock()
+	s, ok := m.accounts[account]
+	m.mu.Unlock()
+	if ok && hmac.Equal(s.passwordDigest, digest) && !s.expired(time.Now(), sessionReuseWindow) {
+		return s, nil
+	}
+
+	s = &Session{
+		Account:        account,
+		passwordDigest: digest,
+	}
+	if err := m.login(s, mailAddress, password); err != nil {
+		return nil, err
+	}
+	s.savedUntil = time.Now().Add(sessionTTL())
+
+	m.register(s, "")
+	m.save(ctx, s.Id, "", s.Account, s.savedUntil)
+	return s, nil
+}
+
+// Lookup は管理しているセッションを返す 上流にも保存先にも問い合わせない
+// SESSION_TTL_MSの間使われていないセッションは捨てる
+func (m *SessionManager) Lookup(sessionId string) (*Session, bool) {
+	if sessionId == "" {
+		return nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	ttl := sessionTTL()
+	if now.Sub(m.lastSweep) >= sessionSweepInterval {
+		m.sweep(now, ttl)
+	}
+	s, ok := m.sessions[sessionId]
+	if ok && s.expired(now, ttl) {
+		m.remove(sessionId, s)
+		return nil, false
+	}
+	return s, ok
+}
+
+// restore は保存先の記録からセッションを作り直す
+// クッキージャーにはクライアントのJSESSIONIDを入れ、上流で切れているかは取得時のエラーページで判断する
+func (m *SessionManager) restore(ctx context.Context, sessionId string) (*Session, error) {
+	repository, err := getSessionRepository()
+	if err != nil {
+		return nil, err
+	}
+	record, err := repository.Get(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(os.Getenv("TOP_URL"))
+	if err != nil {
+		return nil, err
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	jar.SetCookies(u, []*http.Cookie{{Name: sessionCookieName, Value: sessionId, Path: "/"}})
+
+	s := &Session{
+		Id:         sessionId,
+		Account:    record.Account,
+		savedUntil: record.ExpiresAt,
+		jar:        jar,
+	}
+	s.lastUsed.Store(time.Now().UnixNano())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 同時に作り直した場合は先に登録したものを使う
+	if existing, ok := m.sessions[sessionId]; ok {
+		return existing, nil
+	}
+	m.sessions[sessionId] = s
+	return s, nil
+}
+
+// sweep は期限切れのセッションを全て捨てる m.muを持った状態で呼ぶ
+func (m *SessionManager) sweep(now time.Time, ttl time.Duration) {
+	m.lastSweep = now
+	for id, s := range m.sessions {
+		if s.expired(now, ttl) {
+			m.remove(id, s)
+		}
+	}
+}
+
+// remove はセッションを管理から外す m.muを持った状態で呼ぶ
+func (m *SessionManager) remove(id string, s *Session) {
+	delete(m.sessions, id)
+	if s.Account != "" && m.accounts[s.Account] == s {
+		delete(m.accounts, s.Account)
+	}
+}
+
+// Fetch はセッションのクッキーを付けてurlを取得し、ページの本文を返す
+// セッション切れのページが返ってきた場合はセッションを捨ててErrSessionExpiredを返す
+// 同じセッションで並行して呼び出してよい
+func (m *SessionManager) Fetch(s *Session, url string) ([]byte, error) {
+	s.mu.RLock()
+	body, expired, err := m.fetchOnce(s, url)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		m.forget(s)
+		return nil, ErrSessionExpired
+	}
+	m.touch(s)
+	return body, nil
+}
+
+func (m *SessionManager) fetchOnce(s *Session, url string) ([]byte, bool, error) {
+	pageParser, err := getPageParser()
+	if err != nil {
+		return nil, false, err
+	}
+
+	c := s.newCollector()
+
+	var body []byte
+	c.OnResponse(func(r *colly.Response) {
+		body = r.Body
+	})
+
+	var fetchErr error
+	c.OnError(func(_ *colly.Response, err error) {
+		fetchErr = err
+	})
+
+	if err := c.Visit(url); err != nil && fetchErr == nil {
+		fetchErr = err
+	}
+	if fetchErr != nil {
+		return nil, false, fetchErr
+	}
+
+	expired, err := pageParser.IsErrorPage(body)
+	if err != nil {
+		return nil, false, err
+	}
+	if expired {
+		return nil, true, nil
+	}
+	return body, false, nil
+}
+
+// touch は最終利用時刻を更新し、上流がセッションIDを振り直した場合に追従する
+// 保存先の有効期限が半分を過ぎていれば延ばす
+func (m *SessionManager) touch(s *Session) {
+	now := time.Now()
+	ttl := sessionTTL()
+
+	s.mu.Lock()
+	s.lastUsed.Store(now.UnixNano())
+	oldId := s.Id
+	if id := s.currentSessionId(); id != "" && id != s.Id {
+		s.Id = id
+		m.register(s, oldId)
+	}
+	id := s.Id
+	renew := id != oldId || s.savedUntil.Sub(now) < ttl/2
+	if renew {
+		s.savedUntil = now.Add(ttl)
+	}
+	savedUntil := s.savedUntil
+	s.mu.Unlock()
+
+	if renew {
+		ctx, cancel := context.WithTimeout(context.Background(), sessionSaveTimeout)
+		defer cancel()
+		m.save(ctx, id, oldId, s.Account, savedUntil)
+	}
+}
+
+// login はメールアドレスとパスワードでログインし、セッションIDを取得する
+func (m *SessionManager) login(s *Session, mailAddress string, password string) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	s.jar = jar
+
+	c := s.newCollector()
+	var fetchErr error
+	c.OnError(func(_ *colly.Response, err error) {
+		fetchErr = err
+	})
+	if err := c.Visit(buildLoginUrl(mailAddress, password)); err != nil && fetchErr == nil {
+		fetchErr = err
+	}
+	if fetchErr != nil {
+		return fetchErr
+	}
+
+	id := s.currentSessionId()
+	if id == "" {
+		return ErrLoginFailed
+	}
+	s.Id = id
+	s.lastUsed.Store(time.Now().UnixNano())
+	return nil
+}
+
+func (m *SessionManager) register(s *Session, oldId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if oldId != "" && oldId != s.Id {
+		delete(m.sessions, oldId)
+	}
+	m.sessions[s.Id] = s
+	if s.passwordDigest != nil {
+		m.accounts[s.Account] = s
+	}
+}
+
+// forget はセッションを管理から外し、保存先の記録も消す
+func (m *SessionManager) forget(s *Session) {
+	id := s.SessionId()
+
+	m.mu.Lock()
+	m.remove(id, s)
+	m.mu.Unlock()
+
+	repository, err := getSessionRepository()
+	if err != nil {
+		log.Printf("Failed to get session repository: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionSaveTimeout)
+	defer cancel()
+	if err := repository.Delete(ctx, id); err != nil {
+		log.Printf("Failed to delete session: %v", err)
+	}
+}
+
+// save はセッションの記録を保存先に書く IDが振り直された場合は古い記録を消す
+// 書けなくてもこのインスタンスでは使えるので、エラーはログに残すだけにする
+func (m *SessionManager) save(ctx context.Context, id string, oldId string, account string, expiresAt time.Time) {
+	repository, err := getSessionRepository()
+	if err != nil {
+		log.Printf("Failed to get session repository: %v", err)
+		return
+	}
+	if err := repository.Save(ctx, id, SessionRecord{Account: account, ExpiresAt: expiresAt}); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+	if oldId != "" && oldId != id {
+		if err := repository.Delete(ctx, oldId); err != nil {
+			log.Printf("Failed to delete session: %v", err)
+		}
+	}
+}
+
+func (s *Session) newCollector() *colly.Collector {
+	c := colly.NewCollector(
+		colly.AllowURLRevisit(),
+	)
+	c.SetCookieJar(s.jar)
+	return c
+}
+
+func (s *Session) currentSessionId() string {
+	u, err := url.Parse(os.Getenv("TOP_URL"))
+	if err != nil {
+		return ""
+	}
+	for _, cookie := range s.jar.Cookies(u) {
+		if cookie.Name == sessionCookieName {
+			return cookie.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/joho/godotenv"
+)
+
+// StreamPageEvent は1ページ取得するたびに送るイベント
+type StreamPageEvent struct {
+	Page       int          `json:"page"`
+	Effects    []EffectInfo `json:"effects"`
+	IsNext     bool         `json:"isNext"`
+	DurationMs int64        `json:"durationMs"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// StreamSummaryEvent は全ページ取得し終えたときに送るイベント
+type StreamSummaryEvent struct {
+	SessionId string       `json:"sessionId"`
+	DlSecKey  string       `json:"dlSecKey"`
+	Total     int          `json:"total"`
+	Pages     []PageTiming `json:"pages"`
+	Truncated bool         `json:"truncated"`
+	Succeed   bool         `json:"succeed"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// writeSSE はServer-Sent Eventsのイベントを1つ書き込んで送り出す
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, event string, data interface{}) error {
+	dataJson, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dataJson); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// StreamEffectList は全ページの取得をサーバー側で行い、進捗をServer-Sent Eventsで返す
+// ページごとに"page"イベント、最後に"summary"イベントを送る
+// POSTはGetEffectListと同じJSONを受け付ける EventSourceから使う場合はGETでsessionIdをクエリに付ける
+func StreamEffectList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	var request RequestInfo
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	case http.MethodGet:
+		query := r.URL.Query()
+		request.SessionId = query.Get("sessionId")
+		request.MaxPages, _ = strconv.Atoi(query.Get("maxPages"))
+		request.Parallelism, _ = strconv.Atoi(query.Get("parallelism"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	godotenv.Load()
+
+	// セッションの取得 sessionIdがなければログインする
+	session, account, err := authenticate(r.Context(), request.SessionId, request.MailAddress, request.Password)
+	if err != nil {
+		log.Printf("Failed to acquire session: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	options := crawlOptions(request)
+	options.OnPage = func(event PageEvent) {
+		pageEvent := StreamPageEvent{
+			Page:       event.Page,
+			Effects:    event.Effects,
+			IsNext:     event.IsNext,
+			DurationMs: event.Duration.Milliseconds(),
+		}
+		if event.Err != nil {
+			pageEvent.Error = event.Err.Error()
+		}
+		if err := writeSSE(w, flusher, "page", pageEvent); err != nil {
+			log.Printf("Failed to write event: %v", err)
+		}
+	}
+
+	result, err := crawlAllPages(r.Context(), session, options)
+	if err != nil {
+		log.Printf("Error fetching effect list: %v", err)
+		writeSSE(w, flusher, "summary", StreamSummaryEvent{
+			Succeed: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if _, err := saveCatalog(r.Context(), account, result); err != nil {
+		log.Printf("Failed to save catalog: %v", err)
+	}
+
+	writeSSE(w, flusher, "summary", StreamSummaryEvent{
+		SessionId: session.SessionId(),
+		DlSecKey:  result.DlSecKey,
+		Total:     len(result.Effects),
+		Pages:     result.Pages,
+		Truncated: result.Truncated,
+		Succeed:   true,
+	})
+}
@@ -0,0 +1,149 @@
+package functions
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, current)
+			current = sseEvent{}
+		}
+	}
+	return events
+}
+
+func TestStreamEffectList(t *testing.T) {
+	setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+
+	bodyJSON := `{"mailAddress":"` + testMailAddress + `","password":"` + testPassword + `"}`
+	response := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(bodyJSON))
+
+	StreamEffectList(response, req)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if ct := response.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	events := parseSSE(t, response.Body.String())
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 2 pages and a summary: %+v", len(events), events)
+	}
+
+	effects := 0
+	for _, event := range events[:2] {
+		if event.name != "page" {
+			t.Errorf("event = %q, want page", event.name)
+		}
+		var page StreamPageEvent
+		if err := json.Unmarshal([]byte(event.data), &page); err != nil {
+			t.Fatalf("invalid page event: %v", err)
+		}
+		effects += len(page.Effects)
+	}
+	if effects != 3 {
+		t.Errorf("got %d effects in page events, want 3", effects)
+	}
+
+	var summary StreamSummaryEvent
+	if events[2].name != "summary" {
+		t.Fatalf("last event = %q, want summary", events[2].name)
+	}
+	if err := json.Unmarshal([]byte(events[2].data), &summary); err != nil {
+		t.Fatalf("invalid summary event: %v", err)
+	}
+	if !summary.Succeed || summary.Total != 3 || summary.SessionId == "" {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestStreamEffectList_parallel(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	t.Setenv("EFFECT_LIST_JITTER_MS", "0")
+	t.Setenv("EFFECT_LIST_PARALLELISM", "4")
+	var effects []fakeupstream.Effect
+	for i := 1; i <= 9; i++ {
+		id := strconv.Itoa(i)
+		effects = append(effects, fakeupstream.Effect{Id: id, Name: "effect" + id, HashId: "hash" + id})
+	}
+	upstream.SetEffects(effects)
+
+	bodyJSON := `{"mailAddress":"` + testMailAddress + `","password":"` + testPassword + `","parallelism":4}`
+	response := httptest.NewRecorder()
+	StreamEffectList(response, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(bodyJSON)))
+
+	// 最終ページより後に先に取りに行ったページのイベントは送らず、ページ順に送る
+	events := parseSSE(t, response.Body.String())
+	if len(events) != 6 {
+		t.Fatalf("got %d events, want 5 pages and a summary: %+v", len(events), events)
+	}
+	total := 0
+	for i, event := range events[:5] {
+		var page StreamPageEvent
+		if err := json.Unmarshal([]byte(event.data), &page); err != nil || event.name != "page" || page.Page != i+1 {
+			t.Errorf("events[%d] = %s %s", i, event.name, event.data)
+		}
+		total += len(page.Effects)
+	}
+	var summary StreamSummaryEvent
+	json.Unmarshal([]byte(events[5].data), &summary)
+	if !summary.Succeed || summary.Total != total || total != len(effects) {
+		t.Errorf("summary total = %d, page events = %d, want %d", summary.Total, total, len(effects))
+	}
+}
+
+func TestStreamEffectList_upstreamError(t *testing.T) {
+	upstream := setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+
+	bodyJSON := `{"mailAddress":"` + testMailAddress + `","password":"` + testPassword + `"}`
+	upstream.FailNext("/list", 1)
+	response := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(bodyJSON))
+
+	StreamEffectList(response, req)
+
+	events := parseSSE(t, response.Body.String())
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want an error page and a summary: %+v", len(events), events)
+	}
+	var page StreamPageEvent
+	json.Unmarshal([]byte(events[0].data), &page)
+	if page.Error == "" {
+		t.Errorf("expected error in page event")
+	}
+	var summary StreamSummaryEvent
+	json.Unmarshal([]byte(events[1].data), &summary)
+	if summary.Succeed {
+		t.Errorf("expected failed summary")
+	}
+}
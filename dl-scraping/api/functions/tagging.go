@@ -0,0 +1,471 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joho/godotenv"
+)
+
+// 同時にタグ付けするエフェクト数の既定値
+const defaultTaggingParallelism = 4
+
+// EffectTags はエフェクトのサムネイルからモデルが判定した見た目の特徴
+type EffectTags struct {
+	Colors     []string `json:"colors" firestore:"colors"`
+	Mood       string   `json:"mood" firestore:"mood"`
+	Characters []string `json:"characters" firestore:"characters"`
+	Season     string   `json:"season" firestore:"season"`
+	HasText    bool     `json:"hasText" firestore:"hasText"`
+	Model      string   `json:"model" firestore:"model"`
+}
+
+// effectTagsAnswer はタグ付けでモデルに答えさせる形
+type effectTagsAnswer struct {
+	Colors     []string `json:"colors" description:"目立つ色 英語の小文字で3つまで"`
+	Mood       string   `json:"mood" description:"全体の雰囲気 英語の小文字1語"`
+	Characters []string `json:"characters" description:"描かれているキャラクターや生き物 英語の小文字"`
+	Season     string   `json:"season" description:"連想される季節" enum:"spring,summer,autumn,winter,none"`
+	HasText    bool     `json:"hasText" description:"画像に文字が含まれているか"`
+}
+
+const effectTagsSystemInstructions = "You label thumbnails of phone theme effects. Answer only with the requested JSON."
+const effectTagsPrompt = "Describe the visual attributes of this effect thumbnail."
+
+// tagEffectImage はサムネイルをモデルに送ってタグを判定する
+func tagEffectImage(ctx context.Context, client LLMClient, image ImagePart) (*EffectTags, error) {
+	answer, response, err := GenerateTyped[effectTagsAnswer](ctx, client, GenerateRequest{
+		Prompt:             effectTagsPrompt,
+		Images:             []ImagePart{image},
+		SystemInstructions: effectTagsSystemInstructions,
+	}, structuredRetries())
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeTags(&EffectTags{
+		Colors:     answer.Colors,
+		Mood:       answer.Mood,
+		Characters: answer.Characters,
+		Season:     answer.Season,
+		HasText:    answer.HasText,
+		Model:      response.Model,
+	}), nil
+}
+
+// normalizeTags は絞り込みで比べやすいように小文字にそろえる
+func normalizeTags(tags *EffectTags) *EffectTags {
+	lower := func(values []string) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+				result = append(result, value)
+			}
+		}
+		return result
+	}
+	tags.Colors = lower(tags.Colors)
+	tags.Characters = lower(tags.Characters)
+	tags.Mood = strings.ToLower(strings.TrimSpace(tags.Mood))
+	tags.Season = strings.ToLower(strings.TrimSpace(tags.Season))
+	return tags
+}
+
+// fetchEffectImage はエフェクトのサムネイルを画像の保存先から読む なければ上流から取得して保存する
+// 大きさや種類の確認はopenEffectImageと同じものを通す
+func fetchEffectImage(ctx context.Context, effectId string) (ImagePart, error) {
+	store, err := getImageStore()
+	if err != nil {
+		return ImagePart{}, err
+	}
+	data, info, err := readEffectImage(ctx, store, effectId)
+	if err != nil {
+		return ImagePart{}, err
+	}
+	return ImagePart{MimeType: info.ContentType, Data: data}, nil
+}
+
+// EffectFilter はタグでエフェクトを絞り込む条件 指定した条件をすべて満たすものを残す
+type EffectFilter struct {
+	Colors     []string `json:"colors"`
+	Mood       string   `json:"mood"`
+	Characters []string `json:"characters"`
+	Season     string   `json:"season"`
+	HasText    *bool    `json:"hasText"`
+}
+
+// Match はタグが条件を満たすかを返す タグがなければ条件がない場合のみ満たす
+func (f *EffectFilter) Match(tags *EffectTags) bool {
+	if f == nil {
+		return true
+	}
+	if tags == nil {
+		return len(f.Colors) == 0 && f.Mood == "" && len(f.Characters) == 0 && f.Season == "" && f.HasText == nil
+	}
+	if f.Mood != "" && !strings.EqualFold(f.Mood, tags.Mood) {
+		return false
+	}
+	if f.Season != "" && !strings.EqualFold(f.Season, tags.Season) {
+		return false
+	}
+	if f.HasText != nil && *f.HasText != tags.HasText {
+		return false
+	}
+	return containsAll(tags.Colors, f.Colors) && containsAll(tags.Characters, f.Characters)
+}
+
+func containsAll(values []string, wants []string) bool {
+	for _, want := range wants {
+		found := false
+		for _, value := range values {
+			if strings.EqualFold(value, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// withTags は保存済みのタグを付けたエフェクトの一覧を返し、filterがあれば絞り込む
+// タグが読めなかった場合はタグなしで返す
+func withTags(ctx context.Context, effects []EffectInfo, filter *EffectFilter) []EffectInfo {
+	repository, err := getTagRepository()
+	if err != nil {
+		log.Printf("Failed to open tag repository: %v", err)
+		return effects
+	}
+
+	// Idが取れなかったエフェクトはタグを持たない
+	ids := make([]string, 0, len(effects))
+	for _, effect := range effects {
+		if effect.Id != "" {
+			ids = append(ids, effect.Id)
+		}
+	}
+	tags, err := repository.Get(ctx, ids)
+	if err != nil {
+		log.Printf("Failed to read tags: %v", err)
+		return effects
+	}
+
+	result := make([]EffectInfo, 0, len(effects))
+	for _, effect := range effects {
+		effect.Tags = tags[effect.Id]
+		if filter.Match(effect.Tags) {
+			result = append(result, effect)
+		}
+	}
+	return result
+}
+
+// TagRepository はエフェクトIdごとのタグの保存先
+// 同じエフェクトの画像はアカウントによらないので、タグもアカウントをまたいで共有する
+type TagRepository interface {
+	// Get は保存済みのタグを返す タグがないIdや空のIdは結果に含まれない
+	Get(ctx context.Context, effectIds []string) (map[string]*EffectTags, error)
+	Save(ctx context.Context, effectId string, tags *EffectTags) error
+}
+
+var (
+	tagRepositoryOnce sync.Once
+	tagRepository     TagRepository
+	tagRepositoryErr  error
+)
+
+// getTagRepository はcatalogStoreで選んだ保存先を返す
+func getTagRepository() (TagRepository, error) {
+	tagRepositoryOnce.Do(func() {
+		switch store := catalogStore(); store {
+		case "firestore":
+			client, err := newFirestoreClient(context.Background())
+			if err != nil {
+				tagRepositoryErr = err
+				return
+			}
+			tagRepository = NewFirestoreTagRepository(client)
+		case "memory":
+			tagRepository = NewMemoryTagRepository()
+		default:
+			tagRepositoryErr = errors.New("unknown catalog store: " + store)
+		}
+	})
+	return tagRepository, tagRepositoryErr
+}
+
+type MemoryTagRepository struct {
+	mu   sync.Mutex
+	tags map[string]EffectTags
+}
+
+func NewMemoryTagRepository() *MemoryTagRepository {
+	return &MemoryTagRepository{tags: make(map[string]EffectTags)}
+}
+
+func (r *MemoryTagRepository) Get(ctx context.Context, effectIds []string) (map[string]*EffectTags, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make(map[string]*EffectTags)
+	for _, id := range effectIds {
+		if tags, ok := r.tags[id]; ok {
+			result[id] = &tags
+		}
+	}
+	return result, nil
+}
+
+func (r *MemoryTagRepository) Save(ctx context.Context, effectId string, tags *EffectTags) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tags[effectId] = *tags
+	return nil
+}
+
+// FirestoreTagRepository はeffectTags/{effectId}に保存する
+type FirestoreTagRepository struct {
+	client *firestore.Client
+}
+
+func NewFirestoreTagRepository(client *firestore.Client) *FirestoreTagRepository {
+	return &FirestoreTagRepository{client: client}
+}
+
+func (r *FirestoreTagRepository) Get(ctx context.Context, effectIds []string) (map[string]*EffectTags, error) {
+	// 空のIdではDocがnilを返し、GetAll全体が失敗するので除く
+	refs := make([]*firestore.DocumentRef, 0, len(effectIds))
+	for _, id := range effectIds {
+		if id == "" {
+			continue
+		}
+		if ref := r.client.Collection("effectTags").Doc(id); ref != nil {
+			refs = append(refs, ref)
+		}
+	}
+	result := make(map[string]*EffectTags)
+	if len(refs) == 0 {
+		return result, nil
+	}
+	docSnaps, err := r.client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	for _, docSnap := range docSnaps {
+		if !docSnap.Exists() {
+			continue
+		}
+		var tags EffectTags
+		if err := docSnap.DataTo(&tags); err != nil {
+			return nil, err
+		}
+		result[docSnap.Ref.ID] = &tags
+	}
+	return result, nil
+}
+
+func (r *FirestoreTagRepository) Save(ctx context.Context, effectId string, tags *EffectTags) error {
+	_, err := r.client.Collection("effectTags").Doc(effectId).Set(ctx, tags)
+	return err
+}
+
+type RequestTagEffects struct {
+	SessionId   string `json:"sessionId"`
+	MailAddress string `json:"mailAddress"`
+	Password    string `json:"password"`
+	// 指定しない場合は保存済みの一覧の全エフェクトを対象にする
+	EffectIds []string `json:"effectIds"`
+	// gpt-4o, gpt-4o-mini, gemini-1.5-flash, gemini-1.5-pro 指定しない場合は環境変数AI_MODEL
+	Model string `json:"model"`
+	// trueの場合はタグ付け済みのものもやり直す
+	Force bool `json:"force"`
+}
+
+type ResponseTagEffects struct {
+	Succeed bool                   `json:"succeed"`
+	Tagged  int                    `json:"tagged"`
+	Skipped int                    `json:"skipped"`
+	Failed  []string               `json:"failed"`
+	Tags    map[string]*EffectTags `json:"tags"`
+	Usage   []UsageRecord          `json:"usage"`
+}
+
+// tagEffects はタグのないエフェクトをまとめてタグ付けして保存する
+// 失敗したものは飛ばして続け、IdをFailedに入れる
+func tagEffects(ctx context.Context, client LLMClient, repository TagRepository, effectIds []string, force bool) (*ResponseTagEffects, error) {
+	existing, err := repository.Get(ctx, effectIds)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ResponseTagEffects{
+		Succeed: true,
+		Failed:  []string{},
+		Tags:    make(map[string]*EffectTags),
+	}
+	var targets []string
+	for _, id := range effectIds {
+		if tags, ok := existing[id]; ok && !force {
+			response.Tags[id] = tags
+			response.Skipped++
+			continue
+		}
+		targets = append(targets, id)
+	}
+
+	var mu sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	// 0を指定されても1件ずつは進める
+	for i := 0; i < max(envInt("AI_TAGGING_PARALLELISM", defaultTaggingParallelism), 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				tags, err := tagEffect(ctx, client, repository, id)
+
+				mu.Lock()
+				if err != nil {
+					log.Printf("Failed to tag effect %s: %v", id, err)
+					response.Failed = append(response.Failed, id)
+				} else {
+					response.Tags[id] = tags
+					response.Tagged++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, id := range targets {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+
+	return response, nil
+}
+
+func tagEffect(ctx context.Context, client LLMClient, repository TagRepository, effectId string) (*EffectTags, error) {
+	image, err := fetchEffectImage(ctx, effectId)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := tagEffectImage(ctx, client, image)
+	if err != nil {
+		return nil, err
+	}
+	if err := repository.Save(ctx, effectId, tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// TagEffects はエフェクトのサムネイルをモデルでタグ付けして保存する
+// 保存したタグはGetEffectListの結果に付き、filterで絞り込める
+func TagEffects(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	// CORS対応 プリフライトリクエストの場合は204を返す
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// JSONデコード
+	var request RequestTagEffects
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	godotenv.Load()
+
+	model, err := resolveModel(request.Model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// タグはサムネイルから判定するので、画像を受け付けないモデルは使えない
+	if !model.Vision {
+		http.Error(w, "Model does not accept images: "+model.Name, http.StatusBadRequest)
+		return
+	}
+
+	// モデルの利用料がかかるので、対象を指定した場合も認証したアカウントに記録する
+	_, account, err := authenticate(r.Context(), request.SessionId, request.MailAddress, request.Password)
+	if err != nil {
+		log.Printf("Failed to acquire session: %v", err)
+		http.Error(w, "Failed to login", http.StatusUnauthorized)
+		return
+	}
+
+	// 対象の指定がなければ保存済みの一覧から取る
+	effectIds := request.EffectIds
+	if len(effectIds) == 0 {
+		repository, err := getCatalogRepository()
+		if err != nil {
+			log.Printf("Failed to open catalog repository: %v", err)
+			http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+			return
+		}
+		snapshot, err := repository.Latest(r.Context(), account)
+		if errors.Is(err, ErrCatalogNotFound) {
+			http.Error(w, "Catalog not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read catalog: %v", err)
+			http.Error(w, "Failed to read catalog", http.StatusInternalServerError)
+			return
+		}
+		for _, effect := range snapshot.Effects {
+			effectIds = append(effectIds, effect.Id)
+		}
+	}
+
+	tagRepository, err := getTagRepository()
+	if err != nil {
+		log.Printf("Failed to open tag repository: %v", err)
+		http.Error(w, "Failed to open tag repository", http.StatusInternalServerError)
+		return
+	}
+
+	client, err := NewLLMClient(r.Context(), model)
+	if err != nil {
+		log.Printf("Failed to create AI client: %v", err)
+		http.Error(w, "Failed to create AI client", http.StatusInternalServerError)
+		return
+	}
+	// forceの場合はキャッシュも使わずに判定し直す
+	recorder := NewUsageRecorder(NewCachedClient(client, model, request.Force), account, "tag-effects")
+	defer recorder.Close()
+
+	response, err := tagEffects(r.Context(), recorder, tagRepository, effectIds, request.Force)
+	if err != nil {
+		log.Printf("Failed to tag effects: %v", err)
+		http.Error(w, "Failed to tag effects", http.StatusInternalServerError)
+		return
+	}
+	response.Usage = recorder.Records()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
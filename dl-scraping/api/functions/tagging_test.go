@@ -0,0 +1,216 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"asa-o.net/dl-scraping/functions/fakeupstream"
+)
+
+// useMemoryTags はテストの間だけメモリ上のタグの保存先を使う
+func useMemoryTags(t *testing.T) *MemoryTagRepository {
+	t.Helper()
+	repository := NewMemoryTagRepository()
+
+	getTagRepository()
+	previous, previousErr := tagRepository, tagRepositoryErr
+	tagRepository, tagRepositoryErr = repository, nil
+	t.Cleanup(func() {
+		tagRepository, tagRepositoryErr = previous, previousErr
+	})
+	return repository
+}
+
+// testTags はfakeupstreamの画像ごとにモデルが返すタグ
+var testTags = map[string]string{
+	"1": `{"colors": ["Blue", "white"], "mood": "calm", "characters": [], "season": "summer", "hasText": false}`,
+	"2": `{"colors": ["red", "black"], "mood": "festive", "characters": ["cat"], "season": "summer", "hasText": true}`,
+	"3": `{"colors": ["orange", "red"], "mood": "calm", "characters": [], "season": "autumn", "hasText": false}`,
+}
+
+// setupTaggingModel は添付された画像からエフェクトを見分けてtestTagsを返すモデルを用意する
+func setupTaggingModel(t *testing.T) *int32 {
+	t.Helper()
+	imageIds := make(map[string]string)
+	for id := range testTags {
+		imageIds[ImagePart{MimeType: "image/jpeg", Data: fakeupstream.ImageData(id)}.DataUrl()] = id
+	}
+
+	var calls int32
+	setupFakeOpenAi(t, func(request map[string]interface{}) string {
+		atomic.AddInt32(&calls, 1)
+		if request["response_format"] == nil {
+			t.Error("expected response_format to be sent")
+		}
+		urls := requestImageUrls(request)
+		if len(urls) != 1 {
+			t.Errorf("expected 1 image; got %d", len(urls))
+			return "{}"
+		}
+		return testTags[imageIds[urls[0]]]
+	})
+	return &calls
+}
+
+func postTagEffects(t *testing.T, request RequestTagEffects) (*httptest.ResponseRecorder, ResponseTagEffects) {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/tag-effects", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	TagEffects(response, req)
+
+	var res ResponseTagEffects
+	if response.Code == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return response, res
+}
+
+func TestTagEffects(t *testing.T) {
+	setupFakeUpstream(t)
+	t.Setenv("EFFECT_LIST_DELAY_MS", "0")
+	useMemoryCatalog(t)
+	useMemoryTags(t)
+	calls := setupTaggingModel(t)
+
+	// 保存済みの一覧がなければ404
+	response, _ := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("expected status NotFound; got %v", response.Code)
+	}
+
+	response, _ = postGetEffectList(t, RequestInfo{All: true, MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+
+	response, res := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v: %s", response.Code, response.Body)
+	}
+	if res.Tagged != 3 || len(res.Failed) != 0 {
+		t.Errorf("expected 3 tagged; got %+v", res)
+	}
+	tags := res.Tags["1"]
+	if tags == nil || tags.Mood != "calm" || tags.Season != "summer" || tags.Colors[0] != "blue" || tags.Model != "gpt-4o-mini-2024-07-18" {
+		t.Errorf("unexpected tags for 1: %+v", tags)
+	}
+
+	// タグ付け済みのものはモデルに送らない
+	response, res = postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword, EffectIds: []string{"1", "2"}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Skipped != 2 || res.Tagged != 0 || atomic.LoadInt32(calls) != 3 {
+		t.Errorf("expected tagged effects to be skipped; got %+v after %d calls", res, atomic.LoadInt32(calls))
+	}
+
+	// 一覧にタグが付き、タグで絞り込める
+	_, list := postGetEffectList(t, RequestInfo{Page: 1, MailAddress: testMailAddress, Password: testPassword})
+	if len(list.Effects) != 2 || list.Effects[0].Tags == nil {
+		t.Errorf("expected tagged effects; got %+v", list.Effects)
+	}
+	hasText := false
+	_, filtered := postGetEffectList(t, RequestInfo{All: true, MailAddress: testMailAddress, Password: testPassword, Filter: &EffectFilter{Mood: "Calm", HasText: &hasText}})
+	if len(filtered.Effects) != 2 || filtered.Effects[0].Id != "1" || filtered.Effects[1].Id != "3" {
+		t.Errorf("expected calm effects 1 and 3; got %+v", filtered.Effects)
+	}
+	_, filtered = postGetEffectList(t, RequestInfo{All: true, MailAddress: testMailAddress, Password: testPassword, Filter: &EffectFilter{Colors: []string{"red"}, Characters: []string{"cat"}}})
+	if len(filtered.Effects) != 1 || filtered.Effects[0].Id != "2" {
+		t.Errorf("expected effect 2; got %+v", filtered.Effects)
+	}
+}
+
+func TestTagEffects_failure(t *testing.T) {
+	setupFakeUpstream(t)
+	repository := useMemoryTags(t)
+	setupTaggingModel(t)
+
+	// 画像が取れないエフェクトは失敗として返し、残りは続ける
+	response, res := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword, EffectIds: []string{"1", "missing"}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", response.Code)
+	}
+	if res.Tagged != 1 || len(res.Failed) != 1 || res.Failed[0] != "missing" {
+		t.Errorf("expected 1 tagged and 1 failed; got %+v", res)
+	}
+	saved, _ := repository.Get(context.Background(), []string{"1", "missing"})
+	if len(saved) != 1 {
+		t.Errorf("expected only the tagged effect to be saved; got %v", saved)
+	}
+	// 取得した画像は画像の保存先に残り、他の機能と使い回す
+	store, _ := getImageStore()
+	if ok, _ := store.Exists(context.Background(), effectImageName("1")); !ok {
+		t.Error("expected the effect image to be stored")
+	}
+
+	response, _ = postTagEffects(t, RequestTagEffects{EffectIds: []string{"1"}, Model: "unknown"})
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("expected status BadRequest for unknown model; got %v", response.Code)
+	}
+}
+
+func TestTagEffects_zeroParallelism(t *testing.T) {
+	setupFakeUpstream(t)
+	useMemoryTags(t)
+	setupTaggingModel(t)
+	t.Setenv("AI_TAGGING_PARALLELISM", "0")
+
+	response, res := postTagEffects(t, RequestTagEffects{MailAddress: testMailAddress, Password: testPassword, EffectIds: []string{"1", "2"}})
+	if response.Code != http.StatusOK || res.Tagged != 2 {
+		t.Errorf("expected 2 tagged; got %v %+v", response.Code, res)
+	}
+}
+
+func TestTagEffects_requiresLogin(t *testing.T) {
+	setupFakeUpstream(t)
+	useMemoryTags(t)
+	calls := setupTaggingModel(t)
+
+	// 対象を指定してもメールアドレスだけではモデルを呼ばない
+	for _, request := range []RequestTagEffects{
+		{EffectIds: []string{"1"}},
+		{MailAddress: testMailAddress, EffectIds: []string{"1"}, Force: true},
+	} {
+		if response, _ := postTagEffects(t, request); response.Code != http.StatusUnauthorized {
+			t.Errorf("expected status Unauthorized; got %v", response.Code)
+		}
+	}
+	if atomic.LoadInt32(calls) != 0 {
+		t.Errorf("expected no model calls; got %d", atomic.LoadInt32(calls))
+	}
+}
+
+// strictTagRepository は空のIdを渡されると失敗する Firestoreと同じ
+type strictTagRepository struct {
+	*MemoryTagRepository
+}
+
+func (r strictTagRepository) Get(ctx context.Context, effectIds []string) (map[string]*EffectTags, error) {
+	for _, id := range effectIds {
+		if id == "" {
+			return nil, errors.New("empty effect id")
+		}
+	}
+	return r.MemoryTagRepository.Get(ctx, effectIds)
+}
+
+func Test_withTags_emptyId(t *testing.T) {
+	repository := useMemoryTags(t)
+	tagRepository = strictTagRepository{repository}
+	repository.Save(context.Background(), "1", &EffectTags{Mood: "calm"})
+
+	// Idのないエフェクトがあっても他のエフェクトは絞り込める
+	effects := withTags(context.Background(), []EffectInfo{{Id: "1"}, {Name: "no id"}, {Id: "2"}}, &EffectFilter{Mood: "calm"})
+	if len(effects) != 1 || effects[0].Id != "1" || effects[0].Tags == nil {
+		t.Errorf("unexpected effects: %+v", effects)
+	}
+}
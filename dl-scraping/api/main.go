@@ -5,7 +5,7 @@ import (
 	"log"
 	"os"
 
-	"asa-o.net/dl-scraping/functions/functions"
+	"asa-o.net/dl-scraping/functions"
 	"github.com/GoogleCloudPlatform/functions-framework-go/funcframework"
 )
 
@@ -16,6 +16,15 @@ func main() {
 	funcframework.RegisterHTTPFunctionContext(ctx, "/get-effect-list", functions.GetEffectList)
 	funcframework.RegisterHTTPFunctionContext(ctx, "/change-effect", functions.ChangeEffect)
 	funcframework.RegisterHTTPFunctionContext(ctx, "/get-effect-image", functions.GetEffectImage)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/stream-effect-list", functions.StreamEffectList)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/effect-diff", functions.EffectDiff)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/tag-effects", functions.TagEffects)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/search-effects", functions.SearchEffects)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/ai-usage", functions.AiUsage)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/ask-effects", functions.AskEffects)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/chat", functions.Chat)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/effect-image/", functions.EffectImage)
+	funcframework.RegisterHTTPFunctionContext(ctx, "/effect-images", functions.EffectImages)
 	port := "8081"
 	if envPort := os.Getenv("PORT"); envPort != "" {
 		port = envPort
@@ -27,12 +27,21 @@ class EffectService {
         },
         body: jsonData,
       });
+      // セッションが切れていたら、同じページからログインし直す
+      if (response.status === 401 && sessionId !== "") {
+        sessionId = "";
+        continue;
+      }
+      if (!response.ok) {
+        throw new Error(`Failed to get effect list: ${response.status}`);
+      }
       const responseData: ResponseGetEffectList = await response.json();
       this.renewalPossesionList(responseData.effects);
       this.downloadImage(responseData.effects);
       pagerNextExists = responseData.isNext;
       page++;
       progressCallback(responseData.effects);
+      sessionId = responseData.sessionId;
 
       ConnectInfoStore.set(ConnectInfoAtom, () => {
         return { dlSecKey: responseData.dlSecKey, sessionId: responseData.sessionId };
@@ -40,24 +49,31 @@ class EffectService {
     }
   }
 
-  downloadImage(effects: EffectInfo[]): void {
+  async downloadImage(effects: EffectInfo[]): Promise<void> {
+    if (effects.length === 0) {
+      return;
+    }
     try {
-      effects.map(async (effect) => {
-        const response = await fetch("https://asia-northeast1-asa-o-experiment.cloudfunctions.net/get-effect-image", {
+      // ページ分のサムネイルをまとめて取得する
+      const response = await fetch(
+        "https://asia-northeast1-asa-o-experiment.cloudfunctions.net/effect-images",
+        {
           method: "POST",
-          headers: {
-            "Content-Type": "application/json",
-          },
-          body: JSON.stringify({ effectId: effect.Id }),
-        });
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ effectIds: effects.map((effect) => effect.Id), format: "multipart" }),
+        }
+      );
+      if (!response.ok) {
+        return;
+      }
 
-        const data = await response.json();
-        if (data.succeed) {
-          const base64Response = await fetch(`data:image/jpeg;base64,${data.image}`);
-          const blob = await base64Response.blob();
-          LocalDB.getInstance().effectImage.add({ id: effect.Id, image: blob });
+      const formData = await response.formData();
+      for (const effect of effects) {
+        const image = formData.get(effect.Id);
+        if (image instanceof Blob) {
+          LocalDB.getInstance().effectImage.add({ id: effect.Id, image: image });
         }
-      });
+      }
     } catch (e) {
       console.error(e);
     }